@@ -0,0 +1,43 @@
+package define
+
+import (
+	"errors"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+//Encode marshal v to json []byte
+func Encode(v interface{}) ([]byte, error) {
+	return jsoniter.Marshal(v)
+}
+
+//Decode convert req.Params / req.Data / Call result (map[string]interface{}) to typed struct out
+func Decode(in interface{}, out interface{}) error {
+	jsonByte, err := jsoniter.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return jsoniter.Unmarshal(jsonByte, out)
+}
+
+//ParseIDs convert ids ([]string, []interface{} or "id1,id2") to []string
+func ParseIDs(ids interface{}) ([]string, error) {
+	ret := make([]string, 0)
+	switch ids.(type) {
+	case []string:
+		ret = ids.([]string)
+	case []interface{}:
+		_ids := ids.([]interface{})
+		for _, v := range _ids {
+			if sv, ok := v.(string); ok {
+				ret = append(ret, sv)
+			}
+		}
+	case string:
+		ret = strings.Split(ids.(string), ",")
+	default:
+		return nil, errors.New("can't parse ids")
+	}
+	return ret, nil
+}
@@ -0,0 +1,57 @@
+//Package define holds the event/action names and payload structs shared by
+//all micro-services, so the wire contract is declared only once.
+package define
+
+//RPC定义(带Action为RPC call, 其它为RPC broadcast)
+const (
+	WsConnectorActionPush       = "ws-connector.push"              //in: PushMsgStruct || out: null, err
+	WsConnectorActionCount      = "ws-connector.count"             //in: null || out: count, err
+	WsConnectorActionMetrics    = "ws-connector.metrics"           //in: null || out: MetricsStruct, err
+	WsConnectorActionUserInfo   = "ws-connector.userInfo"          //in: UserIDStruct || out: []ClientInfo, err
+	WsConnectorActionDrain      = "ws-connector.drain"             //in: DrainStruct || out: DrainResultStruct, err
+	WsConnectorActionRateLimit  = "ws-connector.rateLimit"         //in: RateLimitStruct || out: RateLimitStruct, err
+	WsConnectorInPush           = "ws-connector.in.push"           //PushMsgStruct
+	WsConnectorInPublish        = "ws-connector.in.publish"        //PublishStruct
+	WsConnectorInKickClient     = "ws-connector.in.kickClient"     //CidStruct
+	WsConnectorInKickUser       = "ws-connector.in.kickUser"       //UserIDStruct
+	WsConnectorOutOnline        = "ws-connector.out.online"        //ClientInfo
+	WsConnectorOutOffline       = "ws-connector.out.offline"       //ClientInfo
+	WsConnectorInSyncUsersInfo  = "ws-connector.in.syncUsersInfo"  //null || SyncUsersInfoStruct
+	WsConnectorOutSyncUsersInfo = "ws-connector.out.syncUsersInfo" //ClientInfo
+	WsConnectorOutAck           = "ws-connector.out.ack"           //AckStruct
+	WsConnectorOutMessage       = "ws-connector.out.message"       //UpstreamMsgStruct
+	WsConnectorInSyncMetrics    = "ws-connector.in.syncMetrics"    //null
+	WsConnectorOutSyncMetrics   = "ws-connector.out.syncMetrics"   //MetricsStruct
+	WsConnectorOutHeartbeat     = "ws-connector.out.heartbeat"     //HeartbeatStruct
+
+	WsTokenActionVerify     = "ws-token.verify"        //in: VerifyTokenStruct || out: VerifyTokenResultStruct, err
+	WsTokenActionIssue      = "ws-token.issue"         //in: IssueTokenStruct || out: IssueTokenResultStruct, err
+	WsTokenActionRevoke     = "ws-token.revoke"        //in: RevokeTokenStruct || out: null, err
+	WsTokenActionReloadKeys = "ws-token.reloadKeys"    //in: null || out: null, err
+	WsTokenInRevoke         = "ws-token.in.revoke"     //RevokeTokenStruct
+	WsTokenInReloadKeys     = "ws-token.in.reloadKeys" //null
+
+	WsOnlineActionOnlineStatus     = "ws-online.onlineStatus"     //in: UserIDStruct || out: OnlineStatusStruct, err
+	WsOnlineActionOnlineStatusBulk = "ws-online.onlineStatusBulk" //in: IDsStruct || out: OnlineStatusBulkStruct, err
+	WsOnlineOutOnline              = "ws-online.out.online"       //ClientInfo
+	WsOnlineOutOffline             = "ws-online.out.offline"      //ClientInfo
+
+	WsSenderActionSend    = "ws-sender.send"          //in: PushMsgStruct || out: null, err
+	WsSenderActionStatus  = "ws-sender.status"        //in: MidStruct || out: MsgStatusStruct, err
+	WsSenderActionMetrics = "ws-sender.metrics"       //in: null || out: SenderMetricsStruct, err
+	WsSenderOutDelivered  = "ws-sender.out.delivered" //DeliveryStatusStruct
+
+	WsCacheActionSave = "ws-cache.save" //in: CacheMsgStruct || out: null, err
+
+	WsAnalyzeActionSummary = "ws-analyze.summary" //in: null || out: ClusterSummaryStruct, err
+)
+
+//delivery state of one message to one client: pending -> pushed -> acked / cached -> redelivered / expired
+const (
+	DeliveryStatePending     = "pending"     //ws-sender.send received, not pushed yet
+	DeliveryStatePushed      = "pushed"      //ws-connector.push done, wait ack
+	DeliveryStateAcked       = "acked"       //client ack received
+	DeliveryStateCached      = "cached"      //client offline or ack timeout, saved to ws-cache
+	DeliveryStateRedelivered = "redelivered" //pushed again from ws-cache after client online
+	DeliveryStateExpired     = "expired"     //not acked in time
+)
@@ -0,0 +1,67 @@
+package define
+
+import (
+	"strconv"
+	"time"
+)
+
+//DropReasonExpired msg dropped because expireAt passed
+const DropReasonExpired = "expired"
+
+//ExpireAtFromTTL return expireAt timestamp (ms) of ttl seconds later, empty if ttl <= 0
+func ExpireAtFromTTL(ttl int) string {
+	expireAt := ""
+	applyTTL(&ttl, &expireAt, time.Now())
+	return expireAt
+}
+
+//IsExpired check expireAt timestamp (ms), empty or invalid expireAt never expire
+func IsExpired(expireAt string, now time.Time) bool {
+	if len(expireAt) < 1 {
+		return false
+	}
+	ms, err := strconv.ParseInt(expireAt, 10, 64)
+	if err != nil {
+		return false
+	}
+	return now.UnixNano()/1e6 >= ms
+}
+
+//applyTTL expireAt of ttl seconds after now if it is not set, ttl is cleared so it is never applied twice
+func applyTTL(ttl *int, expireAt *string, now time.Time) {
+	if *ttl > 0 && len(*expireAt) < 1 {
+		*expireAt = Timestamp(now.Add(time.Second * time.Duration(*ttl)))
+	}
+	*ttl = 0
+}
+
+//ApplyTTL convert TTL to ExpireAt, every entry point (ws-sender.send, ws-connector.push/publish, ws-cache.save)
+//call it once after decode, so a ttl counts from the first service that received it
+func (d *PushMsgDataStruct) ApplyTTL(now time.Time) {
+	if d != nil {
+		applyTTL(&d.TTL, &d.ExpireAt, now)
+	}
+}
+
+//ApplyTTL same as PushMsgDataStruct.ApplyTTL
+func (c *CacheMsgStruct) ApplyTTL(now time.Time) {
+	if c != nil {
+		applyTTL(&c.TTL, &c.ExpireAt, now)
+	}
+}
+
+//IsExpired nil data never expire
+func (d *PushMsgDataStruct) IsExpired(now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	return IsExpired(d.ExpireAt, now)
+}
+
+//IsExpired nil msg never expire
+func (c *CacheMsgStruct) IsExpired(now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	return IsExpired(c.ExpireAt, now)
+}
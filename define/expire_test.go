@@ -0,0 +1,99 @@
+package define
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpireAtFromTTL(t *testing.T) {
+	before := time.Now().UnixNano() / 1e6
+	expireAt := ExpireAtFromTTL(60)
+	after := time.Now().UnixNano() / 1e6
+	ms, err := strconv.ParseInt(expireAt, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms < before+60000 || ms > after+60000 {
+		t.Fatalf("expireAt %d not 60s after [%d, %d]", ms, before, after)
+	}
+	if got := ExpireAtFromTTL(0); got != "" {
+		t.Fatalf("ttl 0 expireAt %q, want empty", got)
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		expireAt string
+		want     bool
+	}{
+		{"", false},
+		{"abc", false},
+		{Timestamp(now.Add(time.Millisecond)), false},
+		{Timestamp(now), true},
+		{Timestamp(now.Add(-time.Second)), true},
+	}
+	for _, c := range cases {
+		if got := IsExpired(c.expireAt, now); got != c.want {
+			t.Errorf("IsExpired(%q) = %v, want %v", c.expireAt, got, c.want)
+		}
+		if got := (&PushMsgDataStruct{ExpireAt: c.expireAt}).IsExpired(now); got != c.want {
+			t.Errorf("PushMsgDataStruct.IsExpired(%q) = %v, want %v", c.expireAt, got, c.want)
+		}
+		if got := (&CacheMsgStruct{ExpireAt: c.expireAt}).IsExpired(now); got != c.want {
+			t.Errorf("CacheMsgStruct.IsExpired(%q) = %v, want %v", c.expireAt, got, c.want)
+		}
+	}
+}
+
+func TestApplyTTL(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	d := &PushMsgDataStruct{TTL: 30}
+	d.ApplyTTL(now)
+	if d.ExpireAt != Timestamp(now.Add(time.Second*30)) || d.TTL != 0 {
+		t.Fatalf("ttl 30: expireAt %s ttl %d", d.ExpireAt, d.TTL)
+	}
+	//applied once, a later entry point does not move it
+	d.ApplyTTL(now.Add(time.Minute))
+	if d.ExpireAt != Timestamp(now.Add(time.Second*30)) {
+		t.Fatalf("applied twice: expireAt %s", d.ExpireAt)
+	}
+	if !d.IsExpired(now.Add(time.Second*30)) || d.IsExpired(now.Add(time.Second*29)) {
+		t.Fatal("IsExpired does not follow ttl")
+	}
+
+	//expireAt wins over ttl
+	d = &PushMsgDataStruct{TTL: 30, ExpireAt: "1500000001000"}
+	d.ApplyTTL(now)
+	if d.ExpireAt != "1500000001000" {
+		t.Fatalf("expireAt changed to %s", d.ExpireAt)
+	}
+
+	d = &PushMsgDataStruct{}
+	d.ApplyTTL(now)
+	if d.ExpireAt != "" || d.IsExpired(now.Add(time.Hour*24*365)) {
+		t.Fatalf("no ttl: expireAt %q", d.ExpireAt)
+	}
+
+	c := &CacheMsgStruct{TTL: 5}
+	c.ApplyTTL(now)
+	if c.ExpireAt != Timestamp(now.Add(time.Second*5)) || c.TTL != 0 {
+		t.Fatalf("cache msg ttl 5: expireAt %s ttl %d", c.ExpireAt, c.TTL)
+	}
+
+	var nilData *PushMsgDataStruct
+	nilData.ApplyTTL(now)
+}
+
+func TestIsExpiredNil(t *testing.T) {
+	var d *PushMsgDataStruct
+	if d.IsExpired(time.Now()) {
+		t.Error("nil PushMsgDataStruct expired")
+	}
+	var c *CacheMsgStruct
+	if c.IsExpired(time.Now()) {
+		t.Error("nil CacheMsgStruct expired")
+	}
+}
@@ -0,0 +1,56 @@
+package define
+
+//FrameVersion current client frame version, frames with bigger "v" are rejected
+const FrameVersion = 1
+
+//client frame types
+const (
+	FrameTypeAck         = "ack"         //client -> server: id is mid of pushed msg; server -> client: upstream msg accepted
+	FrameTypePing        = "ping"        //client -> server, server reply pong with same id
+	FrameTypePong        = "pong"        //server -> client
+	FrameTypeSubscribe   = "subscribe"   //client -> server, payload TopicsStruct
+	FrameTypeUnsubscribe = "unsubscribe" //client -> server, payload TopicsStruct
+	FrameTypeMessage     = "message"     //client -> server, payload is business data, forward by WsConnectorOutMessage
+	FrameTypeError       = "error"       //server -> client, payload FrameErrorStruct
+	FrameTypeReconnect   = "reconnect"   //server -> client, payload ReconnectStruct, node is draining
+)
+
+//error frame codes
+const (
+	FrameErrorBadFrame    = "bad_frame"
+	FrameErrorBadVersion  = "bad_version"
+	FrameErrorUnknownType = "unknown_type"
+	FrameErrorBadPayload  = "bad_payload"
+)
+
+//FrameStruct client frame envelope, {"v":1,"type":"message","id":"c1","payload":{...}}
+type FrameStruct struct {
+	V       int         `json:"v,omitempty"`
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+//FrameErrorStruct ...
+type FrameErrorStruct struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//TopicsStruct ...
+type TopicsStruct struct {
+	Topics []string `json:"topics"`
+}
+
+//UpstreamMsgStruct business message from client
+type UpstreamMsgStruct struct {
+	ID      string      `json:"id"`
+	Payload interface{} `json:"payload"`
+	Client  *ClientInfo `json:"client"`
+}
+
+//ReconnectStruct client should reconnect (to another node) after delayMs, the node will close it soon
+type ReconnectStruct struct {
+	DelayMs int64  `json:"delayMs"`
+	Reason  string `json:"reason"`
+}
@@ -0,0 +1,145 @@
+package define
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//push -> deliver -> ack pipeline stages
+const (
+	LatencyLookup      = "lookup"        //ws-sender: send received -> ws-online lookup done
+	LatencySendToPush  = "send_to_push"  //ws-sender send received -> ws-connector push received, cross node clocks
+	LatencyPushToWrite = "push_to_write" //ws-connector: push received -> frame written by writePump
+	LatencyWriteToAck  = "write_to_ack"  //ws-connector: frame written -> ack from client
+	LatencySendToAck   = "send_to_ack"   //ws-sender: send received -> ack, end to end
+)
+
+//DeliveryBuckets histogram upper bounds in seconds for delivery stages, acks may take minutes with retries
+var DeliveryBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+//LatencyStruct one stage in milliseconds, percentiles are interpolated in histogram buckets
+type LatencyStruct struct {
+	Count uint64  `json:"count"`
+	Avg   float64 `json:"avg"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+//Timestamp t as ms string, same as other timestamps in structs
+func Timestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/1e6, 10)
+}
+
+//ParseTimestamp ms string to time, ok is false for empty or invalid ts
+func ParseTimestamp(ts string) (time.Time, bool) {
+	if len(ts) < 1 {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(ms/1e3, ms%1e3*1e6), true
+}
+
+//Percentile q (0~1) of observed durations, linear in the bucket it falls into.
+//values in the +Inf bucket are reported as the last bound
+func (h *Histogram) Percentile(q float64) time.Duration {
+	counts, count, _ := h.snapshot()
+	if count == 0 {
+		return 0
+	}
+	rank := q * float64(count)
+	var cumulative float64
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if cumulative+float64(c) >= rank {
+			if i >= len(h.bounds) {
+				return secondsToDuration(h.bounds[len(h.bounds)-1])
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = h.bounds[i-1]
+			}
+			upper := h.bounds[i]
+			return secondsToDuration(lower + (upper-lower)*(rank-cumulative)/float64(c))
+		}
+		cumulative += float64(c)
+	}
+	return secondsToDuration(h.bounds[len(h.bounds)-1])
+}
+
+//Latency count, avg and percentiles in milliseconds
+func (h *Histogram) Latency() *LatencyStruct {
+	_, count, sum := h.snapshot()
+	ret := &LatencyStruct{
+		Count: count,
+		P50:   durationToMs(h.Percentile(0.5)),
+		P90:   durationToMs(h.Percentile(0.9)),
+		P99:   durationToMs(h.Percentile(0.99)),
+	}
+	if count > 0 {
+		ret.Avg = sum * 1e3 / float64(count)
+	}
+	return ret
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+//LatencyStats delivery histograms by stage
+type LatencyStats struct {
+	stages sync.Map //sync.Map[string(stage)]*Histogram
+}
+
+//Observe add duration d to stage
+func (s *LatencyStats) Observe(stage string, d time.Duration) {
+	h, ok := s.stages.Load(stage)
+	if !ok {
+		h, _ = s.stages.LoadOrStore(stage, NewHistogram(DeliveryBuckets))
+	}
+	h.(*Histogram).Observe(d)
+}
+
+//ObserveSince add time since start to stage, zero start is ignored
+func (s *LatencyStats) ObserveSince(stage string, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	s.Observe(stage, time.Since(start))
+}
+
+//Latency percentiles of all observed stages
+func (s *LatencyStats) Latency() map[string]*LatencyStruct {
+	ret := make(map[string]*LatencyStruct)
+	s.stages.Range(func(key, value interface{}) bool {
+		ret[key.(string)] = value.(*Histogram).Latency()
+		return true
+	})
+	return ret
+}
+
+//WriteProm write histogram name with label stage
+func (s *LatencyStats) WriteProm(p *PromWriter, name string) {
+	stages := make([]string, 0)
+	s.stages.Range(func(key, value interface{}) bool {
+		stages = append(stages, key.(string))
+		return true
+	})
+	sort.Strings(stages)
+	for _, stage := range stages {
+		if h, ok := s.stages.Load(stage); ok {
+			p.Histogram(name, "push -> deliver -> ack latency by stage", h.(*Histogram), "stage", stage)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package define
+
+import "strconv"
+
+//NewerThan c and old are updates of the same Cid (Cid includes NodeID). c is newer if it comes from
+//a later process epoch, a later connection, or a later event of the same connection.
+//updates without Seq (older ws-connector) are always newer
+func (c *ClientInfo) NewerThan(old *ClientInfo) bool {
+	if old == nil || c.Seq == 0 || old.Seq == 0 {
+		return true
+	}
+	if c.Epoch != old.Epoch {
+		return epochLess(old.Epoch, c.Epoch)
+	}
+	if c.ConnSeq != old.ConnSeq {
+		return c.ConnSeq > old.ConnSeq
+	}
+	return c.Seq > old.Seq
+}
+
+//SameEvent c and old are the same event of the same connection
+func (c *ClientInfo) SameEvent(old *ClientInfo) bool {
+	return old != nil && c.Epoch == old.Epoch && c.ConnSeq == old.ConnSeq && c.Seq == old.Seq
+}
+
+func epochLess(a string, b string) bool {
+	ai, errA := strconv.ParseInt(a, 10, 64)
+	bi, errB := strconv.ParseInt(b, 10, 64)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ai < bi
+}
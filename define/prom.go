@@ -0,0 +1,245 @@
+package define
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/moleculer-go/protocol"
+)
+
+//PromContentType prometheus text exposition format
+const PromContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//LatencyBuckets default histogram upper bounds in seconds
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//PromWriter write metrics in prometheus text format,
+//samples of the same metric name must be written one after another
+type PromWriter struct {
+	w     *bufio.Writer
+	typed map[string]bool
+}
+
+//NewPromWriter ...
+func NewPromWriter(w io.Writer) *PromWriter {
+	return &PromWriter{
+		w:     bufio.NewWriter(w),
+		typed: make(map[string]bool),
+	}
+}
+
+//Flush ...
+func (p *PromWriter) Flush() error {
+	return p.w.Flush()
+}
+
+//Counter labels are name, value pairs
+func (p *PromWriter) Counter(name string, help string, value float64, labels ...string) {
+	p.header(name, help, "counter")
+	p.sample(name, value, labels)
+}
+
+//Gauge labels are name, value pairs
+func (p *PromWriter) Gauge(name string, help string, value float64, labels ...string) {
+	p.header(name, help, "gauge")
+	p.sample(name, value, labels)
+}
+
+//Histogram write _bucket, _sum and _count of h, labels are name, value pairs
+func (p *PromWriter) Histogram(name string, help string, h *Histogram, labels ...string) {
+	p.header(name, help, "histogram")
+	counts, count, sum := h.snapshot()
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		p.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatPromValue(bound)))
+	}
+	p.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf"))
+	p.sample(name+"_sum", sum, labels)
+	p.sample(name+"_count", float64(count), labels)
+}
+
+func (p *PromWriter) header(name string, help string, typ string) {
+	if p.typed[name] {
+		return
+	}
+	p.typed[name] = true
+	p.w.WriteString("# HELP " + name + " " + strings.Replace(help, "\n", " ", -1) + "\n")
+	p.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func (p *PromWriter) sample(name string, value float64, labels []string) {
+	p.w.WriteString(name)
+	if len(labels) > 1 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			p.w.WriteString(labels[i] + "=\"" + escapePromLabel(labels[i+1]) + "\"")
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteString(" " + formatPromValue(value) + "\n")
+}
+
+var promLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePromLabel(v string) string {
+	return promLabelReplacer.Replace(v)
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//PromHandler serve /metrics, write is called on every scrape
+func PromHandler(write func(p *PromWriter)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", PromContentType)
+		p := NewPromWriter(w)
+		write(p)
+		p.Flush()
+	}
+}
+
+//StartPromService serve /metrics on http port, port < 1 to disable.
+//Only listen error is returned, metrics are not worth exiting the process for
+func StartPromService(port int, write func(p *PromWriter)) error {
+	if port < 1 {
+		return nil
+	}
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", PromHandler(write))
+	go http.Serve(ln, mux)
+	return nil
+}
+
+//SortedKeys keys of m in order, for stable label order
+func SortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Histogram latency histogram with fixed buckets (seconds), Observe is lock free
+type Histogram struct {
+	bounds    []float64
+	counts    []uint64 //counts[i] observations <= bounds[i], last one for +Inf
+	count     uint64
+	sumMicros uint64
+}
+
+//NewHistogram bounds must be sorted, nil use LatencyBuckets
+func NewHistogram(bounds []float64) *Histogram {
+	if bounds == nil {
+		bounds = LatencyBuckets
+	}
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+//Observe add one duration
+func (h *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumMicros, uint64(d/time.Microsecond))
+	atomic.AddUint64(&h.count, 1)
+}
+
+//Count ...
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	counts := make([]uint64, len(h.counts))
+	var count uint64
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		count += counts[i]
+	}
+	return counts, count, float64(atomic.LoadUint64(&h.sumMicros)) / 1e6
+}
+
+//RPCStats latency and error count of rpc calls (in and out) by name
+type RPCStats struct {
+	stats sync.Map //sync.Map[string(name)]*rpcStat
+}
+
+type rpcStat struct {
+	latency *Histogram
+	errors  uint64
+}
+
+//Observe record one rpc started at start, err != nil count as error
+func (s *RPCStats) Observe(name string, start time.Time, err error) {
+	stat, ok := s.stats.Load(name)
+	if !ok {
+		stat, _ = s.stats.LoadOrStore(name, &rpcStat{latency: NewHistogram(nil)})
+	}
+	statObj := stat.(*rpcStat)
+	statObj.latency.Observe(time.Since(start))
+	if err != nil {
+		atomic.AddUint64(&statObj.errors, 1)
+	}
+}
+
+//TimedAction wrap action handler to record its latency and errors in s
+func TimedAction(s *RPCStats, name string, handler func(req *protocol.MsRequest) (interface{}, error)) func(req *protocol.MsRequest) (interface{}, error) {
+	return func(req *protocol.MsRequest) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(req)
+		s.Observe(name, start, err)
+		return res, err
+	}
+}
+
+//WriteProm write <prefix>_rpc_duration_seconds and <prefix>_rpc_errors_total
+func (s *RPCStats) WriteProm(p *PromWriter, prefix string) {
+	names := make([]string, 0)
+	s.stats.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		if stat, ok := s.stats.Load(name); ok {
+			p.Histogram(prefix+"_rpc_duration_seconds", "rpc latency by action, in and out", stat.(*rpcStat).latency, "rpc", name)
+		}
+	}
+	for _, name := range names {
+		if stat, ok := s.stats.Load(name); ok {
+			p.Counter(prefix+"_rpc_errors_total", "rpc errors by action", float64(atomic.LoadUint64(&stat.(*rpcStat).errors)), "rpc", name)
+		}
+	}
+}
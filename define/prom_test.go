@@ -0,0 +1,77 @@
+package define
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roytan883/moleculer-go/protocol"
+)
+
+func TestStartPromService(t *testing.T) {
+	if err := StartPromService(0, func(p *PromWriter) {}); err != nil {
+		t.Fatalf("port 0 should disable, got %v", err)
+	}
+
+	//take a free port, then serve on it
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	err = StartPromService(port, func(p *PromWriter) {
+		p.Gauge("test_up", "test gauge", 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "test_up 1\n") {
+		t.Fatalf("/metrics body: %s", body)
+	}
+
+	//port in use is returned, not fatal
+	if err := StartPromService(port, func(p *PromWriter) {}); err == nil {
+		t.Fatal("listen on a used port succeeded")
+	}
+}
+
+func TestTimedAction(t *testing.T) {
+	stats := &RPCStats{}
+	fail := true
+	handler := TimedAction(stats, "test.action", func(req *protocol.MsRequest) (interface{}, error) {
+		if fail {
+			return nil, errors.New("fail")
+		}
+		return "ok", nil
+	})
+	handler(&protocol.MsRequest{})
+	fail = false
+	if res, err := handler(&protocol.MsRequest{}); res != "ok" || err != nil {
+		t.Fatalf("handler result changed: %v %v", res, err)
+	}
+	stat, ok := stats.stats.Load("test.action")
+	if !ok {
+		t.Fatal("no stats recorded")
+	}
+	if count, errs := stat.(*rpcStat).latency.Count(), stat.(*rpcStat).errors; count != 2 || errs != 1 {
+		t.Fatalf("count %d errors %d, want 2 and 1", count, errs)
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	got := strings.Join(SortedKeys(map[string]int{"web": 1, "android": 2, "ios": 3}), ",")
+	if got != "android,ios,web" {
+		t.Fatalf("SortedKeys %s", got)
+	}
+}
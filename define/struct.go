@@ -0,0 +1,327 @@
+package define
+
+import (
+	jsoniter "github.com/json-iterator/go"
+)
+
+//AckStruct ...
+type AckStruct struct {
+	Aid    string `json:"aid"`
+	Cid    string `json:"cid"`
+	UserID string `json:"userID"`
+}
+
+//PushMsgStruct ...
+//IDs can be []string, []interface{} or comma separated string, use ParseIDs to read it
+type PushMsgStruct struct {
+	IDs    interface{}        `json:"ids"`
+	Data   *PushMsgDataStruct `json:"data"`
+	Retry  *RetryStruct       `json:"retry,omitempty"`  //only for ws-sender.send, empty fields use ws-sender flags
+	Target *TargetStruct      `json:"target,omitempty"` //only push to matched clients of ids
+
+	Msgs []*PushMsgStruct `json:"msgs,omitempty"` //ordered batch instead of ids and data, each client gets them in this order
+
+	SendTime string `json:"sendTime,omitempty"` //timestamp (ms) ws-sender.send received, set by ws-sender for latency
+}
+
+//RetryStruct ...
+//MaxAttempts include the first push, 1 means move to ws-cache when first wait ack timeout
+type RetryStruct struct {
+	MaxAttempts       int `json:"maxAttempts,omitempty"`
+	WaitAckSeconds    int `json:"waitAckSeconds,omitempty"`
+	MaxBackoffSeconds int `json:"maxBackoffSeconds,omitempty"`
+}
+
+//PushMsgDataStruct ...
+type PushMsgDataStruct struct {
+	Mid         string      `json:"mid"`
+	Msg         interface{} `json:"msg"`
+	CollapseKey string      `json:"collapseKey,omitempty"` //ws-cache keep only the newest offline msg with same key
+	TTL         int         `json:"ttl,omitempty"`         //seconds after received, ApplyTTL convert it to ExpireAt
+	ExpireAt    string      `json:"expireAt,omitempty"`    //timestamp (ms), never push, retry or redeliver after it
+}
+
+//CacheMsgStruct ...
+type CacheMsgStruct struct {
+	UserID      string        `json:"userID"`
+	Cid         string        `json:"cid"`
+	Timestamp   string        `json:"timestamp"`
+	Mid         string        `json:"mid"`
+	Msg         interface{}   `json:"msg"`
+	CollapseKey string        `json:"collapseKey,omitempty"`
+	TTL         int           `json:"ttl,omitempty"` //seconds after received, ApplyTTL convert it to ExpireAt
+	ExpireAt    string        `json:"expireAt,omitempty"`
+	Target      *TargetStruct `json:"target,omitempty"`
+}
+
+//MidStruct ...
+//UserID is optional, only return this user's recipients when set
+type MidStruct struct {
+	Mid    string `json:"mid"`
+	UserID string `json:"userID"`
+}
+
+//DeliveryStatusStruct ...
+//UpdateTime: ms timestamp of the last state change
+type DeliveryStatusStruct struct {
+	Mid        string `json:"mid"`
+	UserID     string `json:"userID"`
+	Cid        string `json:"cid"`
+	State      string `json:"state"`
+	UpdateTime string `json:"updateTime"`
+}
+
+//MsgStatusStruct ...
+type MsgStatusStruct struct {
+	Mid        string                  `json:"mid"`
+	Recipients []*DeliveryStatusStruct `json:"recipients"`
+}
+
+//PublishStruct push to all clients subscribed Topic on every ws-connector
+type PublishStruct struct {
+	Topic  string             `json:"topic"`
+	Data   *PushMsgDataStruct `json:"data"`
+	Target *TargetStruct      `json:"target,omitempty"`
+}
+
+//SubscribeStruct old client control frame, {"sub":["news"]} or {"unsub":["news"]}, use FrameTypeSubscribe now
+type SubscribeStruct struct {
+	Sub   []string `json:"sub,omitempty"`
+	Unsub []string `json:"unsub,omitempty"`
+}
+
+//CidStruct ...
+type CidStruct struct {
+	Cid string `json:"cid"`
+}
+
+//UserIDStruct ...
+type UserIDStruct struct {
+	UserID string `json:"userID"`
+}
+
+//IDsStruct ...
+type IDsStruct struct {
+	IDs interface{} `json:"ids"`
+}
+
+//VerifyTokenStruct ...
+type VerifyTokenStruct struct {
+	URL       string `json:"url"`
+	UserID    string `json:"userID"`
+	Platform  string `json:"platform"`
+	Version   string `json:"version"`
+	Timestamp string `json:"timestamp"`
+	Token     string `json:"token"`
+}
+
+func (v *VerifyTokenStruct) String() string {
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+//VerifyTokenResultStruct ...
+type VerifyTokenResultStruct struct {
+	Invalid bool `json:"invalid"` //GO default bool is false, so use invalid == true to detect invalid token
+}
+
+//IssueTokenStruct ...
+type IssueTokenStruct struct {
+	UserID   string `json:"userID"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+}
+
+//IssueTokenResultStruct ...
+//client connect ws-connector with ?userID=&platform=&version=&timestamp=&token=
+type IssueTokenResultStruct struct {
+	Timestamp string `json:"timestamp"`
+	Token     string `json:"token"`
+}
+
+//RevokeTokenStruct ...
+//Token: revoke one token; UserID: revoke all tokens of userID issued before Timestamp(ms, default now)
+type RevokeTokenStruct struct {
+	Token     string `json:"token"`
+	UserID    string `json:"userID"`
+	Timestamp string `json:"timestamp"`
+}
+
+//ClientInfo ...
+type ClientInfo struct {
+	NodeID         string `json:"nodeID"`
+	Cid            string `json:"cid"`
+	UserID         string `json:"userID"`
+	Platform       string `json:"platform"`
+	Version        string `json:"version"`
+	Timestamp      string `json:"timestamp"`
+	Token          string `json:"token"`
+	ConnectTime    string `json:"connectTime"`
+	DisconnectTime string `json:"disconnectTime"`
+	IsOnline       bool   `json:"isOnline"`
+	Reason         string `json:"reason,omitempty"`  //offline reason code, empty for normal disconnect
+	Dropped        uint64 `json:"dropped,omitempty"` //msgs dropped because client is too slow
+	Epoch          string `json:"epoch,omitempty"`   //ws-connector process epoch, see HeartbeatStruct
+	ConnSeq        uint64 `json:"connSeq,omitempty"` //connection number in the process, later connection of same Cid is bigger
+	Seq            uint64 `json:"seq,omitempty"`     //event number of the connection, online 1, offline is the last
+}
+
+//OfflineReasonSlowConsumer client disconnected because its send queue is full
+const OfflineReasonSlowConsumer = "slow_consumer"
+
+//OfflineReasonDrain client disconnected because its node is draining
+const OfflineReasonDrain = "drain"
+
+//OfflineReasonNodeLapsed ws-online expired the client because its node stopped heartbeating
+const OfflineReasonNodeLapsed = "node_lapsed"
+
+//OfflineReasonNodeRestarted ws-online expired the client because its node restarted (new epoch)
+const OfflineReasonNodeRestarted = "node_restarted"
+
+//HeartbeatStruct ws-connector is alive, Epoch changes when the process restarts
+type HeartbeatStruct struct {
+	NodeID          string `json:"nodeID"`
+	Epoch           string `json:"epoch"` //process start timestamp (ms)
+	Clients         int64  `json:"clients"`
+	Time            string `json:"time"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+}
+
+//SyncUsersInfoStruct empty NodeID ask every ws-connector, otherwise only that node
+type SyncUsersInfoStruct struct {
+	NodeID string `json:"nodeID,omitempty"`
+}
+
+//DropReasonSlowConsumer msg dropped because client send queue is full
+const DropReasonSlowConsumer = "slow_consumer"
+
+//DrainStruct ...
+type DrainStruct struct {
+	WindowSeconds int `json:"windowSeconds,omitempty"` //disconnect clients gradually in seconds, 0 use node default
+}
+
+//DrainResultStruct ...
+type DrainResultStruct struct {
+	NodeID          string `json:"nodeID"`
+	Clients         int    `json:"clients"` //clients to disconnect
+	WindowSeconds   int    `json:"windowSeconds"`
+	AlreadyDraining bool   `json:"alreadyDraining"`
+}
+
+//RateLimitStruct RPS and burst of ws-connector in/out pools, RPS 0 only query
+type RateLimitStruct struct {
+	NodeID string `json:"nodeID,omitempty"`
+	RPS    int    `json:"rps,omitempty"`
+	Burst  int    `json:"burst,omitempty"` //0 use RPS/10
+}
+
+//PoolStatsStruct backpressure of one ws-connector handler pool
+type PoolStatsStruct struct {
+	Name     string  `json:"name"`
+	Workers  int     `json:"workers"` //0 goroutine per item
+	Queued   int64   `json:"queued"`
+	InFlight int64   `json:"inFlight"` //taken from queue, handler not returned
+	Rejected uint64  `json:"rejected"`
+	Handled  uint64  `json:"handled"`
+	P99      float64 `json:"p99"` //handler time in ms
+}
+
+//MetricsStruct ...
+type MetricsStruct struct {
+	NodeID           string `json:"nodeID"`
+	Port             int    `json:"port"`
+	OnlineUsers      uint64 `json:"onlineUsers"`
+	TotalTrySend     uint64 `json:"totalTrySend"`
+	TotalSend        uint64 `json:"totalSend"`
+	TotalTryAck      uint64 `json:"totalTryAck"`
+	TotalAck         uint64 `json:"totalAck"`
+	CurrentAccepting int64  `json:"currentAccepting"`
+
+	RejectBusy         uint64 `json:"rejectBusy"`         //too many concurrent accepting
+	RejectParams       uint64 `json:"rejectParams"`       //missing query values
+	RejectInvalidToken uint64 `json:"rejectInvalidToken"` //ws-token.verify return invalid
+	RejectVerifyError  uint64 `json:"rejectVerifyError"`  //ws-token.verify error and policy reject
+	VerifyErrorPass    uint64 `json:"verifyErrorPass"`    //ws-token.verify error but policy allow
+	VerifyCacheHit     uint64 `json:"verifyCacheHit"`
+
+	Topics          uint64 `json:"topics"`
+	TotalTryPublish uint64 `json:"totalTryPublish"`
+
+	TotalUpstream uint64 `json:"totalUpstream"`
+	TotalBadFrame uint64 `json:"totalBadFrame"`
+
+	Encodings map[string]uint64 `json:"encodings,omitempty"` //clients by frame encoding
+
+	BytesSent           uint64 `json:"bytesSent"`           //all frames payload bytes
+	BytesBeforeCompress uint64 `json:"bytesBeforeCompress"` //payload bytes of compressed frames
+	BytesAfterCompress  uint64 `json:"bytesAfterCompress"`  //same frames after permessage-deflate
+
+	Drops map[string]uint64 `json:"drops,omitempty"` //dropped push msgs by reason
+
+	PoolDrops map[string]uint64  `json:"poolDrops,omitempty"` //RunGoPool items dropped by "pool.class"
+	Pools     []*PoolStatsStruct `json:"pools,omitempty"`
+
+	SlowConsumerDropped    uint64 `json:"slowConsumerDropped"`    //new msgs dropped, policy drop
+	SlowConsumerDropOldest uint64 `json:"slowConsumerDropOldest"` //queued msgs dropped, policy drop-oldest
+	SlowConsumerDisconnect uint64 `json:"slowConsumerDisconnect"` //clients disconnected, policy disconnect
+
+	Draining       bool   `json:"draining"`
+	RejectDraining uint64 `json:"rejectDraining"` //upgrades rejected while draining
+
+	Latency map[string]*LatencyStruct `json:"latency,omitempty"` //by stage: send_to_push, push_to_write, write_to_ack
+}
+
+//SenderMetricsStruct ...
+type SenderMetricsStruct struct {
+	NodeID             string `json:"nodeID"`
+	WaitAck            uint64 `json:"waitAck"`
+	TotalRetry         uint64 `json:"totalRetry"`
+	TotalAckAfterRetry uint64 `json:"totalAckAfterRetry"`
+	TotalFallbackCache uint64 `json:"totalFallbackCache"`
+
+	Drops map[string]uint64 `json:"drops,omitempty"` //dropped msgs by reason
+
+	Latency map[string]*LatencyStruct `json:"latency,omitempty"` //by stage: lookup, send_to_ack
+}
+
+//OnlineStatusStruct ...
+type OnlineStatusStruct struct {
+	UserID          string        `json:"userID"`
+	IsShortOnline   bool          `json:"isShortOnline"`
+	IsRealOnline    bool          `json:"isRealOnline"`
+	RealOnlineInfos []*ClientInfo `json:"realOnlineInfos"`
+}
+
+//NodeSummaryStruct one ws-connector aggregated by ws-analyze
+type NodeSummaryStruct struct {
+	NodeID               string                    `json:"nodeID"`
+	OnlineUsers          uint64                    `json:"onlineUsers"`
+	PushPerSecond        float64                   `json:"pushPerSecond"` //frames sent to clients, between last two reports
+	AckRate              float64                   `json:"ackRate"`       //acks / frames sent, between last two reports
+	ConnectsPerMinute    uint64                    `json:"connectsPerMinute"`
+	DisconnectsPerMinute uint64                    `json:"disconnectsPerMinute"`
+	LastReport           string                    `json:"lastReport"` //timestamp (ms) of last syncMetrics, empty if never
+	Stale                bool                      `json:"stale"`      //no syncMetrics in ws-analyze StaleSeconds
+	Latency              map[string]*LatencyStruct `json:"latency,omitempty"`
+}
+
+//ClusterSummaryStruct all ws-connectors, stale nodes are listed but not summed
+type ClusterSummaryStruct struct {
+	Time                 string               `json:"time"`
+	Nodes                int                  `json:"nodes"`
+	StaleNodes           []string             `json:"staleNodes"`
+	OnlineUsers          uint64               `json:"onlineUsers"`
+	PushPerSecond        float64              `json:"pushPerSecond"`
+	AckRate              float64              `json:"ackRate"`
+	ConnectsPerMinute    uint64               `json:"connectsPerMinute"`
+	DisconnectsPerMinute uint64               `json:"disconnectsPerMinute"`
+	NodeSummaries        []*NodeSummaryStruct `json:"nodeSummaries"`
+}
+
+//OnlineStatusBulkStruct ...
+type OnlineStatusBulkStruct struct {
+	OnlineStatusBulk []*OnlineStatusStruct `json:"onlineStatusBulk"`
+}
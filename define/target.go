@@ -0,0 +1,223 @@
+package define
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//TargetStruct filter push recipients by client platform and version, empty fields match all.
+//Versions is space separated constraints which must all match, "||" separate alternatives,
+//e.g. "<2.3", ">=2.0 <3.0", "< 1.5 || >= 2.0". Call Parse once when received, bad syntax is an error
+type TargetStruct struct {
+	Platforms        []string `json:"platforms,omitempty"`        //allow list
+	ExcludePlatforms []string `json:"excludePlatforms,omitempty"` //deny list
+	Versions         string   `json:"versions,omitempty"`
+
+	groups [][]versionConstraint //parsed Versions, set by Parse
+}
+
+type versionConstraint struct {
+	op      string
+	version []int
+}
+
+//Parse validate Versions and keep the parsed constraints for Match, nil target is valid.
+//Call it before the target is shared, Match never write to it
+func (t *TargetStruct) Parse() error {
+	if t == nil {
+		return nil
+	}
+	groups, err := parseVersionExpr(t.Versions)
+	if err != nil {
+		return err
+	}
+	t.groups = groups
+	return nil
+}
+
+//Match check one client, nil target match all. A target with invalid Versions match nothing,
+//so does a client with invalid version when Versions is not empty
+func (t *TargetStruct) Match(platform string, version string) bool {
+	if t == nil {
+		return true
+	}
+	if len(t.Platforms) > 0 && !containsPlatform(t.Platforms, platform) {
+		return false
+	}
+	if containsPlatform(t.ExcludePlatforms, platform) {
+		return false
+	}
+	groups := t.groups
+	if groups == nil {
+		var err error
+		groups, err = parseVersionExpr(t.Versions)
+		if err != nil {
+			return false
+		}
+	}
+	return matchVersionGroups(groups, version)
+}
+
+//MatchVersion check version with range expression, empty expression match all, invalid one match nothing
+func MatchVersion(expr string, version string) bool {
+	groups, err := parseVersionExpr(expr)
+	if err != nil {
+		return false
+	}
+	return matchVersionGroups(groups, version)
+}
+
+func matchVersionGroups(groups [][]versionConstraint, version string) bool {
+	if len(groups) < 1 {
+		return true
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		return false
+	}
+	for _, group := range groups {
+		if matchVersionGroup(group, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchVersionGroup(group []versionConstraint, version []int) bool {
+	for _, constraint := range group {
+		cmp := compareVersionParts(version, constraint.version)
+		ok := false
+		switch constraint.op {
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//parseVersionExpr nil for empty expr
+func parseVersionExpr(expr string) ([][]versionConstraint, error) {
+	expr = strings.TrimSpace(expr)
+	if len(expr) < 1 {
+		return nil, nil
+	}
+	groups := make([][]versionConstraint, 0)
+	for _, group := range strings.Split(expr, "||") {
+		fields := strings.Fields(group)
+		if len(fields) < 1 {
+			return nil, errors.New("versions: empty group in " + strconv.Quote(expr))
+		}
+		constraints := make([]versionConstraint, 0, len(fields))
+		for i := 0; i < len(fields); i++ {
+			op, want := splitVersionOp(fields[i])
+			//"< 2.3", operator and version in separate fields
+			if len(want) < 1 && len(op) > 0 && i+1 < len(fields) {
+				i++
+				want = fields[i]
+			}
+			if len(op) < 1 {
+				op = "="
+			}
+			version, err := ParseVersion(want)
+			if err != nil {
+				return nil, errors.New("versions: " + strconv.Quote(fields[i]) + ": " + err.Error())
+			}
+			constraints = append(constraints, versionConstraint{op: op, version: version})
+		}
+		groups = append(groups, constraints)
+	}
+	return groups, nil
+}
+
+//splitVersionOp op is empty if constraint has no operator
+func splitVersionOp(constraint string) (string, string) {
+	for _, op := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+		if strings.HasPrefix(constraint, op) {
+			if op == "==" {
+				return "=", constraint[len(op):]
+			}
+			return op, constraint[len(op):]
+		}
+	}
+	return "", constraint
+}
+
+//ParseVersion dotted numeric version, leading "v" and suffix like "-beta" or "+build" are ignored,
+//e.g. "2.3", "v2.3.1", "2.3.0-beta". Empty, empty part or non numeric part is an error
+func ParseVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	if len(v) < 1 {
+		return nil, errors.New("empty version")
+	}
+	parts := strings.Split(v, ".")
+	ret := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, errors.New("bad version: " + strconv.Quote(v))
+		}
+		ret[i] = n
+	}
+	return ret, nil
+}
+
+//CompareVersion compare dotted versions by numeric parts, "2.3" == "2.3.0", return -1, 0 or 1.
+//See ParseVersion for valid versions, an invalid one is less than every valid one
+func CompareVersion(a string, b string) int {
+	as, errA := ParseVersion(a)
+	bs, errB := ParseVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return compareVersionParts(as, bs)
+}
+
+func compareVersionParts(as []int, bs []int) int {
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func containsPlatform(list []string, platform string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, platform) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package define
+
+import (
+	"testing"
+)
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"2.3", "2.3", 0},
+		{"2.3", "2.3.0", 0},
+		{"2.3.0.0", "2.3", 0},
+		{"2.3", "2.4", -1},
+		{"2.10", "2.9", 1},
+		{"10.0", "9.9.9", 1},
+		{"v2.3", "2.3", 0},
+		{"2.3.0-beta", "2.3", 0},
+		{"2.3+build5", "2.3.1", -1},
+		{" 1.0 ", "1.0", 0},
+		{"", "0.0.1", -1},
+		{"abc", "0", -1},
+		{"1.x", "1.0", -1},
+		{"1.0", "1..0", 1},
+		{"abc", "", 0},
+	}
+	for _, c := range cases {
+		if got := CompareVersion(c.a, c.b); got != c.want {
+			t.Errorf("CompareVersion(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := CompareVersion(c.b, c.a); got != -c.want {
+			t.Errorf("CompareVersion(%q, %q) = %d, want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
+
+func TestMatchVersion(t *testing.T) {
+	cases := []struct {
+		expr    string
+		version string
+		want    bool
+	}{
+		{"", "1.0", true},
+		{"  ", "", true},
+		{"<2.3", "2.2.9", true},
+		{"<2.3", "2.3", false},
+		{"< 2.3", "2.2", true},
+		{"< 2.3", "2.3", false},
+		{">=  2.0   <  3.0", "2.5", true},
+		{">= 2.0 < 3.0", "3.0", false},
+		{"<=2.3", "2.3.0", true},
+		{">2.3", "2.3", false},
+		{">2.3", "2.3.1", true},
+		{"!=2.3", "2.3", false},
+		{"!= 2.3", "2.4", true},
+		{"2.3", "2.3.0", true},
+		{"=2.3", "2.4", false},
+		{"== 2.3", "2.3", true},
+		{"<1.5 || >=2.0", "1.4", true},
+		{"<1.5 || >=2.0", "1.7", false},
+		{"<1.5||>=2.0", "2.1", true},
+		{">=2.0 <2.3 || <1.0", "2.2", true},
+		{">=2.0 <2.3 || <1.0", "1.5", false},
+		{"<v2.3", "2.2", true},
+		{">=2.3", "2.3.0-beta", true},
+
+		//empty or invalid client version never match a constraint
+		{"<1.0", "", false},
+		{"<1.0", "abc", false},
+		{"!=1.0", "", false},
+
+		//bad expressions match nothing
+		{"<abc", "1.0", false},
+		{"<", "1.0", false},
+		{">= 2.0 <", "2.1", false},
+		{"<1.0 ||", "0.5", false},
+		{"|| <1.0", "0.5", false},
+		{"<1.x", "0.5", false},
+		{"~1.0", "1.0", false},
+	}
+	for _, c := range cases {
+		if got := MatchVersion(c.expr, c.version); got != c.want {
+			t.Errorf("MatchVersion(%q, %q) = %v, want %v", c.expr, c.version, got, c.want)
+		}
+	}
+}
+
+func TestTargetParse(t *testing.T) {
+	valid := []string{"", "<2.3", "< 2.3", ">= 2.0 < 3.0", "<1.5 || >=2.0", "v2", "2.3.0-beta"}
+	for _, expr := range valid {
+		if err := (&TargetStruct{Versions: expr}).Parse(); err != nil {
+			t.Errorf("Parse(%q): %v", expr, err)
+		}
+	}
+	invalid := []string{"<", "<abc", ">= 2.0 <", "<1.0 ||", "||", "1..2", "~1.0", ">=-1"}
+	for _, expr := range invalid {
+		if err := (&TargetStruct{Versions: expr}).Parse(); err == nil {
+			t.Errorf("Parse(%q) accepted", expr)
+		}
+	}
+	var nilTarget *TargetStruct
+	if err := nilTarget.Parse(); err != nil {
+		t.Errorf("nil target Parse: %v", err)
+	}
+}
+
+func TestTargetMatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		target   *TargetStruct
+		platform string
+		version  string
+		want     bool
+	}{
+		{"nil target", nil, "ios", "", true},
+		{"empty target", &TargetStruct{}, "web", "", true},
+		{"platform allowed", &TargetStruct{Platforms: []string{"ios", "android"}}, "Android", "1.0", true},
+		{"platform not allowed", &TargetStruct{Platforms: []string{"ios"}}, "web", "1.0", false},
+		{"platform excluded", &TargetStruct{ExcludePlatforms: []string{"web"}}, "web", "1.0", false},
+		{"exclude wins", &TargetStruct{Platforms: []string{"web"}, ExcludePlatforms: []string{"web"}}, "web", "1.0", false},
+		{"version match", &TargetStruct{Platforms: []string{"ios"}, Versions: "< 2.3"}, "ios", "2.2", true},
+		{"version not match", &TargetStruct{Platforms: []string{"ios"}, Versions: "< 2.3"}, "ios", "2.3", false},
+		{"empty client version", &TargetStruct{Versions: "<1.0"}, "ios", "", false},
+		{"bad versions", &TargetStruct{Versions: "<abc"}, "ios", "1.0", false},
+	}
+	for _, c := range cases {
+		if got := c.target.Match(c.platform, c.version); got != c.want {
+			t.Errorf("%s: Match unparsed = %v, want %v", c.name, got, c.want)
+		}
+		c.target.Parse()
+		if got := c.target.Match(c.platform, c.version); got != c.want {
+			t.Errorf("%s: Match parsed = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
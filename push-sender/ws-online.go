@@ -3,14 +3,13 @@ package main
 import (
 	"errors"
 	"strconv"
-	"strings"
 	"time"
 
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
 	"sync"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
@@ -29,9 +28,9 @@ func createMoleculerService() moleculer.Service {
 	gMoleculerService.Actions["onlineStatusBulk"] = actionOnlineStatusBulk
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutOnline] = eventWsConnectorOutOnline
-	gMoleculerService.Events[cWsConnectorOutOffline] = eventWsConnectorOutOffline
-	gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutOnline] = eventWsConnectorOutOnline
+	gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
 
 	gShortOnlineHub = &ShortOnlineHub{
 		Users:        &sync.Map{},
@@ -41,7 +40,7 @@ func createMoleculerService() moleculer.Service {
 	gShortOnlineHub.runCheckAbandonUsers()
 
 	time.AfterFunc(time.Second*time.Duration(gSyncDelaySeconds), func() {
-		pBroker.Broadcast(cWsConnectorInSyncUsersInfo, nil)
+		pBroker.Broadcast(define.WsConnectorInSyncUsersInfo, nil)
 	})
 
 	return *gMoleculerService
@@ -63,40 +62,23 @@ func actionOnlineStatus(req *protocol.MsRequest) (interface{}, error) {
 //mol $ call ws-online.onlineStatusBulk --ids gotest-user-0,gotest-user-1
 func actionOnlineStatusBulk(req *protocol.MsRequest) (interface{}, error) {
 
-	jsonByte, err := jsoniter.Marshal(req.Params)
+	jsonObj := &define.IDsStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run actionOnlineStatusBulk, parse req.Data to jsonByte error: ", err)
-		return nil, err
-	}
-	jsonObj := &idsStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
-	if err != nil {
-		log.Warn("run actionOnlineStatusBulk, parse req.Data to jsonObj idsStruct error: ", err)
+		log.Warn("run actionOnlineStatusBulk, parse req.Params to jsonObj IDsStruct error: ", err)
 		return nil, err
 	}
 
 	log.Info("run actionOnlineStatusBulk jsonObj.IDs: ", jsonObj.IDs)
 
-	ids := make([]string, 0)
-	switch jsonObj.IDs.(type) {
-	case []string:
-		ids = jsonObj.IDs.([]string)
-	case []interface{}:
-		_ids := jsonObj.IDs.([]interface{})
-		for _, v := range _ids {
-			if sv, ok := v.(string); ok {
-				ids = append(ids, sv)
-			}
-		}
-	case string:
-		ids = strings.Split(jsonObj.IDs.(string), ",")
-	default:
+	ids, err := define.ParseIDs(jsonObj.IDs)
+	if err != nil {
 		log.Info("can't parse jsonObj.IDs")
-		return nil, errors.New("can't parse ids")
+		return nil, err
 	}
 
-	onlineStatusBulk := &onlineStatusBulkStruct{
-		OnlineStatusBulk: make([]*onlineStatusStruct, 0),
+	onlineStatusBulk := &define.OnlineStatusBulkStruct{
+		OnlineStatusBulk: make([]*define.OnlineStatusStruct, 0),
 	}
 	for _, userID := range ids {
 		onlineStatus := getOnlineStatus(userID)
@@ -106,19 +88,19 @@ func actionOnlineStatusBulk(req *protocol.MsRequest) (interface{}, error) {
 	return onlineStatusBulk, nil
 }
 
-func getOnlineStatus(userID string) *onlineStatusStruct {
-	onlineStatus := &onlineStatusStruct{
+func getOnlineStatus(userID string) *define.OnlineStatusStruct {
+	onlineStatus := &define.OnlineStatusStruct{
 		UserID:          userID,
-		RealOnlineInfos: make([]*ClientInfo, 0),
+		RealOnlineInfos: make([]*define.ClientInfo, 0),
 	}
 
 	if userInfo, ok := gShortOnlineHub.Users.Load(userID); ok {
 		onlineStatus.IsShortOnline = true
 		userInfoObj, ok := userInfo.(*UserInfo)
 		if ok {
-			realOnlineInfos := make([]*ClientInfo, 0)
+			realOnlineInfos := make([]*define.ClientInfo, 0)
 			userInfoObj.Clients.Range(func(key, value interface{}) bool {
-				if clientInfo, ok := value.(*ClientInfo); ok {
+				if clientInfo, ok := value.(*define.ClientInfo); ok {
 					if clientInfo.IsOnline {
 						onlineStatus.IsRealOnline = true
 					}
@@ -133,15 +115,10 @@ func getOnlineStatus(userID string) *onlineStatusStruct {
 }
 
 func parseUserID(req *protocol.MsRequest) string {
-	jsonByte, err := jsoniter.Marshal(req.Params)
+	jsonObj := &define.UserIDStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run parseUserID, parse req.Data to jsonByte error: ", err)
-		return ""
-	}
-	jsonObj := &userIDStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
-	if err != nil {
-		log.Warn("run parseUserID, parse req.Data to jsonObj userIDStruct error: ", err)
+		log.Warn("run parseUserID, parse req.Params to jsonObj UserIDStruct error: ", err)
 		return ""
 	}
 	return jsonObj.UserID
@@ -167,8 +144,8 @@ type UserInfo struct {
 	UserID          string
 	LastOnlineTime  time.Time
 	LastOfflineTime time.Time
-	LastClientInfo  *ClientInfo
-	Clients         *sync.Map //~= sync.Map[string(Cid)]*ClientInfo //only real online clientInfos
+	LastClientInfo  *define.ClientInfo
+	Clients         *sync.Map //~= sync.Map[string(Cid)]*define.ClientInfo //only real online clientInfos
 
 }
 
@@ -182,13 +159,8 @@ type ShortOnlineHub struct {
 }
 
 func handlerClientInfo(req *protocol.MsEvent) {
-	jsonByte, err := jsoniter.Marshal(req.Data)
-	if err != nil {
-		log.Warn("handlerClientInfo, parse req.Data to jsonByte error: ", err)
-		return
-	}
-	clientInfo := &ClientInfo{}
-	err = jsoniter.Unmarshal(jsonByte, clientInfo)
+	clientInfo := &define.ClientInfo{}
+	err := define.Decode(req.Data, clientInfo)
 	if err != nil {
 		log.Warn("handlerClientInfo, parse req.Data to ClientInfo error: ", err)
 		return
@@ -230,7 +202,7 @@ func handlerClientInfo(req *protocol.MsEvent) {
 	log.Infof("handlerClientInfo userInfoObj = %+v\n", userInfoObj)
 
 	if !isOld && isOnline {
-		pBroker.Broadcast(cWsOnlineOutOnline, clientInfo)
+		pBroker.Broadcast(define.WsOnlineOutOnline, clientInfo)
 	}
 
 	userInfoObj.LastClientInfo = clientInfo
@@ -269,7 +241,7 @@ func handlerClientInfo(req *protocol.MsEvent) {
 	// log.Infof("handlerClientInfo newUserInfo Clients %+v", userInfoObj.Clients)
 
 	userInfoObj.Clients.Range(func(key, value interface{}) bool {
-		clientInfoObj, ok := value.(*ClientInfo)
+		clientInfoObj, ok := value.(*define.ClientInfo)
 		if ok {
 			log.Infof("handlerClientInfo userInfoObj.clientInfoObj = %+v\n", clientInfoObj)
 		}
@@ -312,7 +284,7 @@ func (h *ShortOnlineHub) runCheckAbandonUsers() {
 									})
 									if !hasOtherClients {
 										gShortOnlineHub.Users.Delete(abandon.UserID)
-										pBroker.Broadcast(cWsOnlineOutOffline, userInfoObj.LastClientInfo)
+										pBroker.Broadcast(define.WsOnlineOutOffline, userInfoObj.LastClientInfo)
 									}
 								}
 							}
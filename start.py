@@ -163,6 +163,10 @@ os.chdir("./ws-connector")
 callSys("go build && ./ws-connector -s nats://127.0.0.1:12008 -p 12220 -i 0 -d 1 -fe 1 -wf 1 > /dev/null 2>&1 &")
 os.chdir("../")
 
+os.chdir("./ws-token")
+callSys("go build && ./ws-token -s nats://127.0.0.1:12008 -i 0 -d 1 -fe 1 -wf 1 -k keys.json > /dev/null 2>&1 &")
+os.chdir("../")
+
 os.chdir("./ws-online")
 callSys("go build && ./ws-online -s nats://127.0.0.1:12008 -i 0 -d 1 -wf 1 > /dev/null 2>&1 &")
 os.chdir("../")
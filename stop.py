@@ -163,3 +163,4 @@ runSys("pkill ws-connector")
 runSys("pkill ws-online")
 runSys("pkill ws-cache")
 runSys("pkill ws-sender")
+runSys("pkill ws-token")
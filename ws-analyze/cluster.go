@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+//forgetStaleNodes remove nodes not reporting for so long, they are gone not just stale
+const forgetStaleNodes = time.Hour * 1
+
+//minuteWindow events in last 60 seconds, one slot per second
+type minuteWindow struct {
+	slots [60]uint64
+	times [60]int64 //unix second of slot
+}
+
+func (w *minuteWindow) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % 60
+	if w.times[i] != sec {
+		w.times[i] = sec
+		w.slots[i] = 0
+	}
+	w.slots[i]++
+}
+
+func (w *minuteWindow) sum(now time.Time) uint64 {
+	sec := now.Unix()
+	var ret uint64
+	for i := range w.slots {
+		if sec-w.times[i] < 60 {
+			ret += w.slots[i]
+		}
+	}
+	return ret
+}
+
+type nodeStat struct {
+	nodeID      string
+	firstSeen   time.Time
+	lastReport  time.Time
+	metrics     *define.MetricsStruct
+	deltaSend   uint64
+	deltaAck    uint64
+	deltaTime   time.Duration
+	connects    minuteWindow
+	disconnects minuteWindow
+}
+
+//ClusterStat per node aggregates of ws-connector syncMetrics and online/offline events
+type ClusterStat struct {
+	mtx       sync.Mutex
+	nodes     map[string]*nodeStat
+	hubClosed chan int
+}
+
+var gClusterStat *ClusterStat
+
+func newClusterStat() *ClusterStat {
+	return &ClusterStat{
+		nodes:     make(map[string]*nodeStat),
+		hubClosed: make(chan int, 1),
+	}
+}
+
+//node must hold mtx
+func (s *ClusterStat) node(nodeID string, now time.Time) *nodeStat {
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		node = &nodeStat{
+			nodeID:    nodeID,
+			firstSeen: now,
+		}
+		s.nodes[nodeID] = node
+	}
+	return node
+}
+
+//counterDelta counters restart from 0 when node restart
+func counterDelta(cur uint64, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func (s *ClusterStat) onMetrics(metrics *define.MetricsStruct) {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	node := s.node(metrics.NodeID, now)
+	if node.metrics != nil {
+		node.deltaSend = counterDelta(metrics.TotalSend, node.metrics.TotalSend)
+		node.deltaAck = counterDelta(metrics.TotalAck, node.metrics.TotalAck)
+		node.deltaTime = now.Sub(node.lastReport)
+	}
+	node.metrics = metrics
+	node.lastReport = now
+}
+
+func (s *ClusterStat) onClient(info *define.ClientInfo, online bool) {
+	now := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	node := s.node(info.NodeID, now)
+	if online {
+		node.connects.add(now)
+	} else {
+		node.disconnects.add(now)
+	}
+}
+
+func (s *ClusterStat) summary() *define.ClusterSummaryStruct {
+	now := time.Now()
+	stale := time.Second * time.Duration(gStaleSeconds)
+	ret := &define.ClusterSummaryStruct{
+		Time:          define.Timestamp(now),
+		StaleNodes:    make([]string, 0),
+		NodeSummaries: make([]*define.NodeSummaryStruct, 0),
+	}
+	var deltaSend, deltaAck uint64
+	s.mtx.Lock()
+	for nodeID, node := range s.nodes {
+		lastSeen := node.lastReport
+		if lastSeen.IsZero() {
+			lastSeen = node.firstSeen
+		}
+		if now.Sub(lastSeen) > forgetStaleNodes {
+			delete(s.nodes, nodeID)
+			continue
+		}
+		nodeSummary := &define.NodeSummaryStruct{
+			NodeID:               nodeID,
+			ConnectsPerMinute:    node.connects.sum(now),
+			DisconnectsPerMinute: node.disconnects.sum(now),
+			Stale:                node.lastReport.IsZero() || now.Sub(node.lastReport) > stale,
+		}
+		if node.metrics != nil {
+			nodeSummary.OnlineUsers = node.metrics.OnlineUsers
+			nodeSummary.LastReport = define.Timestamp(node.lastReport)
+			nodeSummary.Latency = node.metrics.Latency
+		}
+		if node.deltaTime > 0 {
+			nodeSummary.PushPerSecond = float64(node.deltaSend) / node.deltaTime.Seconds()
+		}
+		if node.deltaSend > 0 {
+			nodeSummary.AckRate = float64(node.deltaAck) / float64(node.deltaSend)
+		}
+		ret.NodeSummaries = append(ret.NodeSummaries, nodeSummary)
+		ret.ConnectsPerMinute += nodeSummary.ConnectsPerMinute
+		ret.DisconnectsPerMinute += nodeSummary.DisconnectsPerMinute
+		if nodeSummary.Stale {
+			ret.StaleNodes = append(ret.StaleNodes, nodeID)
+			continue
+		}
+		ret.OnlineUsers += nodeSummary.OnlineUsers
+		ret.PushPerSecond += nodeSummary.PushPerSecond
+		deltaSend += node.deltaSend
+		deltaAck += node.deltaAck
+	}
+	s.mtx.Unlock()
+	if deltaSend > 0 {
+		ret.AckRate = float64(deltaAck) / float64(deltaSend)
+	}
+	ret.Nodes = len(ret.NodeSummaries)
+	sort.Strings(ret.StaleNodes)
+	sort.Slice(ret.NodeSummaries, func(i, j int) bool {
+		return ret.NodeSummaries[i].NodeID < ret.NodeSummaries[j].NodeID
+	})
+	return ret
+}
+
+//Close ...
+func (s *ClusterStat) Close() {
+	s.hubClosed <- 1
+}
+
+//runSyncMetrics ask all ws-connector to broadcast ws-connector.out.syncMetrics every gMetricsSeconds
+func (s *ClusterStat) runSyncMetrics() {
+	go func() {
+		ticker := time.NewTicker(time.Second * time.Duration(gMetricsSeconds))
+		for {
+			select {
+			case <-ticker.C:
+				pBroker.Broadcast(define.WsConnectorInSyncMetrics, nil)
+				summary := s.summary()
+				if len(summary.StaleNodes) > 0 {
+					log.Warn("ws-connector stale nodes: ", summary.StaleNodes)
+				}
+			case <-s.hubClosed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
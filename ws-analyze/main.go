@@ -95,7 +95,7 @@ var upgrader = websocket.Upgrader{
 }
 
 func usage() {
-	log.Fatalf("Usage: ws-online [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-w WaitAckSeconds (10)]\n")
+	log.Fatalf("Usage: ws-analyze [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-w WaitAckSeconds (10)] [-p status page port (12260)] [-mi syncMetrics interval seconds (10)] [-st stale node seconds (30)]\n")
 }
 
 var gCloseChan chan int
@@ -111,6 +111,9 @@ func main() {
 	_gID := flag.Int("i", 0, "ID of the service on this machine")
 	_gWaitAckSeconds := flag.Int("w", 10, "wait 10s ack")
 	_gIsDebug := flag.Int("d", 0, "is debug")
+	_gPort := flag.Int("p", 12260, "status page http port, 0 disable")
+	_gMetricsSeconds := flag.Int("mi", 10, "broadcast ws-connector.in.syncMetrics every 10s")
+	_gStaleSeconds := flag.Int("st", 30, "ws-connector without syncMetrics for 30s is stale")
 	// _gTestCount := flag.Int("c", 1, "test send message RPS")
 	// _gTestUserName := flag.String("u", "gotest-user-", "TestUserName prefix")
 	// _gTestUserNameRange := flag.Int("ur", 9999, "TestUserName range")
@@ -121,6 +124,15 @@ func main() {
 	gID = *_gID
 	gIsDebug = *_gIsDebug
 	gWaitAckSeconds = *_gWaitAckSeconds
+	gPort = *_gPort
+	gMetricsSeconds = *_gMetricsSeconds
+	gStaleSeconds = *_gStaleSeconds
+	if gMetricsSeconds < 1 {
+		gMetricsSeconds = 1
+	}
+	if gStaleSeconds < gMetricsSeconds {
+		gStaleSeconds = gMetricsSeconds * 3
+	}
 	// gTestCount = *_gTestCount
 	// gTestUserName = *_gTestUserName
 	// gTestUserNameRange = *_gTestUserNameRange
@@ -135,6 +147,11 @@ func main() {
 	log.Warnf("gNodeID : %v\n", gNodeID)
 	log.Warnf("gIsDebug : %v\n", gIsDebug)
 	log.Warnf("gWaitAckSeconds : %v\n", gWaitAckSeconds)
+	log.Warnf("gPort : %v\n", gPort)
+	log.Warnf("gMetricsSeconds : %v\n", gMetricsSeconds)
+	log.Warnf("gStaleSeconds : %v\n", gStaleSeconds)
+
+	gClusterStat = newClusterStat()
 
 	//init service and broker
 	config := &moleculer.ServiceBrokerConfig{
@@ -158,6 +175,9 @@ func main() {
 		return
 	}
 
+	gClusterStat.runSyncMetrics()
+	startStatusService()
+
 	log.Warn("================= Server Started ================= ")
 
 	closer.Hold()
@@ -166,6 +186,9 @@ func main() {
 func cleanupFunc() {
 	log.Infof("Hang on! %s is closing ...", AppName)
 	log.Warn("=================== exit start =================== ")
+	if gClusterStat != nil {
+		gClusterStat.Close()
+	}
 	time.Sleep(time.Second * 1)
 	log.Warn("=================== exit end   =================== ")
 	log.Infof("%s is closed", AppName)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(v float64) string {
+		return strconv.FormatFloat(v*100, 'f', 1, 64) + "%"
+	},
+	"fixed": func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>ws-analyze</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.stale { color: #c00; }
+</style>
+</head>
+<body>
+<h2>ws-connector cluster</h2>
+<table>
+<tr><th>nodes</th><th>online users</th><th>push/s</th><th>ack rate</th><th>connects/min</th><th>disconnects/min</th><th>stale nodes</th></tr>
+<tr><td>{{.Nodes}}</td><td>{{.OnlineUsers}}</td><td>{{fixed .PushPerSecond}}</td><td>{{percent .AckRate}}</td><td>{{.ConnectsPerMinute}}</td><td>{{.DisconnectsPerMinute}}</td><td class="stale">{{range .StaleNodes}}{{.}} {{end}}</td></tr>
+</table>
+<h2>nodes</h2>
+<table>
+<tr><th>nodeID</th><th>online users</th><th>push/s</th><th>ack rate</th><th>connects/min</th><th>disconnects/min</th><th>last report</th></tr>
+{{range .NodeSummaries}}<tr{{if .Stale}} class="stale"{{end}}><td>{{.NodeID}}{{if .Stale}} (stale){{end}}</td><td>{{.OnlineUsers}}</td><td>{{fixed .PushPerSecond}}</td><td>{{percent .AckRate}}</td><td>{{.ConnectsPerMinute}}</td><td>{{.DisconnectsPerMinute}}</td><td>{{.LastReport}}</td></tr>
+{{end}}</table>
+<p><a href="/summary">json</a></p>
+</body>
+</html>
+`))
+
+//startStatusService serve status page on gPort, "/" html and "/summary" json
+func startStatusService() {
+	if gPort < 1 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusTemplate.Execute(w, gClusterStat.summary())
+		if err != nil {
+			log.Warn("status page, template Execute err: ", err)
+		}
+	})
+	mux.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
+		data, err := jsoniter.Marshal(gClusterStat.summary())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	go func() {
+		err := http.ListenAndServe(":"+strconv.Itoa(gPort), mux)
+		if err != nil {
+			log.Fatal("exit process, status http ListenAndServe err: ", err)
+		}
+	}()
+}
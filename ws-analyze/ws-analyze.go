@@ -5,6 +5,7 @@ import (
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
@@ -20,17 +21,18 @@ func createMoleculerService() moleculer.Service {
 
 	//init actions handlers
 	// gMoleculerService.Actions["send"] = actionSend
+	gMoleculerService.Actions["summary"] = actionSummary
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutOnline] = eventAnalyze
-	gMoleculerService.Events[cWsConnectorOutOffline] = eventAnalyze
-	gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventAnalyze
-	gMoleculerService.Events[cWsConnectorOutAck] = eventAnalyze
-	gMoleculerService.Events[cWsConnectorOutSyncMetrics] = eventAnalyze
-	gMoleculerService.Events[cWsOnlineOutOnline] = eventAnalyze
-	gMoleculerService.Events[cWsOnlineOutOffline] = eventAnalyze
-	// gMoleculerService.Events[cWsConnectorOutOffline] = eventWsConnectorOutOffline
-	// gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutOnline] = eventWsConnectorOutOnline
+	gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventAnalyze
+	gMoleculerService.Events[define.WsConnectorOutAck] = eventAnalyze
+	gMoleculerService.Events[define.WsConnectorOutSyncMetrics] = eventWsConnectorOutSyncMetrics
+	gMoleculerService.Events[define.WsOnlineOutOnline] = eventAnalyze
+	gMoleculerService.Events[define.WsOnlineOutOffline] = eventAnalyze
+	// gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	// gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
 
 	return *gMoleculerService
 }
@@ -41,6 +43,49 @@ func createMoleculerService() moleculer.Service {
 // 	return nil, nil
 // }
 
+//mol $ call ws-analyze.summary
+func actionSummary(req *protocol.MsRequest) (interface{}, error) {
+	log.Info("run actionSummary")
+	return gClusterStat.summary(), nil
+}
+
+func eventWsConnectorOutOnline(req *protocol.MsEvent) {
+	eventAnalyze(req)
+	handlerClientInfo(req, true)
+}
+
+func eventWsConnectorOutOffline(req *protocol.MsEvent) {
+	eventAnalyze(req)
+	handlerClientInfo(req, false)
+}
+
+func handlerClientInfo(req *protocol.MsEvent, online bool) {
+	clientInfo := &define.ClientInfo{}
+	err := define.Decode(req.Data, clientInfo)
+	if err != nil {
+		log.Warn("handlerClientInfo, parse req.Data to ClientInfo error: ", err)
+		return
+	}
+	if len(clientInfo.NodeID) < 1 {
+		return
+	}
+	gClusterStat.onClient(clientInfo, online)
+}
+
+func eventWsConnectorOutSyncMetrics(req *protocol.MsEvent) {
+	eventAnalyze(req)
+	metrics := &define.MetricsStruct{}
+	err := define.Decode(req.Data, metrics)
+	if err != nil {
+		log.Warn("eventWsConnectorOutSyncMetrics, parse req.Data to MetricsStruct error: ", err)
+		return
+	}
+	if len(metrics.NodeID) < 1 {
+		return
+	}
+	gClusterStat.onMetrics(metrics)
+}
+
 func eventAnalyze(req *protocol.MsEvent) {
 	jsonByte, err := jsoniter.Marshal(req)
 	if err != nil {
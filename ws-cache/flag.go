@@ -16,17 +16,30 @@ var gFastExit int
 var gIsDebug int
 var gWriteLogToFile int
 var gNodeID = AppName
+var gPromPort int
 var gMaxCacheSeconds int
+var gStorage string
+var gDataDir string
+var gQueueMaxLen int
+var gQueueMaxBytes int
+var gQueueOverflow string
 
 func initFlag() {
 	_gUrls := flag.String("s", nats.DefaultURL, "The nats server URLs (separated by comma, default localhost:4222)")
 	_gID := flag.Int("i", 0, "ID of the service on this machine")
 
+	_gPromPort := flag.Int("mp", 0, "prometheus /metrics http port, 0 to disable")
+
 	_gFastExit := flag.Int("fe", 0, "fast exit")
 	_gIsDebug := flag.Int("d", 0, "is debug")
 	_gWriteLogToFile := flag.Int("wf", 0, "write log to file")
 
 	_gMaxCacheSeconds := flag.Int("m", 1800, "max cache message seconds")
+	_gStorage := flag.String("st", storageLog, "cache storage: log or memory")
+	_gDataDir := flag.String("dir", "data", "data dir for log storage")
+	_gQueueMaxLen := flag.Int("ql", 1000, "max cached messages per user")
+	_gQueueMaxBytes := flag.Int("qb", 1024*1024, "max cached message bytes per user")
+	_gQueueOverflow := flag.String("qo", overflowDropOldest, "queue overflow policy: drop-oldest, drop-newest or collapse")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -37,8 +50,23 @@ func initFlag() {
 	gIsDebug = *_gIsDebug
 	gFastExit = *_gFastExit
 	gWriteLogToFile = *_gWriteLogToFile
+	gPromPort = *_gPromPort
 
 	gMaxCacheSeconds = *_gMaxCacheSeconds
+	gStorage = *_gStorage
+	gDataDir = *_gDataDir
+	gQueueMaxLen = *_gQueueMaxLen
+	gQueueMaxBytes = *_gQueueMaxBytes
+	gQueueOverflow = *_gQueueOverflow
+
+	switch gQueueOverflow {
+	case overflowDropOldest, overflowDropNewest, overflowCollapse:
+	default:
+		log.Fatalf("invalid queue overflow policy: %s\n", gQueueOverflow)
+	}
+	if gQueueMaxLen < 1 || gQueueMaxBytes < 1 {
+		log.Fatalf("invalid queue limit, len: %d, bytes: %d\n", gQueueMaxLen, gQueueMaxBytes)
+	}
 
 	gNatsHosts = strings.Split(gUrls, ",")
 
@@ -53,5 +81,11 @@ func printFlag() {
 	log.Warnf("gNodeID : %v\n", gNodeID)
 	log.Warnf("gUrls : %v\n", gUrls)
 	log.Warnf("gNatsHosts : %v\n", gNatsHosts)
+	log.Warnf("gPromPort : %v\n", gPromPort)
 	log.Warnf("gMaxCacheSeconds : %v\n", gMaxCacheSeconds)
+	log.Warnf("gStorage : %v\n", gStorage)
+	log.Warnf("gDataDir : %v\n", gDataDir)
+	log.Warnf("gQueueMaxLen : %v\n", gQueueMaxLen)
+	log.Warnf("gQueueMaxBytes : %v\n", gQueueMaxBytes)
+	log.Warnf("gQueueOverflow : %v\n", gQueueOverflow)
 }
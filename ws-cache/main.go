@@ -8,7 +8,7 @@ import (
 )
 
 func usage() {
-	log.Fatalf("Usage: ws-cache [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-fe FastExit (0)] [-wf WriteLogToFile (0)] [-w MaxCacheSeconds (1800)]\n")
+	log.Fatalf("Usage: ws-cache [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-mp PromPort (0)] [-fe FastExit (0)] [-wf WriteLogToFile (0)] [-m MaxCacheSeconds (1800)] [-st Storage (log|memory)] [-dir DataDir (data)] [-ql QueueMaxLen (1000)] [-qb QueueMaxBytes (1048576)] [-qo QueueOverflow (drop-oldest|drop-newest|collapse)]\n")
 }
 
 //./ws-cache -s nats://192.168.1.223:12008 -d 1
@@ -22,6 +22,7 @@ func main() {
 	log.Warnf("Start Server: %s ...\n", AppName)
 
 	setupMoleculerService()
+	startPromService()
 
 	log.Warn("=================== Server Started ================= ")
 
@@ -36,6 +37,9 @@ func cleanupFunc() {
 	}
 	log.Warnf("Hang on! Server[%s] is closing ...", AppName)
 	log.Warn("=================== exit start =================== ")
+	if gMyHub != nil {
+		gMyHub.close()
+	}
 	time.Sleep(time.Second * 1)
 	log.Warn("=================== exit end   =================== ")
 	log.Warnf("Server[%s] is closed", AppName)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+var gRPCStats = &define.RPCStats{}
+
+//startPromService serve /metrics on gPromPort, 0 to disable
+func startPromService() {
+	err := define.StartPromService(gPromPort, writeProm)
+	if err != nil {
+		log.Warnf("metrics http port[%d] listen err, /metrics disabled: %v\n", gPromPort, err)
+	}
+}
+
+func writeProm(p *define.PromWriter) {
+	var users, msgs, bytes int
+	gMyHub.userQueues.Range(func(key, value interface{}) bool {
+		if queue, ok := value.(*userQueue); ok {
+			queueLen, queueBytes := queue.size()
+			if queueLen > 0 {
+				users++
+				msgs += queueLen
+				bytes += queueBytes
+			}
+		}
+		return true
+	})
+	p.Gauge("ws_cache_users", "users with cached msgs", float64(users))
+	p.Gauge("ws_cache_msgs", "cached msgs", float64(msgs))
+	p.Gauge("ws_cache_bytes", "cached msgs bytes", float64(bytes))
+
+	p.Counter("ws_cache_save_total", "ws-cache.save requests", float64(atomic.LoadUint64(&gTotalSave)))
+	p.Counter("ws_cache_redeliver_total", "cached msgs sent again when user online", float64(atomic.LoadUint64(&gTotalRedeliver)))
+	p.Counter("ws_cache_storage_errors_total", "storage save or delete errors", float64(atomic.LoadUint64(&gStorageErrors)))
+	p.Counter("ws_cache_drops_total", "dropped msgs by reason", float64(atomic.LoadUint64(&gDropOldest)), "reason", overflowDropOldest)
+	p.Counter("ws_cache_drops_total", "", float64(atomic.LoadUint64(&gDropNewest)), "reason", overflowDropNewest)
+	p.Counter("ws_cache_drops_total", "", float64(atomic.LoadUint64(&gDropCollapse)), "reason", overflowCollapse)
+	p.Counter("ws_cache_drops_total", "", float64(atomic.LoadUint64(&gDropTooLarge)), "reason", "too-large")
+	p.Counter("ws_cache_drops_total", "", float64(atomic.LoadUint64(&gDropExpired)), "reason", define.DropReasonExpired)
+
+	gRPCStats.WriteProm(p, "ws_cache")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDropNewest = "drop-newest"
+	overflowCollapse   = "collapse"
+)
+
+var gDropOldest uint64
+var gDropNewest uint64
+var gDropCollapse uint64
+var gDropTooLarge uint64
+var gDropExpired uint64
+var gTotalSave uint64
+var gTotalRedeliver uint64
+var gStorageErrors uint64
+
+//userQueue cached msgs of one user in save order
+type userQueue struct {
+	mtx     sync.Mutex
+	msgs    []*cacheMsgStruct
+	bytes   int
+	removed bool //already deleted from MyHub.userQueues, push to a new one
+}
+
+func (q *userQueue) indexOf(match func(msg *cacheMsgStruct) bool) int {
+	for i, msg := range q.msgs {
+		if match(msg) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *userQueue) removeAt(i int) *cacheMsgStruct {
+	msg := q.msgs[i]
+	q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+	q.bytes -= msg.size
+	return msg
+}
+
+func (q *userQueue) isFull(msg *cacheMsgStruct) bool {
+	return len(q.msgs)+1 > gQueueMaxLen || q.bytes+msg.size > gQueueMaxBytes
+}
+
+//push add msg to tail, return msgs dropped by overflow policy (may include msg itself).
+//return ok false if queue is removed, caller should retry with a new queue
+func (q *userQueue) push(msg *cacheMsgStruct) (dropped []*cacheMsgStruct, ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.removed {
+		return nil, false
+	}
+
+	//same umid saved again, keep the newer one
+	if i := q.indexOf(func(m *cacheMsgStruct) bool { return m.umid == msg.umid }); i >= 0 {
+		q.removeAt(i)
+	}
+
+	if msg.size > gQueueMaxBytes {
+		atomic.AddUint64(&gDropTooLarge, 1)
+		return append(dropped, msg), true
+	}
+
+	if gQueueOverflow == overflowCollapse && len(msg.CollapseKey) > 0 {
+		if i := q.indexOf(func(m *cacheMsgStruct) bool { return m.CollapseKey == msg.CollapseKey }); i >= 0 {
+			atomic.AddUint64(&gDropCollapse, 1)
+			dropped = append(dropped, q.removeAt(i))
+		}
+	}
+
+	for len(q.msgs) > 0 && q.isFull(msg) {
+		if gQueueOverflow == overflowDropNewest {
+			atomic.AddUint64(&gDropNewest, 1)
+			return append(dropped, msg), true
+		}
+		//drop-oldest, also collapse when nothing left to collapse
+		atomic.AddUint64(&gDropOldest, 1)
+		dropped = append(dropped, q.removeAt(0))
+	}
+
+	q.msgs = append(q.msgs, msg)
+	q.bytes += msg.size
+	return dropped, true
+}
+
+//take remove and return all msgs in save order
+func (q *userQueue) take() []*cacheMsgStruct {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	msgs := q.msgs
+	q.msgs = nil
+	q.bytes = 0
+	return msgs
+}
+
+//removeExpired drop msgs passed expireAt or older than maxAge, mark queue removed if it becomes empty
+func (q *userQueue) removeExpired(now time.Time, maxAge time.Duration) (expired []*cacheMsgStruct, empty bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	msgs := q.msgs[:0]
+	for _, msg := range q.msgs {
+		if msg.IsExpired(now) {
+			atomic.AddUint64(&gDropExpired, 1)
+			expired = append(expired, msg)
+			q.bytes -= msg.size
+		} else if now.Sub(*msg.saveTime) > maxAge {
+			expired = append(expired, msg)
+			q.bytes -= msg.size
+		} else {
+			msgs = append(msgs, msg)
+		}
+	}
+	for i := len(msgs); i < len(q.msgs); i++ {
+		q.msgs[i] = nil
+	}
+	q.msgs = msgs
+	if len(q.msgs) == 0 {
+		q.removed = true
+		return expired, true
+	}
+	return expired, false
+}
+
+func (q *userQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.msgs)
+}
+
+//size msgs count and bytes
+func (q *userQueue) size() (int, int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.msgs), q.bytes
+}
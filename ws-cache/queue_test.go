@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+//resetHub fresh gMyHub with memory storage and queue limits, run() is not started
+func resetHub(maxLen int, maxBytes int, overflow string) {
+	log = logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	gQueueMaxLen = maxLen
+	gQueueMaxBytes = maxBytes
+	gQueueOverflow = overflow
+	gMaxCacheSeconds = 1800
+	gMyHub = &MyHub{
+		userQueues: &sync.Map{},
+		storage:    &memoryStorage{},
+		hubClosed:  make(chan int, 1),
+	}
+}
+
+func testCacheMsg(t *testing.T, userID string, mid string, collapseKey string, msg interface{}) *cacheMsgStruct {
+	one, err := newCacheMsg(&define.CacheMsgStruct{
+		UserID:      userID,
+		Cid:         userID + "_ios_node-0",
+		Mid:         mid,
+		Msg:         msg,
+		CollapseKey: collapseKey,
+		Timestamp:   define.Timestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return one
+}
+
+func queueMids(userID string) string {
+	queue, ok := gMyHub.userQueues.Load(userID)
+	if !ok {
+		return ""
+	}
+	q := queue.(*userQueue)
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	mids := make([]string, 0, len(q.msgs))
+	for _, msg := range q.msgs {
+		mids = append(mids, msg.Mid)
+	}
+	return strings.Join(mids, ",")
+}
+
+func droppedMids(dropped []*cacheMsgStruct) string {
+	mids := make([]string, 0, len(dropped))
+	for _, msg := range dropped {
+		mids = append(mids, msg.Mid)
+	}
+	return strings.Join(mids, ",")
+}
+
+func TestQueueOverflow(t *testing.T) {
+	cases := []struct {
+		name     string
+		overflow string
+		maxLen   int
+		push     []string //mid or mid:collapseKey
+		want     string
+		dropped  string //dropped by the last push
+	}{
+		{"drop-oldest", overflowDropOldest, 3, []string{"m1", "m2", "m3", "m4"}, "m2,m3,m4", "m1"},
+		{"drop-newest", overflowDropNewest, 3, []string{"m1", "m2", "m3", "m4"}, "m1,m2,m3", "m4"},
+		{"collapse same key", overflowCollapse, 3, []string{"m1:a", "m2:b", "m3:a"}, "m2,m3", "m1"},
+		{"collapse full without key", overflowCollapse, 2, []string{"m1:a", "m2:b", "m3"}, "m2,m3", "m1"},
+		{"collapse key only in collapse policy", overflowDropOldest, 3, []string{"m1:a", "m2:a"}, "m1,m2", ""},
+		{"same mid saved again", overflowDropNewest, 3, []string{"m1", "m2", "m1"}, "m2,m1", ""},
+	}
+	for _, c := range cases {
+		resetHub(c.maxLen, 1024*1024, c.overflow)
+		var dropped []*cacheMsgStruct
+		for _, one := range c.push {
+			parts := strings.SplitN(one, ":", 2)
+			collapseKey := ""
+			if len(parts) > 1 {
+				collapseKey = parts[1]
+			}
+			dropped = gMyHub.store(testCacheMsg(t, "u1", parts[0], collapseKey, "hello"))
+		}
+		if got := queueMids("u1"); got != c.want {
+			t.Errorf("%s: queue %q, want %q", c.name, got, c.want)
+		}
+		if got := droppedMids(dropped); got != c.dropped {
+			t.Errorf("%s: dropped %q, want %q", c.name, got, c.dropped)
+		}
+	}
+}
+
+func TestQueueOverflowBytes(t *testing.T) {
+	//"0123456789" is 12 bytes encoded
+	resetHub(100, 30, overflowDropOldest)
+	for i := 1; i <= 3; i++ {
+		gMyHub.store(testCacheMsg(t, "u1", "m"+strconv.Itoa(i), "", "0123456789"))
+	}
+	if got := queueMids("u1"); got != "m2,m3" {
+		t.Fatalf("queue %q, want m2,m3", got)
+	}
+	_, bytes := func() (int, int) {
+		queue, _ := gMyHub.userQueues.Load("u1")
+		return queue.(*userQueue).size()
+	}()
+	if bytes != 24 {
+		t.Fatalf("queue bytes %d, want 24", bytes)
+	}
+
+	//larger than the whole queue, dropped and the queue is kept
+	dropped := gMyHub.store(testCacheMsg(t, "u1", "big", "", strings.Repeat("x", 40)))
+	if droppedMids(dropped) != "big" || queueMids("u1") != "m2,m3" {
+		t.Fatalf("too large msg: dropped %q, queue %q", droppedMids(dropped), queueMids("u1"))
+	}
+}
+
+func TestQueueRemovedRetry(t *testing.T) {
+	resetHub(10, 1024*1024, overflowDropOldest)
+	gMyHub.store(testCacheMsg(t, "u1", "m1", "", "hello"))
+	queue, _ := gMyHub.userQueues.Load("u1")
+	queue.(*userQueue).take()
+	//run() removed the empty queue
+	if _, empty := queue.(*userQueue).removeExpired(time.Now(), time.Hour); !empty {
+		t.Fatal("queue not empty after take")
+	}
+	gMyHub.userQueues.Delete("u1")
+
+	gMyHub.store(testCacheMsg(t, "u1", "m2", "", "hello"))
+	if got := queueMids("u1"); got != "m2" {
+		t.Fatalf("queue %q after removed, want m2", got)
+	}
+}
+
+//TestReplayOrder all cached msgs of a user go to ws-sender in one send, in save order
+func TestReplayOrder(t *testing.T) {
+	resetHub(100, 1024*1024, overflowDropOldest)
+	var sends []*define.PushMsgStruct
+	call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+		if action != define.WsSenderActionSend {
+			t.Fatalf("unexpected call %s", action)
+		}
+		sends = append(sends, params.(*define.PushMsgStruct))
+		return nil, nil
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		gMyHub.store(testCacheMsg(t, "u1", "m"+strconv.Itoa(i), "", i))
+	}
+	expired := testCacheMsg(t, "u1", "expired", "", "late")
+	expired.ExpireAt = define.Timestamp(time.Now().Add(-time.Second))
+	gMyHub.store(expired)
+	gMyHub.store(testCacheMsg(t, "u2", "other", "", "hello"))
+
+	eventWsConnectorOutOnline(&protocol.MsEvent{Data: &define.ClientInfo{UserID: "u1", Cid: "u1_ios_node-0"}})
+
+	if len(sends) != 1 {
+		t.Fatalf("got %d ws-sender.send calls, want 1", len(sends))
+	}
+	if len(sends[0].Msgs) != n {
+		t.Fatalf("send has %d msgs, want %d", len(sends[0].Msgs), n)
+	}
+	for i, msg := range sends[0].Msgs {
+		if msg.Data.Mid != "m"+strconv.Itoa(i) || msg.IDs != "u1" {
+			t.Fatalf("msg %d is %s to %v", i, msg.Data.Mid, msg.IDs)
+		}
+	}
+	if got := queueMids("u1"); got != "" {
+		t.Fatalf("queue %q after replay, want empty", got)
+	}
+	if got := queueMids("u2"); got != "other" {
+		t.Fatalf("other user queue %q, want other", got)
+	}
+}
+
+func TestSaveTTL(t *testing.T) {
+	resetHub(100, 1024*1024, overflowDropOldest)
+	_, err := actionSave(&protocol.MsRequest{Params: &define.CacheMsgStruct{
+		UserID:    "u1",
+		Cid:       "u1_ios_node-0",
+		Mid:       "m1",
+		Msg:       "hello",
+		TTL:       60,
+		Timestamp: define.Timestamp(time.Now()),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, ok := gMyHub.userQueues.Load("u1")
+	if !ok {
+		t.Fatal("msg not saved")
+	}
+	msgs := queue.(*userQueue).take()
+	if len(msgs) != 1 {
+		t.Fatalf("queue has %d msgs, want 1", len(msgs))
+	}
+	expireAt, ok := define.ParseTimestamp(msgs[0].ExpireAt)
+	if !ok || expireAt.Before(time.Now().Add(time.Second*55)) || expireAt.After(time.Now().Add(time.Second*61)) {
+		t.Fatalf("saved expireAt %q, want about 60s later", msgs[0].ExpireAt)
+	}
+}
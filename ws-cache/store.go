@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
+)
+
+const (
+	storageMemory = "memory"
+	storageLog    = "log"
+)
+
+const (
+	logOpSave   = "save"
+	logOpDelete = "del"
+)
+
+//minCompactRecords skip compaction while the log file is still small
+const minCompactRecords = 10000
+
+//CacheStorage persist cached messages, MyHub keeps the in memory index
+type CacheStorage interface {
+	//Save persist one cached message
+	Save(msg *cacheMsgStruct) error
+	//Delete remove cached messages by umid
+	Delete(umids []string) error
+	//Recover call fn for every stored message in save order
+	Recover(fn func(msg *cacheMsgStruct)) error
+	//Compact drop deleted records from the storage
+	Compact() error
+	//Close flush and release the storage
+	Close() error
+}
+
+func newCacheStorage() (CacheStorage, error) {
+	switch gStorage {
+	case storageMemory:
+		return &memoryStorage{}, nil
+	case storageLog:
+		os.MkdirAll(gDataDir, os.ModePerm)
+		return openLogStorage(filepath.Join(gDataDir, gNodeID+".log"))
+	}
+	return nil, errors.New("unknown storage: " + gStorage)
+}
+
+//memoryStorage keep nothing, messages are lost when process exit
+type memoryStorage struct{}
+
+func (s *memoryStorage) Save(msg *cacheMsgStruct) error             { return nil }
+func (s *memoryStorage) Delete(umids []string) error                { return nil }
+func (s *memoryStorage) Recover(fn func(msg *cacheMsgStruct)) error { return nil }
+func (s *memoryStorage) Compact() error                             { return nil }
+func (s *memoryStorage) Close() error                               { return nil }
+
+type logRecordStruct struct {
+	Op    string                 `json:"op"`
+	Seq   uint64                 `json:"seq,omitempty"`
+	Msg   *define.CacheMsgStruct `json:"msg,omitempty"`
+	Umids []string               `json:"umids,omitempty"`
+}
+
+type logEntry struct {
+	seq  uint64
+	line []byte
+}
+
+//logStorage append-only log file, one json record per line.
+//Deleted records stay in the file until Compact rewrite it with live records only
+type logStorage struct {
+	mtx     sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64
+	live    map[string]*logEntry //map[string(umid)]*logEntry
+	records int
+	dirty   bool
+	closed  chan int
+}
+
+func openLogStorage(path string) (*logStorage, error) {
+	s := &logStorage{
+		path:   path,
+		live:   make(map[string]*logEntry),
+		closed: make(chan int, 1),
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	//rewrite at startup, also drop a half written last line after crash
+	err = s.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	s.runSync()
+	return s, nil
+}
+
+func (s *logStorage) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		record := &logRecordStruct{}
+		err := jsoniter.Unmarshal(line, record)
+		if err != nil {
+			log.Warnf("logStorage load, skip bad line[%d]: %v\n", lineNum, err)
+			continue
+		}
+		switch record.Op {
+		case logOpSave:
+			if record.Msg == nil {
+				continue
+			}
+			umid := genUniqueMid(record.Msg.UserID, record.Msg.Cid, record.Msg.Mid)
+			s.live[umid] = &logEntry{
+				seq:  record.Seq,
+				line: append([]byte(nil), line...),
+			}
+			if record.Seq > s.seq {
+				s.seq = record.Seq
+			}
+		case logOpDelete:
+			for _, umid := range record.Umids {
+				delete(s.live, umid)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+//sortedLive return live entries in save order, must hold mtx
+func (s *logStorage) sortedLive() []*logEntry {
+	entries := make([]*logEntry, 0, len(s.live))
+	for _, entry := range s.live {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	return entries
+}
+
+//rewrite write live records to a temp file and rename it over the log, must hold mtx or not started
+func (s *logStorage) rewrite() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, entry := range s.sortedLive() {
+		w.Write(entry.line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.records = len(s.live)
+	s.dirty = false
+	return nil
+}
+
+func (s *logStorage) append(record *logRecordStruct) ([]byte, error) {
+	line, err := jsoniter.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if s.file == nil {
+		return nil, errors.New("log storage is closed")
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	s.records++
+	s.dirty = true
+	return line, nil
+}
+
+//Save ...
+func (s *logStorage) Save(msg *cacheMsgStruct) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.seq++
+	line, err := s.append(&logRecordStruct{
+		Op:  logOpSave,
+		Seq: s.seq,
+		Msg: msg.CacheMsgStruct,
+	})
+	if err != nil {
+		return err
+	}
+	s.live[msg.umid] = &logEntry{
+		seq:  s.seq,
+		line: line,
+	}
+	return nil
+}
+
+//Delete ...
+func (s *logStorage) Delete(umids []string) error {
+	if len(umids) < 1 {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.append(&logRecordStruct{
+		Op:    logOpDelete,
+		Umids: umids,
+	})
+	if err != nil {
+		return err
+	}
+	for _, umid := range umids {
+		delete(s.live, umid)
+	}
+	return nil
+}
+
+//Recover ...
+func (s *logStorage) Recover(fn func(msg *cacheMsgStruct)) error {
+	s.mtx.Lock()
+	entries := s.sortedLive()
+	s.mtx.Unlock()
+
+	for _, entry := range entries {
+		record := &logRecordStruct{}
+		err := jsoniter.Unmarshal(entry.line, record)
+		if err != nil || record.Msg == nil {
+			continue
+		}
+		msg, err := newCacheMsg(record.Msg)
+		if err != nil {
+			log.Warn("logStorage Recover, newCacheMsg error: ", err)
+			continue
+		}
+		fn(msg)
+	}
+	return nil
+}
+
+//Compact rewrite the log when more than half records are deleted
+func (s *logStorage) Compact() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if s.records < minCompactRecords || s.records < len(s.live)*2 {
+		return nil
+	}
+	log.Warnf("logStorage Compact, records[%d] live[%d]\n", s.records, len(s.live))
+	return s.rewrite()
+}
+
+//runSync fsync the log file every second if something written
+func (s *logStorage) runSync() {
+	go func() {
+		ticker := time.NewTicker(time.Second * 1)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mtx.Lock()
+				if s.dirty && s.file != nil {
+					s.file.Sync()
+					s.dirty = false
+				}
+				s.mtx.Unlock()
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+}
+
+//Close ...
+func (s *logStorage) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	s.closed <- 1
+	s.file.Sync()
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
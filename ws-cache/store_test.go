@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogPath(t *testing.T) (string, func()) {
+	log = logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	dir, err := ioutil.TempDir("", "ws-cache-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cache.log"), func() { os.RemoveAll(dir) }
+}
+
+func openTestStorage(t *testing.T, path string) *logStorage {
+	s, err := openLogStorage(path)
+	if err != nil {
+		t.Fatalf("openLogStorage: %v", err)
+	}
+	return s
+}
+
+//recoverMids mids in the order Recover return them
+func recoverMids(t *testing.T, s *logStorage) []string {
+	mids := make([]string, 0)
+	err := s.Recover(func(msg *cacheMsgStruct) {
+		mids = append(mids, msg.Mid)
+	})
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	return mids
+}
+
+func fileLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+func TestLogStorageReopen(t *testing.T) {
+	path, clean := testLogPath(t)
+	defer clean()
+
+	s := openTestStorage(t, path)
+	msgs := make([]*cacheMsgStruct, 0)
+	for i := 0; i < 4; i++ {
+		msg := testCacheMsg(t, "u1", "m"+strconv.Itoa(i), "", "hello")
+		msgs = append(msgs, msg)
+		if err := s.Save(msg); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	s.Delete([]string{msgs[1].umid})
+	s.Close()
+
+	s = openTestStorage(t, path)
+	if got := strings.Join(recoverMids(t, s), ","); got != "m0,m2,m3" {
+		t.Fatalf("after reopen got %s, want m0,m2,m3", got)
+	}
+	//save after reopen keep the order, delete of a recovered msg is persisted
+	s.Save(testCacheMsg(t, "u1", "m4", "", "hello"))
+	s.Delete([]string{msgs[0].umid})
+	s.Close()
+
+	//reopen without Close, what is written is not lost
+	s = openTestStorage(t, path)
+	s.Save(testCacheMsg(t, "u2", "m5", "", "hello"))
+	crashed := s
+	s = openTestStorage(t, path)
+	defer s.Close()
+	defer crashed.Close()
+	if got := strings.Join(recoverMids(t, s), ","); got != "m2,m3,m4,m5" {
+		t.Fatalf("after second reopen got %s, want m2,m3,m4,m5", got)
+	}
+}
+
+func TestLogStorageTornLine(t *testing.T) {
+	path, clean := testLogPath(t)
+	defer clean()
+
+	s := openTestStorage(t, path)
+	s.Save(testCacheMsg(t, "u1", "m0", "", "hello"))
+	s.Save(testCacheMsg(t, "u1", "m1", "", "hello"))
+	s.Close()
+
+	//crash in the middle of writing the last line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"save","seq":3,"msg":{"userID":"u1","mi`)
+	f.Close()
+
+	s = openTestStorage(t, path)
+	if got := strings.Join(recoverMids(t, s), ","); got != "m0,m1" {
+		t.Fatalf("torn line got %s, want m0,m1", got)
+	}
+	if lines := fileLines(t, path); len(lines) != 2 {
+		t.Fatalf("torn line not dropped at open, %d lines", len(lines))
+	}
+	//next append start on its own line
+	s.Save(testCacheMsg(t, "u1", "m2", "", "hello"))
+	s.Close()
+
+	s = openTestStorage(t, path)
+	defer s.Close()
+	if got := strings.Join(recoverMids(t, s), ","); got != "m0,m1,m2" {
+		t.Fatalf("save after torn line got %s, want m0,m1,m2", got)
+	}
+}
+
+func TestLogStorageCompact(t *testing.T) {
+	path, clean := testLogPath(t)
+	defer clean()
+
+	s := openTestStorage(t, path)
+	defer s.Close()
+	live := make(map[string]bool)
+	deleted := make([]string, 0)
+	for i := 0; i < minCompactRecords; i++ {
+		msg := testCacheMsg(t, "u"+strconv.Itoa(i%10), "m"+strconv.Itoa(i), "", i)
+		s.Save(msg)
+		if i%3 == 0 {
+			live[msg.Mid] = true
+		} else {
+			deleted = append(deleted, msg.umid)
+		}
+	}
+
+	//not enough deleted, nothing to do
+	s.Compact()
+	if lines := fileLines(t, path); len(lines) != minCompactRecords {
+		t.Fatalf("compact with no deleted rewrote the log, %d lines", len(lines))
+	}
+
+	for i := 0; i < len(deleted); i += 100 {
+		end := i + 100
+		if end > len(deleted) {
+			end = len(deleted)
+		}
+		s.Delete(deleted[i:end])
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	lines := fileLines(t, path)
+	if len(lines) != len(live) {
+		t.Fatalf("after compact %d lines, want %d live", len(lines), len(live))
+	}
+	if s.records != len(live) {
+		t.Fatalf("records %d after compact, want %d", s.records, len(live))
+	}
+	mids := recoverMids(t, s)
+	seen := make(map[string]bool)
+	for _, mid := range mids {
+		if !live[mid] || seen[mid] {
+			t.Fatalf("compact kept %s, deleted or twice", mid)
+		}
+		seen[mid] = true
+	}
+	if len(seen) != len(live) {
+		t.Fatalf("compact kept %d of %d live", len(seen), len(live))
+	}
+
+	//log still append after compact
+	s.Save(testCacheMsg(t, "u1", "after", "", "hello"))
+	if lines := fileLines(t, path); len(lines) != len(live)+1 {
+		t.Fatalf("save after compact not appended, %d lines", len(lines))
+	}
+}
+
+//raceStorage run beforeSave just before the save record is logged
+type raceStorage struct {
+	*logStorage
+	beforeSave func()
+}
+
+func (s *raceStorage) Save(msg *cacheMsgStruct) error {
+	if s.beforeSave != nil {
+		s.beforeSave()
+	}
+	return s.logStorage.Save(msg)
+}
+
+//TestSaveRedeliverRace a redelivery (take, Delete) right before the save record is logged
+//must not leave a msg that is delivered again after restart
+func TestSaveRedeliverRace(t *testing.T) {
+	path, clean := testLogPath(t)
+	defer clean()
+	resetHub(100, 1024*1024, overflowDropOldest)
+	call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+		return nil, nil
+	}
+	online := func() {
+		eventWsConnectorOutOnline(&protocol.MsEvent{Data: &define.ClientInfo{UserID: "u1"}})
+	}
+	storage := &raceStorage{logStorage: openTestStorage(t, path), beforeSave: online}
+	gMyHub.storage = storage
+
+	_, err := actionSave(&protocol.MsRequest{Params: &define.CacheMsgStruct{
+		UserID:    "u1",
+		Cid:       "u1_ios_node-0",
+		Mid:       "m1",
+		Msg:       "hello",
+		Timestamp: define.Timestamp(time.Now()),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//delivered now or on the next online, then deleted
+	storage.beforeSave = nil
+	online()
+	storage.Close()
+
+	s := openTestStorage(t, path)
+	defer s.Close()
+	if mids := recoverMids(t, s); len(mids) > 0 {
+		t.Fatalf("delivered msg recovered after restart: %v", mids)
+	}
+}
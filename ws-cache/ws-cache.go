@@ -2,11 +2,12 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
@@ -14,6 +15,11 @@ import (
 var pBroker *moleculer.ServiceBroker
 var gMoleculerService *moleculer.Service
 
+//call pBroker.Call, replaced in tests
+var call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+	return pBroker.Call(action, params, opts)
+}
+
 func setupMoleculerService() {
 	//init service and broker
 	config := &moleculer.ServiceBrokerConfig{
@@ -46,50 +52,71 @@ func createMoleculerService() moleculer.Service {
 	}
 
 	//init actions handlers
-	gMoleculerService.Actions["save"] = actionSave
+	gMoleculerService.Actions["save"] = define.TimedAction(gRPCStats, define.WsCacheActionSave, actionSave)
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutOnline] = eventWsConnectorOutOnline
+	gMoleculerService.Events[define.WsConnectorOutOnline] = eventWsConnectorOutOnline
 
 	//init hub
+	storage, err := newCacheStorage()
+	if err != nil {
+		log.Fatalf("exit process, newCacheStorage err: %v\n", err)
+	}
 	gMyHub = &MyHub{
-		cachedMsgs:     &sync.Map{},
-		userCachedMids: &sync.Map{},
-		hubClosed:      make(chan int, 1),
+		userQueues: &sync.Map{},
+		storage:    storage,
+		hubClosed:  make(chan int, 1),
 	}
+	gMyHub.recover()
 	gMyHub.run()
 
 	return *gMoleculerService
 }
 
-//mol $ call ws-sender.send --ids gotest-user-0,gotest-user-1 --data.mid m123 --data.msg.a abc --data.msg.b 111 --data.msg.c true
+//mol $ call ws-cache.save --userID gotest-user-0 --cid c1 --mid m123 --timestamp 1510000000000 --msg.a abc
 func actionSave(req *protocol.MsRequest) (interface{}, error) {
 	log.Info("run actionSave")
+	atomic.AddUint64(&gTotalSave, 1)
 
-	jsonByte, err := jsoniter.Marshal(req.Params)
+	data := &define.CacheMsgStruct{}
+	err := define.Decode(req.Params, data)
 	if err != nil {
-		log.Warn("run actionSave, parse req.Data to jsonByte error: ", err)
+		log.Warn("run actionSave, parse req.Params to jsonObj CacheMsgStruct error: ", err)
 		return nil, err
 	}
-	jsonObj := &cacheMsgStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
+	now := time.Now()
+	data.ApplyTTL(now)
+	if data.IsExpired(now) {
+		atomic.AddUint64(&gDropExpired, 1)
+		log.Infof("run actionSave, drop expired msg, mid[%s] expireAt[%s]\n", data.Mid, data.ExpireAt)
+		return nil, nil
+	}
+	jsonObj, err := newCacheMsg(data)
 	if err != nil {
-		log.Warn("run actionSave, parse jsonByte to jsonObj cacheMsgStruct error: ", err)
+		log.Warn("run actionSave, newCacheMsg error: ", err)
 		return nil, err
 	}
-	jsonObj.saveTime, err = timestampToTime(jsonObj.Timestamp)
+	log.Info("run actionSave, Store msg: ", jsonObj)
+	//save record must be logged before the msg is visible to take, or a del logged
+	//by a redelivery in between would come before it and the msg revive after restart
+	err = gMyHub.storage.Save(jsonObj)
 	if err != nil {
-		log.Warn("run actionSave, parse timestampToTime error: ", err)
+		log.Warn("run actionSave, storage Save error: ", err)
+		atomic.AddUint64(&gStorageErrors, 1)
 		return nil, err
 	}
-	jsonObj.umid = genUniqueMid(jsonObj.UserID, jsonObj.Cid, jsonObj.Mid)
-	log.Info("run actionSave, Store msg: ", jsonObj)
-	gMyHub.cachedMsgs.Store(jsonObj.umid, jsonObj)
-
-	newOneUserCachedMids := &sync.Map{}
-	oneUserCachedMids, _ := gMyHub.userCachedMids.LoadOrStore(jsonObj.UserID, newOneUserCachedMids)
-	if oneUserCachedMidsObj, ok := oneUserCachedMids.(*sync.Map); ok {
-		oneUserCachedMidsObj.Store(jsonObj.umid, struct{}{})
+	dropped := gMyHub.store(jsonObj)
+	droppedUmids := make([]string, 0, len(dropped))
+	for _, msg := range dropped {
+		droppedUmids = append(droppedUmids, msg.umid)
+	}
+	if len(dropped) > 0 {
+		log.Warnf("run actionSave, UserID[%s] queue overflow[%s], dropped: %d\n", jsonObj.UserID, gQueueOverflow, len(dropped))
+	}
+	err = gMyHub.storage.Delete(droppedUmids)
+	if err != nil {
+		log.Warn("run actionSave, storage Delete error: ", err)
+		atomic.AddUint64(&gStorageErrors, 1)
 	}
 
 	return nil, nil
@@ -98,54 +125,137 @@ func actionSave(req *protocol.MsRequest) (interface{}, error) {
 func eventWsConnectorOutOnline(req *protocol.MsEvent) {
 	log.Info("run eventWsConnectorOutOnline")
 
-	jsonByte, err := jsoniter.Marshal(req.Data)
-	if err != nil {
-		log.Warn("run eventWsConnectorOutOnline, parse req.Data to jsonByte error: ", err)
-		return
-	}
-	jsonObj := &ClientInfo{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
+	jsonObj := &define.ClientInfo{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
-		log.Warn("run eventWsConnectorOutOnline, parse jsonByte to jsonObj ClientInfo error: ", err)
+		log.Warn("run eventWsConnectorOutOnline, parse req.Data to jsonObj ClientInfo error: ", err)
 		return
 	}
 
 	log.Info("run eventWsConnectorOutOnline, online client : ", jsonObj)
 
-	oneUserCachedMids, ok := gMyHub.userCachedMids.Load(jsonObj.UserID)
-	if ok {
-		if oneUserCachedMidsObj, ok := oneUserCachedMids.(*sync.Map); ok {
-			oneUserCachedMidsObj.Range(func(key, value interface{}) bool {
-				if umid, ok := key.(string); ok {
-					cacheMsg, ok := gMyHub.cachedMsgs.Load(umid)
-					if ok {
-						gMyHub.cachedMsgs.Delete(umid)
-						if cacheMsgObj, ok := cacheMsg.(*cacheMsgStruct); ok {
-							pBroker.Call(cWsSenderActionSend, &pushMsgStruct{
-								IDs: cacheMsgObj.UserID,
-								Data: &pushMsgDataStruct{
-									Mid: cacheMsgObj.Mid,
-									Msg: cacheMsgObj.Msg,
-								},
-							}, nil)
-							log.Infof("re-send: UserID[%s] Cid[%s] Mid[%s]\n", cacheMsgObj.UserID, cacheMsgObj.Cid, cacheMsgObj.Mid)
-						}
-					}
-				}
-				return true
-			})
+	queue, ok := gMyHub.userQueues.Load(jsonObj.UserID)
+	if !ok {
+		return
+	}
+	queueObj, ok := queue.(*userQueue)
+	if !ok {
+		return
+	}
+	//re-send in save order, all msgs in one ws-sender.send so they are pushed in this order
+	msgs := queueObj.take()
+	sentUmids := make([]string, 0, len(msgs))
+	batch := make([]*define.PushMsgStruct, 0, len(msgs))
+	now := time.Now()
+	for _, cacheMsgObj := range msgs {
+		sentUmids = append(sentUmids, cacheMsgObj.umid)
+		if cacheMsgObj.IsExpired(now) {
+			atomic.AddUint64(&gDropExpired, 1)
+			log.Infof("drop expired msg: UserID[%s] Cid[%s] Mid[%s]\n", cacheMsgObj.UserID, cacheMsgObj.Cid, cacheMsgObj.Mid)
+			continue
 		}
+		batch = append(batch, &define.PushMsgStruct{
+			IDs:    cacheMsgObj.UserID,
+			Target: cacheMsgObj.Target,
+			Data: &define.PushMsgDataStruct{
+				Mid:         cacheMsgObj.Mid,
+				Msg:         cacheMsgObj.Msg,
+				CollapseKey: cacheMsgObj.CollapseKey,
+				ExpireAt:    cacheMsgObj.ExpireAt,
+			},
+		})
+		log.Infof("re-send: UserID[%s] Cid[%s] Mid[%s]\n", cacheMsgObj.UserID, cacheMsgObj.Cid, cacheMsgObj.Mid)
+	}
+	if len(batch) > 0 {
+		atomic.AddUint64(&gTotalRedeliver, uint64(len(batch)))
+		start := time.Now()
+		_, err := call(define.WsSenderActionSend, &define.PushMsgStruct{Msgs: batch}, nil)
+		gRPCStats.Observe(define.WsSenderActionSend, start, err)
+		if err != nil {
+			log.Warn("run eventWsConnectorOutOnline, call ws-sender.send err: ", err)
+		}
+	}
+	err = gMyHub.storage.Delete(sentUmids)
+	if err != nil {
+		log.Warn("run eventWsConnectorOutOnline, storage Delete error: ", err)
+		atomic.AddUint64(&gStorageErrors, 1)
 	}
-	gMyHub.userCachedMids.Delete(jsonObj.UserID)
+}
+
+func newCacheMsg(data *define.CacheMsgStruct) (*cacheMsgStruct, error) {
+	saveTime, err := timestampToTime(data.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	msgBytes, err := define.Encode(data.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheMsgStruct{
+		CacheMsgStruct: data,
+		saveTime:       saveTime,
+		umid:           genUniqueMid(data.UserID, data.Cid, data.Mid),
+		size:           len(msgBytes),
+	}, nil
 }
 
 var gMyHub *MyHub
 
 //MyHub ...
 type MyHub struct {
-	cachedMsgs     *sync.Map //sync.Map[string(Mid)]*cacheMsgStruct
-	userCachedMids *sync.Map //sync.Map[string(UserID)]*sync.Map[string(Mid)]struct{}
-	hubClosed      chan int
+	userQueues *sync.Map //sync.Map[string(UserID)]*userQueue
+	storage    CacheStorage
+	hubClosed  chan int
+}
+
+//store add msg to user queue, return msgs dropped by overflow policy
+func (h *MyHub) store(msg *cacheMsgStruct) []*cacheMsgStruct {
+	for {
+		queue, _ := h.userQueues.LoadOrStore(msg.UserID, &userQueue{})
+		queueObj, ok := queue.(*userQueue)
+		if !ok {
+			return nil
+		}
+		dropped, ok := queueObj.push(msg)
+		if ok {
+			return dropped
+		}
+		//queue removed by run() just now, it is already deleted from userQueues
+	}
+}
+
+//recover rebuild user queues from storage, drop messages expired while stopped
+func (h *MyHub) recover() {
+	now := time.Now()
+	count := 0
+	var droppedUmids []string
+	err := h.storage.Recover(func(msg *cacheMsgStruct) {
+		if now.Sub(*msg.saveTime) > time.Second*time.Duration(gMaxCacheSeconds) || msg.IsExpired(now) {
+			droppedUmids = append(droppedUmids, msg.umid)
+			return
+		}
+		count++
+		for _, dropped := range h.store(msg) {
+			count--
+			droppedUmids = append(droppedUmids, dropped.umid)
+		}
+	})
+	if err != nil {
+		log.Fatalf("exit process, recover cached msgs err: %v\n", err)
+	}
+	err = h.storage.Delete(droppedUmids)
+	if err != nil {
+		log.Warn("recover, storage Delete dropped error: ", err)
+	}
+	log.Warnf("recover cached msgs: %d, dropped: %d\n", count, len(droppedUmids))
+}
+
+func (h *MyHub) close() {
+	h.hubClosed <- 1
+	err := h.storage.Close()
+	if err != nil {
+		log.Warn("close storage error: ", err)
+	}
 }
 
 func (h *MyHub) run() {
@@ -155,73 +265,39 @@ func (h *MyHub) run() {
 			select {
 			case <-ticker.C:
 				now := time.Now()
+				maxAge := time.Second * time.Duration(gMaxCacheSeconds)
 				cacheCount := 0
-				h.cachedMsgs.Range(func(key1, value interface{}) bool {
-					cacheCount++
-					if cacheMsg, ok := value.(*cacheMsgStruct); ok {
-						diff := now.Sub(*cacheMsg.saveTime)
-						if diff > time.Second*time.Duration(gMaxCacheSeconds) {
-							cacheCount--
-							h.cachedMsgs.Delete(key1)
-							log.Info("delete timeout cached umid: ", cacheMsg)
+				var expiredUmids []string
+				h.userQueues.Range(func(key, value interface{}) bool {
+					if queue, ok := value.(*userQueue); ok {
+						expired, empty := queue.removeExpired(now, maxAge)
+						for _, cacheMsg := range expired {
 							log.Info("delete timeout cached msg: ", cacheMsg)
-
-							oneUserCachedMids, ok := gMyHub.userCachedMids.Load(cacheMsg.UserID)
-							if ok {
-								if oneUserCachedMidsObj, ok := oneUserCachedMids.(*sync.Map); ok {
-									count := 0
-									oneUserCachedMidsObj.Range(func(key2, value interface{}) bool {
-										count++
-										umid1, ok1 := key1.(string)
-										umid2, ok2 := key2.(string)
-										if ok1 && ok2 && umid1 == umid2 {
-											oneUserCachedMidsObj.Delete(key2)
-										}
-										return true
-									})
-									if count == 0 {
-										gMyHub.userCachedMids.Delete(cacheMsg.UserID)
-									}
-								}
-							}
+							expiredUmids = append(expiredUmids, cacheMsg.umid)
+						}
+						if empty {
+							h.userQueues.Delete(key)
+						} else {
+							cacheCount += queue.len()
 						}
-
-						// else {
-						// 	res, err := pBroker.Call(cWsOnlineActionOnlineStatus, &userIDStruct{
-						// 		UserID: cacheMsg.UserID,
-						// 	}, nil)
-						// 	if err != nil {
-						// 		log.Warn("get ws-online.onlineStatus err: ", err)
-						// 		return true
-						// 	}
-						// 	jsonByte, err := jsoniter.Marshal(res)
-						// 	if err != nil {
-						// 		log.Warn("parse res to jsonByte error: ", err)
-						// 		return true
-						// 	}
-						// 	jsonObj := &onlineStatusStruct{}
-						// 	err = jsoniter.Unmarshal(jsonByte, jsonObj)
-						// 	if err != nil {
-						// 		log.Warn("parse jsonByte to onlineStatusStruct error: ", err)
-						// 		return true
-						// 	}
-						// 	if jsonObj.IsRealOnline {
-						// 		pBroker.Call(cWsSenderActionSend, &pushMsgStruct{
-						// 			IDs: cacheMsg.UserID,
-						// 			Data: &pushMsgDataStruct{
-						// 				Mid: cacheMsg.Mid,
-						// 				Msg: cacheMsg.Msg,
-						// 			},
-						// 		}, nil)
-						// 		log.Info("re-send: ", key)
-						// 	}
-						// }
 					}
 					return true
 				})
 				if cacheCount > 0 {
 					log.Warn("cacheCount = ", cacheCount)
 				}
+				log.Warnf("drop oldest[%d] newest[%d] collapse[%d] tooLarge[%d] %s[%d]\n",
+					atomic.LoadUint64(&gDropOldest), atomic.LoadUint64(&gDropNewest),
+					atomic.LoadUint64(&gDropCollapse), atomic.LoadUint64(&gDropTooLarge),
+					define.DropReasonExpired, atomic.LoadUint64(&gDropExpired))
+				err := h.storage.Delete(expiredUmids)
+				if err != nil {
+					log.Warn("storage Delete expired error: ", err)
+				}
+				err = h.storage.Compact()
+				if err != nil {
+					log.Warn("storage Compact error: ", err)
+				}
 			case <-h.hubClosed:
 				return
 			}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 )
 
 type WsClient struct {
@@ -53,11 +54,11 @@ func (c *WsClient) run() {
 				return
 			}
 			// log.Info("WsClient recv: ", string(message))
-			jsonObj := &pushMsgDataStruct{}
+			jsonObj := &define.PushMsgDataStruct{}
 			err = jsoniter.Unmarshal(message, jsonObj)
 			if err == nil {
 				if len(jsonObj.Mid) > 0 {
-					ack := &ackStruct{
+					ack := &define.AckStruct{
 						Aid: jsonObj.Mid,
 					}
 					c.conn.WriteJSON(ack)
@@ -3,7 +3,6 @@ package main
 import (
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
 	moleculer "github.com/roytan883/moleculer-go"
 	logrus "github.com/sirupsen/logrus"
 )
@@ -37,64 +36,3 @@ const (
 )
 
 type gCmdType uint32
-
-const (
-	cgListenPush             = AppName + ".in.push"
-	cgListenKickClient       = AppName + ".in.kickClient"
-	cgListenKickUser         = AppName + ".in.kickUser"
-	cgListeSyncUsersInfo     = AppName + ".in.syncUsersInfo"
-	cgBroadcastUserOnline    = AppName + ".out.userOnline"
-	cgBroadcastUserOffline   = AppName + ".out.userOffline"
-	cgBroadcastAck           = AppName + ".out.ack"
-	cgBroadcastSyncUsersInfo = AppName + ".out.syncUsersInfo"
-	cgVerifyToken            = "ws-token.verify"
-)
-
-type ackStruct struct {
-	Aid    string `json:"aid"`
-	Cid    string `json:"cid"`
-	UserID string `json:"userID"`
-}
-
-type pushMsgStruct struct {
-	IDs  interface{} `json:"ids"`
-	Data interface{} `json:"data"`
-}
-
-type pushMsgDataStruct struct {
-	Mid string      `json:"mid"`
-	Msg interface{} `json:"msg"`
-}
-
-type kickClientStruct struct {
-	Cid string `json:"cid"`
-}
-
-type kickUserStruct struct {
-	UserID string `json:"userID"`
-}
-
-type getUserOnlineInfoStruct struct {
-	UserID string `json:"userID"`
-}
-
-type verifyTokenStruct struct {
-	Url       string `json:"url"`
-	UserID    string `json:"userID"`
-	Platform  string `json:"platform"`
-	Version   string `json:"version"`
-	Timestamp string `json:"timestamp"`
-	Token     string `json:"token"`
-}
-
-func (v *verifyTokenStruct) String() string {
-	data, err := jsoniter.Marshal(v)
-	if err != nil {
-		return ""
-	}
-	return string(data)
-}
-
-type verifyTokenResultStruct struct {
-	Invalid bool `json:"invalid"` //GO default bool is false, so use invalid == true to detect invalid token
-}
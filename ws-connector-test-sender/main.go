@@ -12,6 +12,7 @@ import (
 	rotatelogs "github.com/lestrrat/go-file-rotatelogs"
 	nats "github.com/nats-io/go-nats"
 	"github.com/rifflock/lfshook"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	logrus "github.com/sirupsen/logrus"
 	"github.com/xlab/closer"
@@ -178,7 +179,7 @@ func main() {
 							},
 						},
 					}
-					pBroker.Broadcast("ws-connector.in.push", testData)
+					pBroker.Broadcast(define.WsConnectorInPush, testData)
 				}
 			case <-gCloseChan:
 				return
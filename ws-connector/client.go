@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 
 	"github.com/gorilla/websocket"
 )
@@ -38,12 +39,32 @@ type Client struct {
 
 	hub *Hub
 
+	// Connection number in this process, and ClientInfo event seq (see nextSeq).
+	connSeq     uint64
+	seqMu       sync.Mutex
+	seq         uint64
+	offlineSent bool
+
+	// Negotiated frame encoding, json use text frames, others use binary frames.
+	encoding string
+
+	// Use permessage-deflate for frames bigger than gCompressThreshold.
+	compress bool
+
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	sendChan chan []byte
+	// Buffered channel of outbound messages, gSendQueue depth.
+	sendChan chan *outFrame
 	sendMu   sync.Mutex
+	queueMu  sync.Mutex
+
+	// Write time of pushed mids waiting ack.
+	ackWait ackWait
+
+	// Msgs dropped by slow consumer policy, and why client went offline.
+	dropped       uint64
+	offlineReason atomic.Value
 
 	sendPongChan chan int
 
@@ -58,28 +79,66 @@ func (c *Client) String() string {
 	return string(data)
 }
 
+func (c *Client) info(isOnline bool) *define.ClientInfo {
+	return &define.ClientInfo{
+		NodeID:         gNodeID,
+		Cid:            c.Cid,
+		UserID:         c.UserID,
+		Platform:       c.Platform,
+		Version:        c.Version,
+		Timestamp:      c.Timestamp,
+		Token:          c.Token,
+		ConnectTime:    c.ConnectTime,
+		DisconnectTime: c.DisconnectTime,
+		IsOnline:       isOnline,
+		Reason:         c.getOfflineReason(),
+		Dropped:        atomic.LoadUint64(&c.dropped),
+		Epoch:          gEpoch,
+		ConnSeq:        c.connSeq,
+	}
+}
+
+//nextSeq seq of the next ClientInfo event, taken when the event is queued so ws-online can
+//reject events handled out of order. ok is false after the offline event, nothing follows it
+func (c *Client) nextSeq(offline bool) (seq uint64, ok bool) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	if c.offlineSent {
+		return 0, false
+	}
+	c.seq++
+	c.offlineSent = offline
+	return c.seq, true
+}
+
 func (c *Client) send(data interface{}) {
 	// log.Printf("client[%s] send data: %v\n", c.Cid, data)
-	if atomic.LoadInt32(&c.closed) > 0 {
-		log.Warnf("client[%s] already closed, can't send\n", c.Cid)
-		return //already closed
-	}
-	if byteData, ok := data.([]byte); ok {
-		log.Infof("client[%s] send []byte: %s\n", c.Cid, string(byteData))
-		c.sendChan <- byteData
+	byteData, err := encodeFrame(c.encoding, data)
+	if err != nil {
+		log.Infof("client[%s] send encode[%s] data err: %v\n", c.Cid, c.encoding, err)
 		return
 	}
-	if byteData, ok := data.(string); ok {
-		log.Infof("client[%s] send string: %s\n", c.Cid, byteData)
-		c.sendChan <- []byte(byteData)
+	frame, err := newOutFrame(c.encoding, byteData)
+	if err != nil {
+		log.Infof("client[%s] send prepare frame err: %v\n", c.Cid, err)
 		return
 	}
-	if byteData, err := jsoniter.Marshal(data); err == nil {
-		log.Infof("client[%s] send Marshal []byte: %s\n", c.Cid, string(byteData))
-		c.sendChan <- byteData
+	c.sendFrame(frame)
+}
+
+//sendFrame send encoded frame, the frame may be shared with other clients and must not be modified
+func (c *Client) sendFrame(frame *outFrame) {
+	if atomic.LoadInt32(&c.closed) > 0 {
+		log.Warnf("client[%s] already closed, can't send\n", c.Cid)
+		return //already closed
+	}
+	if c.encoding == encodingJSON {
+		log.Infof("client[%s] send: %s\n", c.Cid, frame.data)
 	} else {
-		log.Infof("client[%s] send Marshal data err:", c.Cid, err)
-		log.Infof("client[%s] send Marshal data err\n", c.Cid)
+		log.Infof("client[%s] send %s: %d bytes\n", c.Cid, c.encoding, frame.size)
+	}
+	if c.enqueue(frame) {
+		c.countSent(frame)
 	}
 }
 
@@ -105,7 +164,9 @@ func (c *Client) close() {
 	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 3))
 	c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 	c.sendMu.Unlock()
+	c.queueMu.Lock()
 	close(c.sendChan)
+	c.queueMu.Unlock()
 	close(c.sendPongChan)
 	c.conn.Close()
 	c.hub.unregister(c)
@@ -144,10 +205,12 @@ func (c *Client) readPump() {
 			log.Infof("client[%s] exit readPump, ReadMessage error: %v", c.Cid, err)
 			return
 		}
-		log.Infof("client[%s] ReadMessage msgType: %v", msgType)
+		log.Infof("client[%s] ReadMessage msgType: %v", c.Cid, msgType)
 		if msgType == websocket.TextMessage {
 			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 			c.hub.handleClientMessage(c, msgType, message)
+		} else if msgType == websocket.BinaryMessage {
+			c.hub.handleClientMessage(c, msgType, message)
 		}
 	}
 }
@@ -169,7 +232,7 @@ func (c *Client) writePump() {
 			return //already closed
 		}
 		select {
-		case message, ok := <-c.sendChan:
+		case frame, ok := <-c.sendChan:
 
 			if !ok {
 				log.Infof("client[%s] exit writePump, c.sendChan was closed\n", c.Cid)
@@ -178,12 +241,14 @@ func (c *Client) writePump() {
 
 			c.sendMu.Lock()
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.conn.WriteMessage(websocket.TextMessage, message)
+			c.conn.EnableWriteCompression(c.shouldCompress(frame.size))
+			err := c.conn.WritePreparedMessage(frame.pm)
 			c.sendMu.Unlock()
 			if err != nil {
 				log.Infof("client[%s] exit writePump, WriteMessage error = %v\n", c.Cid, err)
 				return
 			}
+			c.written(frame)
 
 		case _, ok := <-c.sendPongChan:
 			if !ok {
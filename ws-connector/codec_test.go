@@ -0,0 +1,445 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+func testList(n int) []interface{} {
+	list := make([]interface{}, n)
+	for i := range list {
+		list[i] = int64(i % 200)
+	}
+	return list
+}
+
+func testMap(n int) map[string]interface{} {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		m["k"+strconv.Itoa(i)] = int64(i)
+	}
+	return m
+}
+
+//nested n arrays around v
+func testNested(n int, v interface{}) interface{} {
+	for i := 0; i < n; i++ {
+		v = []interface{}{v}
+	}
+	return v
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+		first byte //format byte chosen by encoder
+	}{
+		{"nil", nil, 0xc0},
+		{"false", false, 0xc2},
+		{"true", true, 0xc3},
+
+		{"positive fixint 0", int64(0), 0x00},
+		{"positive fixint 127", int64(127), 0x7f},
+		{"uint8 128", int64(128), 0xcc},
+		{"uint8 255", int64(255), 0xcc},
+		{"uint16 256", int64(256), 0xcd},
+		{"uint16 65535", int64(65535), 0xcd},
+		{"uint32 65536", int64(65536), 0xce},
+		{"uint32 max", int64(math.MaxUint32), 0xce},
+		{"uint64 max uint32 + 1", int64(math.MaxUint32) + 1, 0xcf},
+		{"uint64 max int64", int64(math.MaxInt64), 0xcf},
+		{"negative fixint -1", int64(-1), 0xff},
+		{"negative fixint -32", int64(-32), 0xe0},
+		{"int8 -33", int64(-33), 0xd0},
+		{"int8 -128", int64(-128), 0xd0},
+		{"int16 -129", int64(-129), 0xd1},
+		{"int16 -32768", int64(-32768), 0xd1},
+		{"int32 -32769", int64(-32769), 0xd2},
+		{"int32 min", int64(math.MinInt32), 0xd2},
+		{"int64 min int32 - 1", int64(math.MinInt32) - 1, 0xd3},
+		{"int64 min", int64(math.MinInt64), 0xd3},
+
+		{"float64", 0.5, 0xcb},
+		{"float64 negative", -1.25e300, 0xcb},
+		{"float64 smallest", math.SmallestNonzeroFloat64, 0xcb},
+		{"float64 inf", math.Inf(1), 0xcb},
+
+		{"fixstr empty", "", 0xa0},
+		{"fixstr 31", strings.Repeat("a", 31), 0xbf},
+		{"str8 32", strings.Repeat("a", 32), 0xd9},
+		{"str8 255", strings.Repeat("a", 255), 0xd9},
+		{"str16 256", strings.Repeat("a", 256), 0xda},
+		{"str16 65535", strings.Repeat("a", 65535), 0xda},
+		{"str32 65536", strings.Repeat("a", 65536), 0xdb},
+		{"str utf8", "你好, msgpack", 0xaf},
+
+		{"bin8 empty", []byte{}, 0xc4},
+		{"bin8 255", make([]byte, 255), 0xc4},
+		{"bin16 256", make([]byte, 256), 0xc5},
+		{"bin32 65536", make([]byte, 65536), 0xc6},
+
+		{"fixarray empty", []interface{}{}, 0x90},
+		{"fixarray 15", testList(15), 0x9f},
+		{"array16 16", testList(16), 0xdc},
+		{"array16 65535", testList(65535), 0xdc},
+		{"array32 65536", testList(65536), 0xdd},
+
+		{"fixmap empty", map[string]interface{}{}, 0x80},
+		{"fixmap 15", testMap(15), 0x8f},
+		{"map16 16", testMap(16), 0xde},
+		{"map16 65535", testMap(65535), 0xde},
+		{"map32 65536", testMap(65536), 0xdf},
+
+		{"nested", map[string]interface{}{
+			"mid":  "m1",
+			"msg":  map[string]interface{}{"a": "hello", "b": int64(123), "c": true, "d": nil, "e": []interface{}{1.5, "x", []interface{}{}}},
+			"list": []interface{}{map[string]interface{}{"k": int64(-1)}},
+		}, 0x83},
+		{"max depth", testNested(maxDecodeDepth, "deep"), 0x91},
+	}
+	for _, c := range cases {
+		data, err := msgpackEncode(nil, c.value)
+		if err != nil {
+			t.Errorf("%s: encode err %v", c.name, err)
+			continue
+		}
+		if data[0] != c.first {
+			t.Errorf("%s: format byte 0x%02x, want 0x%02x", c.name, data[0], c.first)
+		}
+		got, err := msgpackDecode(data)
+		if err != nil {
+			t.Errorf("%s: decode err %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.value) {
+			t.Errorf("%s: round trip got %v", c.name, got)
+		}
+	}
+}
+
+//TestMsgpackDecodeOtherFormats formats clients may send but the encoder never writes
+func TestMsgpackDecodeOtherFormats(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"float32", appendUint32([]byte{0xca}, math.Float32bits(1.5)), 1.5},
+		{"float32 negative", appendUint32([]byte{0xca}, math.Float32bits(-0.25)), -0.25},
+		{"uint8 small", []byte{0xcc, 0x05}, int64(5)},
+		{"int64 small", appendUint64([]byte{0xd3}, uint64(1)), int64(1)},
+		{"uint64 above max int64", appendUint64([]byte{0xcf}, math.MaxUint64), float64(math.MaxUint64)},
+		{"str8 short string", []byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{"array16 one item", []byte{0xdc, 0x00, 0x01, 0xc3}, []interface{}{true}},
+		{"map32 one item", []byte{0xdf, 0x00, 0x00, 0x00, 0x01, 0xa1, 'k', 0x01}, map[string]interface{}{"k": int64(1)}},
+	}
+	for _, c := range cases {
+		got, err := msgpackDecode(c.data)
+		if err != nil {
+			t.Errorf("%s: decode err %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMsgpackDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"never used byte", []byte{0xc1}},
+		{"ext type", []byte{0xd4, 0x01, 0x02}},
+		{"extra data", []byte{0xc0, 0xc0}},
+		{"map int key", []byte{0x81, 0x01, 0x02}},
+		{"map nil key", []byte{0x81, 0xc0, 0x02}},
+		{"fixstr short", []byte{0xa5, 'a', 'b'}},
+		{"str8 short", []byte{0xd9, 0x10, 'a'}},
+		{"str16 no length", []byte{0xda, 0x01}},
+		{"str32 huge length", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"bin32 huge length", []byte{0xc6, 0xff, 0xff, 0xff, 0xff}},
+		{"array32 huge count", []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}},
+		{"map32 huge count", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'k', 0xc0}},
+		{"fixarray missing item", []byte{0x92, 0xc0}},
+		{"float64 short", []byte{0xcb, 0x00, 0x00}},
+		{"float32 short", []byte{0xca, 0x00}},
+		{"int16 short", []byte{0xd1, 0x00}},
+		{"uint64 short", []byte{0xcf, 0x00, 0x00, 0x00}},
+	}
+	for _, c := range cases {
+		if v, err := msgpackDecode(c.data); err == nil {
+			t.Errorf("%s: decoded %v, want error", c.name, v)
+		}
+	}
+}
+
+func TestMsgpackDecodeTooDeep(t *testing.T) {
+	data, err := msgpackEncode(nil, testNested(maxDecodeDepth+1, "deep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgpackDecode(data); err == nil {
+		t.Fatal("nesting deeper than maxDecodeDepth accepted")
+	}
+
+	//maps count too, no stack growth for a long run of nested fixmap headers
+	deep := make([]byte, 0, 200000)
+	for i := 0; i < 100000; i++ {
+		deep = append(deep, 0x81, 0xa1, 'k')
+	}
+	deep = append(deep, 0xc0)
+	if _, err := msgpackDecode(deep); err == nil {
+		t.Fatal("100000 nested maps accepted")
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+		want  interface{} //nil use value
+	}{
+		{"nil", nil, nil},
+		{"false", false, nil},
+		{"true", true, nil},
+		{"float64", 0.5, nil},
+		{"float64 negative", -1.25e300, nil},
+		{"float64 inf", math.Inf(-1), nil},
+		{"int64 as number", int64(-123), float64(-123)},
+		{"int64 2^53", int64(1 << 53), float64(1 << 53)},
+		{"string empty", "", nil},
+		{"string 127, 1 byte length", strings.Repeat("a", 127), nil},
+		{"string 128, 2 bytes length", strings.Repeat("a", 128), nil},
+		{"string 16384, 3 bytes length", strings.Repeat("a", 16384), nil},
+		{"string utf8", "你好, protobuf", nil},
+		{"list empty", []interface{}{}, nil},
+		{"list", []interface{}{"a", true, nil, 1.5}, nil},
+		{"list 1000", testList(1000), nil},
+		{"struct empty", map[string]interface{}{}, nil},
+		{"struct", map[string]interface{}{"a": "hello", "b": 2.5, "c": true, "d": nil}, nil},
+		{"struct empty key", map[string]interface{}{"": "x"}, nil},
+		{"struct 1000", testMap(1000), nil},
+		{"nested", map[string]interface{}{
+			"mid": "m1",
+			"msg": map[string]interface{}{"e": []interface{}{1.5, "x", []interface{}{}, map[string]interface{}{"k": false}}},
+		}, nil},
+		{"max depth", testNested(maxDecodeDepth, "deep"), nil},
+	}
+	for _, c := range cases {
+		want := c.want
+		if want == nil {
+			want = c.value
+		}
+		if isIntValue(want) {
+			want = toFloatValue(want)
+		}
+		data, err := protobufEncode(nil, c.value)
+		if err != nil {
+			t.Errorf("%s: encode err %v", c.name, err)
+			continue
+		}
+		got, err := protobufDecode(data)
+		if err != nil {
+			t.Errorf("%s: decode err %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: round trip got %v", c.name, got)
+		}
+	}
+}
+
+//isIntValue value has int64 inside, protobuf numbers are all double
+func isIntValue(v interface{}) bool {
+	switch val := v.(type) {
+	case int64:
+		return true
+	case []interface{}:
+		for _, item := range val {
+			if isIntValue(item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			if isIntValue(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func toFloatValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int64:
+		return float64(val)
+	case []interface{}:
+		ret := make([]interface{}, len(val))
+		for i, item := range val {
+			ret[i] = toFloatValue(item)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			ret[key] = toFloatValue(item)
+		}
+		return ret
+	}
+	return v
+}
+
+func TestProtobufDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"tag only", []byte{0x08}},
+		{"varint never ends", []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"varint short", []byte{0x08, 0x80}},
+		{"fixed64 short", []byte{0x11, 0x00, 0x00, 0x00}},
+		{"fixed32 short", []byte{0x15, 0x00}},
+		{"bytes length beyond data", []byte{0x1a, 0x05, 'a', 'b'}},
+		{"bytes huge length", []byte{0x1a, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"group wire type", []byte{0x0b}},
+		{"end group wire type", []byte{0x0c}},
+		{"wire type 6", []byte{0x0e}},
+		{"bad struct entry", []byte{0x2a, 0x02, 0x0a, 0x05}},
+		{"bad list item", []byte{0x32, 0x03, 0x0a, 0x01, 0x08}},
+	}
+	for _, c := range cases {
+		if v, err := protobufDecode(c.data); err == nil {
+			t.Errorf("%s: decoded %v, want error", c.name, v)
+		}
+	}
+}
+
+func TestProtobufDecodeTooDeep(t *testing.T) {
+	data, err := protobufEncode(nil, testNested(maxDecodeDepth+1, "deep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protobufDecode(data); err == nil {
+		t.Fatal("list nesting deeper than maxDecodeDepth accepted")
+	}
+
+	var deepStruct interface{} = "deep"
+	for i := 0; i < maxDecodeDepth+1; i++ {
+		deepStruct = map[string]interface{}{"k": deepStruct}
+	}
+	data, err = protobufEncode(nil, deepStruct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protobufDecode(data); err == nil {
+		t.Fatal("struct nesting deeper than maxDecodeDepth accepted")
+	}
+}
+
+//mustNotPanic call decode, fail with the input if it panics
+func mustNotPanic(t *testing.T, name string, decode func([]byte) (interface{}, error), data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s panic on % x: %v", name, data, r)
+		}
+	}()
+	_, err = decode(data)
+	return err
+}
+
+func codecSamples() []interface{} {
+	return []interface{}{
+		nil, true, int64(-40), int64(300), int64(math.MinInt64), 1.5, "hi", strings.Repeat("s", 40), strings.Repeat("s", 300),
+		testList(20),
+		testMap(17),
+		map[string]interface{}{"type": "ack", "mid": "m1", "data": map[string]interface{}{"list": []interface{}{int64(1), "two", 3.5, nil, false}}},
+		testNested(10, map[string]interface{}{"k": []interface{}{"v"}}),
+	}
+}
+
+//TestCodecTruncated every strict prefix of a valid frame is an error, not a panic
+func TestCodecTruncated(t *testing.T) {
+	for _, sample := range codecSamples() {
+		msgpackData, err := msgpackEncode(nil, sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(msgpackData); n++ {
+			if mustNotPanic(t, "msgpack", msgpackDecode, msgpackData[:n]) == nil {
+				t.Fatalf("msgpack prefix %d of % x decoded", n, msgpackData)
+			}
+		}
+		protobufData, err := protobufEncode(nil, sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 1; n < len(protobufData); n++ {
+			if mustNotPanic(t, "protobuf", protobufDecode, protobufData[:n]) == nil {
+				t.Fatalf("protobuf prefix %d of % x decoded", n, protobufData)
+			}
+		}
+	}
+}
+
+//TestCodecRandomInput mutated and random frames never panic
+func TestCodecRandomInput(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	samples := make([][]byte, 0)
+	for _, sample := range codecSamples() {
+		data, _ := msgpackEncode(nil, sample)
+		samples = append(samples, data)
+		data, _ = protobufEncode(nil, sample)
+		samples = append(samples, data)
+	}
+	for i := 0; i < 20000; i++ {
+		var data []byte
+		if i%4 == 0 {
+			data = make([]byte, r.Intn(64))
+			r.Read(data)
+		} else {
+			data = append([]byte(nil), samples[r.Intn(len(samples))]...)
+			for j := 0; j < 1+r.Intn(4) && len(data) > 0; j++ {
+				pos := r.Intn(len(data))
+				switch r.Intn(3) {
+				case 0:
+					data[pos] = byte(r.Intn(256))
+				case 1:
+					data = append(data[:pos], data[pos+1:]...)
+				case 2:
+					data = append(data[:pos], append([]byte{byte(r.Intn(256))}, data[pos:]...)...)
+				}
+			}
+		}
+		mustNotPanic(t, "msgpack", msgpackDecode, data)
+		mustNotPanic(t, "protobuf", protobufDecode, data)
+	}
+}
+
+//TestDecodeFrame binary frames decode to the same struct as json
+func TestDecodeFrame(t *testing.T) {
+	for _, encoding := range []string{encodingJSON, encodingMsgpack, encodingProtobuf} {
+		data, err := encodeFrame(encoding, &define.FrameStruct{V: 1, Type: "ack", ID: "m1", Payload: map[string]interface{}{"n": int64(3)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := &define.FrameStruct{}
+		if err := decodeFrame(encoding, data, frame); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		payload, ok := frame.Payload.(map[string]interface{})
+		if frame.V != 1 || frame.Type != "ack" || frame.ID != "m1" || !ok || payload["n"] == nil {
+			t.Fatalf("%s: decoded %+v", encoding, frame)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"compress/flate"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var gBytesSent uint64
+var gBytesBeforeCompress uint64
+var gBytesAfterCompress uint64
+
+var gDeflaterPool = sync.Pool{}
+
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+//deflatedSize size of data after permessage-deflate with gCompressLevel,
+//every message is compressed alone (no context takeover) so this equal what is sent
+func deflatedSize(data []byte) int {
+	counter := &countWriter{}
+	fw, ok := gDeflaterPool.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(counter)
+	} else {
+		var err error
+		fw, err = flate.NewWriter(counter, gCompressLevel)
+		if err != nil {
+			return len(data)
+		}
+	}
+	fw.Write(data)
+	fw.Flush()
+	gDeflaterPool.Put(fw)
+	//permessage-deflate strip the 0x00 0x00 0xff 0xff tail of sync flush
+	return counter.n - 4
+}
+
+//clientCompress check server flag, platform and client offered permessage-deflate
+func clientCompress(r *http.Request, platform string) bool {
+	if gCompress < 1 {
+		return false
+	}
+	for _, disabled := range gCompressDisablePlatforms {
+		if strings.EqualFold(disabled, platform) {
+			return false
+		}
+	}
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(header, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+//shouldCompress only compress big frames, small ones cost more cpu than they save
+func (c *Client) shouldCompress(size int) bool {
+	return c.compress && size >= gCompressThreshold
+}
+
+//countSent add frame to bytes metrics, compressed size is only computed when frame will be compressed
+func (c *Client) countSent(frame *outFrame) {
+	atomic.AddUint64(&gBytesSent, uint64(frame.size))
+	if c.shouldCompress(frame.size) {
+		atomic.AddUint64(&gBytesBeforeCompress, uint64(frame.size))
+		atomic.AddUint64(&gBytesAfterCompress, uint64(frame.deflatedSize()))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+//readCounter count bytes read from the client side of the connection
+type readCounter struct {
+	net.Conn
+	n int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+//wireFrameSize size of one compressed server frame read by a client, level set the way serveWs does
+func wireFrameSize(t *testing.T, data []byte) int {
+	//one frame for the whole message, no fragment headers
+	testUpgrader := websocket.Upgrader{EnableCompression: true, WriteBufferSize: 65536}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := testUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := conn.SetCompressionLevel(gCompressLevel); err != nil {
+			t.Error(err)
+			return
+		}
+		//wait for the client to be ready, so the frame is not read together with the handshake
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		conn.EnableWriteCompression(true)
+		conn.WriteMessage(websocket.TextMessage, data)
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	var counter *readCounter
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			counter = &readCounter{Conn: conn}
+			return counter, nil
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := atomic.LoadInt64(&counter.n)
+	conn.WriteMessage(websocket.TextMessage, []byte("ready"))
+	_, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("frame payload changed")
+	}
+	return int(atomic.LoadInt64(&counter.n) - before)
+}
+
+//TestDeflatedSizeMatchesWire bytesAfterCompress metric equal the payload the client receives, for every level
+func TestDeflatedSizeMatchesWire(t *testing.T) {
+	parts := make([]string, 0, 500)
+	for i := 0; i < 500; i++ {
+		parts = append(parts, `{"mid":"m`+strconv.Itoa(i*7919%1000)+`","seq":`+strconv.Itoa(i*i%997)+`}`)
+	}
+	data := []byte(strings.Join(parts, ","))
+
+	defer func(level int) {
+		gCompressLevel = level
+		gDeflaterPool = sync.Pool{}
+	}(gCompressLevel)
+	sizes := make(map[int]bool)
+	for _, level := range []int{-2, 1, 5, 9} {
+		gCompressLevel = level
+		gDeflaterPool = sync.Pool{}
+		want := deflatedSize(data)
+		sizes[want] = true
+		//server frames are not masked, 4 bytes header for 126 ~ 65535 bytes payload
+		if want < 126 || want > 65535 {
+			t.Fatalf("level %d: deflated size %d out of test range", level, want)
+		}
+		if got := wireFrameSize(t, data) - 4; got != want {
+			t.Errorf("level %d: %d bytes on wire, deflatedSize %d", level, got, want)
+		}
+	}
+	if len(sizes) < 2 {
+		t.Fatal("all levels give the same size, test data does not check the level")
+	}
+}
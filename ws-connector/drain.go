@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/xlab/closer"
+)
+
+//drainGrace time between the reconnect delay told to client and the server closing it,
+//so a well behaved client is already connected elsewhere when it is closed
+const drainGrace = time.Second * 5
+
+//drainFlushWait max wait for a client send queue to be written before closing it
+const drainFlushWait = time.Second * 1
+
+var gDraining int32
+var gRejectDraining uint64
+var gDrainDone = make(chan int)
+
+//gSigTerm set when exit by SIGTERM, only SIGTERM drain before exit
+var gSigTerm int32
+
+//bindExitSignals closer handle SIGINT, SIGHUP and SIGABRT as before, SIGTERM drain then close
+func bindExitSignals() {
+	closer.Init(closer.Config{
+		ExitCodeErr: 1,
+		ExitSignals: []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGABRT},
+	})
+	sigTerm := make(chan os.Signal, 1)
+	signal.Notify(sigTerm, syscall.SIGTERM)
+	go func() {
+		<-sigTerm
+		atomic.StoreInt32(&gSigTerm, 1)
+		closer.Close()
+	}()
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&gDraining) > 0
+}
+
+type drainClient struct {
+	c        *Client
+	deadline time.Time
+}
+
+//drain stop accepting upgrades, ask every client to reconnect elsewhere after a random delay
+//in window, then close clients gradually. gDrainDone is closed when all clients are closed
+func (h *Hub) drain(window time.Duration) *define.DrainResultStruct {
+	ret := &define.DrainResultStruct{
+		NodeID:        gNodeID,
+		WindowSeconds: int(window / time.Second),
+	}
+	if !atomic.CompareAndSwapInt32(&gDraining, 0, 1) {
+		ret.AlreadyDraining = true
+		return ret
+	}
+	log.Warnf("Hub drain start, window = %v\n", window)
+
+	start := time.Now()
+	told := make(map[*Client]bool)
+	clients := h.tellReconnect(told, start, window)
+	ret.Clients = len(clients)
+
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 100)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			now := time.Now()
+			for len(clients) > 0 && !clients[0].deadline.After(now) {
+				go clients[0].c.drainClose()
+				clients = clients[1:]
+			}
+			if len(clients) > 0 {
+				continue
+			}
+			//wait last clients flush and close, then check clients registered
+			//after drain start (upgrade already past the isDraining check)
+			time.Sleep(drainFlushWait)
+			clients = h.tellReconnect(told, start, window)
+			if len(clients) == 0 {
+				break
+			}
+			log.Warnf("Hub drain found %d late clients\n", len(clients))
+		}
+		log.Warnf("Hub drain end, cost = %v\n", time.Since(start))
+		close(gDrainDone)
+	}()
+	return ret
+}
+
+//tellReconnect send reconnect to every client not in told, and return them sorted by close deadline.
+//late clients get a delay in what is left of window
+func (h *Hub) tellReconnect(told map[*Client]bool, start time.Time, window time.Duration) []*drainClient {
+	now := time.Now()
+	left := window - now.Sub(start)
+	clients := make([]*drainClient, 0)
+	h.clients.Range(func(key, value interface{}) bool {
+		clientObj, ok := value.(*Client)
+		if !ok || told[clientObj] {
+			return true
+		}
+		told[clientObj] = true
+		if atomic.LoadInt32(&clientObj.closed) > 0 {
+			return true
+		}
+		var delay time.Duration
+		if left > 0 {
+			delay = time.Duration(rand.Int63n(int64(left)))
+		}
+		clientObj.send(&define.FrameStruct{
+			V:    define.FrameVersion,
+			Type: define.FrameTypeReconnect,
+			Payload: &define.ReconnectStruct{
+				DelayMs: int64(delay / time.Millisecond),
+				Reason:  define.OfflineReasonDrain,
+			},
+		})
+		clients = append(clients, &drainClient{
+			c:        clientObj,
+			deadline: now.Add(delay + drainGrace),
+		})
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].deadline.Before(clients[j].deadline)
+	})
+	return clients
+}
+
+//drainClose write queued frames (in-flight pushes) then close with reason drain
+func (c *Client) drainClose() {
+	if atomic.LoadInt32(&c.closed) > 0 {
+		return //already closed, maybe reconnected elsewhere
+	}
+	c.setOfflineReason(define.OfflineReasonDrain)
+	deadline := time.Now().Add(drainFlushWait)
+	for len(c.sendChan) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.close()
+}
+
+//waitDrain drain the node and wait it finish, used on SIGTERM
+func waitDrain() {
+	if atomic.LoadInt32(&gSigTerm) == 0 {
+		return //SIGINT and others exit at once
+	}
+	if gHub == nil {
+		return
+	}
+	gHub.drain(time.Second * time.Duration(gDrainSeconds))
+	<-gDrainDone
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func isReconnectFrame(frame *outFrame) bool {
+	return strings.Contains(string(frame.data), `"type":"reconnect"`)
+}
+
+//TestTellReconnect every client is told once, clients registered after drain start are told on re-scan
+func TestTellReconnect(t *testing.T) {
+	h, clients, _ := newBenchHub(3, encodingJSON)
+	window := time.Second * 10
+	start := time.Now()
+	told := make(map[*Client]bool)
+
+	first := h.tellReconnect(told, start, window)
+	if len(first) != 3 {
+		t.Fatalf("told %d clients, want 3", len(first))
+	}
+	for i := 1; i < len(first); i++ {
+		if first[i].deadline.Before(first[i-1].deadline) {
+			t.Fatal("clients not sorted by deadline")
+		}
+	}
+	for _, dc := range first {
+		if dc.deadline.After(start.Add(window + drainGrace)) {
+			t.Fatalf("deadline %v after window", dc.deadline.Sub(start))
+		}
+	}
+	for _, c := range clients {
+		if frame := <-c.sendChan; !isReconnectFrame(frame) {
+			t.Fatalf("client %s got %s, want reconnect", c.Cid, frame.data)
+		}
+	}
+
+	//late client, window already passed: told with no delay
+	late, _, _ := newBenchHub(1, encodingJSON)
+	late.clients.Range(func(key, value interface{}) bool {
+		value.(*Client).hub = h
+		h.clients.Store("late", value)
+		return true
+	})
+	again := h.tellReconnect(told, start.Add(-window*2), window)
+	if len(again) != 1 {
+		t.Fatalf("re-scan told %d clients, want only the late one", len(again))
+	}
+	if again[0].deadline.After(time.Now().Add(drainGrace)) {
+		t.Fatal("late client after window got a delay")
+	}
+	if frame := <-again[0].c.sendChan; !isReconnectFrame(frame) {
+		t.Fatalf("late client got %s, want reconnect", frame.data)
+	}
+	for _, c := range clients {
+		if len(c.sendChan) > 0 {
+			t.Fatalf("client %s told twice", c.Cid)
+		}
+	}
+
+	if len(h.tellReconnect(told, start, window)) != 0 {
+		t.Fatal("nothing left to tell")
+	}
+}
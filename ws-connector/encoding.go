@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
+)
+
+const (
+	encodingJSON     = "json"
+	encodingMsgpack  = "msgpack"
+	encodingProtobuf = "protobuf"
+)
+
+func init() {
+	//server preference when client offer several in Sec-WebSocket-Protocol
+	upgrader.Subprotocols = []string{encodingMsgpack, encodingProtobuf, encodingJSON}
+}
+
+func isValidEncoding(encoding string) bool {
+	return encoding == encodingJSON || encoding == encodingMsgpack || encoding == encodingProtobuf
+}
+
+//negotiateEncoding query param "encoding" first, then Sec-WebSocket-Protocol, default json
+func negotiateEncoding(r *http.Request) (string, error) {
+	encoding := strings.ToLower(r.URL.Query().Get("encoding"))
+	if len(encoding) > 0 {
+		if !isValidEncoding(encoding) {
+			return "", errors.New("unsupported encoding: " + encoding)
+		}
+		return encoding, nil
+	}
+	for _, protocol := range upgrader.Subprotocols {
+		for _, offer := range websocketProtocols(r) {
+			if offer == protocol {
+				return protocol, nil
+			}
+		}
+	}
+	return encodingJSON, nil
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var ret []string
+	for _, header := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+				ret = append(ret, strings.ToLower(protocol))
+			}
+		}
+	}
+	return ret
+}
+
+//toGeneric convert struct to json like value (map[string]interface{}, []interface{}, int64, float64 ...)
+func toGeneric(v interface{}) (interface{}, error) {
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var ret interface{}
+	err = decoder.Decode(&ret)
+	if err != nil {
+		return nil, err
+	}
+	return convertNumbers(ret), nil
+}
+
+func convertNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = convertNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = convertNumbers(item)
+		}
+	}
+	return v
+}
+
+//encodeFrame encode v for client encoding, []byte and string are sent as is
+func encodeFrame(encoding string, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case []byte:
+		return val, nil
+	case string:
+		return []byte(val), nil
+	}
+	if encoding == encodingJSON || len(encoding) < 1 {
+		return jsoniter.Marshal(v)
+	}
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == encodingMsgpack {
+		return msgpackEncode(nil, generic)
+	}
+	return protobufEncode(nil, generic)
+}
+
+//decodeFrame decode binary frame of client encoding to out struct
+func decodeFrame(encoding string, data []byte, out interface{}) error {
+	var generic interface{}
+	var err error
+	switch encoding {
+	case encodingMsgpack:
+		generic, err = msgpackDecode(data)
+	case encodingProtobuf:
+		generic, err = protobufDecode(data)
+	default:
+		return jsoniter.Unmarshal(data, out)
+	}
+	if err != nil {
+		return err
+	}
+	return define.Decode(generic, out)
+}
+
+//outFrame one encoded frame ready for writePump, websocket.PreparedMessage build the
+//wire bytes (and compressed bytes) once, then every client write the same cached bytes
+type outFrame struct {
+	pm   *websocket.PreparedMessage
+	size int
+
+	pushTime time.Time //push or publish received, zero for other frames
+	mid      string
+
+	deflateOnce sync.Once
+	data        []byte
+	deflated    int
+}
+
+func frameTypeOf(encoding string) int {
+	if encoding == encodingJSON || len(encoding) < 1 {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+func newOutFrame(encoding string, data []byte) (*outFrame, error) {
+	pm, err := websocket.NewPreparedMessage(frameTypeOf(encoding), data)
+	if err != nil {
+		return nil, err
+	}
+	return &outFrame{
+		pm:   pm,
+		size: len(data),
+		data: data,
+	}, nil
+}
+
+//deflatedSize compressed size for metrics, computed once however many clients share the frame
+func (f *outFrame) deflatedSize() int {
+	f.deflateOnce.Do(func() {
+		f.deflated = deflatedSize(f.data)
+	})
+	return f.deflated
+}
+
+//preparedMsg encode one push msg once per encoding, the frame is shared by all recipients
+type preparedMsg struct {
+	msg      interface{}
+	pushTime time.Time
+	frames   map[string]*outFrame
+}
+
+func newPreparedMsg(msg interface{}, pushTime time.Time) *preparedMsg {
+	return &preparedMsg{
+		msg:      msg,
+		pushTime: pushTime,
+		frames:   make(map[string]*outFrame, 3),
+	}
+}
+
+func (p *preparedMsg) frame(encoding string) (*outFrame, error) {
+	if frame, ok := p.frames[encoding]; ok {
+		return frame, nil
+	}
+	data, err := encodeFrame(encoding, p.msg)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := newOutFrame(encoding, data)
+	if err != nil {
+		return nil, err
+	}
+	frame.pushTime = p.pushTime
+	if data, ok := p.msg.(*define.PushMsgDataStruct); ok && data != nil {
+		frame.mid = data.Mid
+	}
+	p.frames[encoding] = frame
+	return frame, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const benchRecipients = 10000
+
+//newBenchHub hub with n connected clients (no websocket conn), every client use encoding
+func newBenchHub(n int, encoding string) (*Hub, []*Client, []string) {
+	log.SetLevel(logrus.WarnLevel)
+	h := &Hub{
+		clients:     &sync.Map{},
+		userID2Cids: &sync.Map{},
+		topics:      &sync.Map{},
+		cidTopics:   &sync.Map{},
+		offlineCids: &sync.Map{},
+	}
+	clients := make([]*Client, 0, n)
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		c := &Client{
+			Cid:      "user" + strconv.Itoa(i) + "_web_bench",
+			UserID:   "user" + strconv.Itoa(i),
+			Platform: "web",
+			Version:  "1.0.0",
+			hub:      h,
+			encoding: encoding,
+			sendChan: make(chan *outFrame, 1),
+		}
+		h.clients.Store(c.Cid, c)
+		clients = append(clients, c)
+		ids = append(ids, c.Cid)
+	}
+	return h, clients, ids
+}
+
+func benchPushMsg() *define.PushMsgDataStruct {
+	return &define.PushMsgDataStruct{
+		Mid: "bench-mid",
+		Msg: map[string]interface{}{
+			"title":   "daily report",
+			"content": "you have 12 new messages and 3 new friend requests, open the app to read them",
+			"badge":   15,
+			"extra":   map[string]interface{}{"from": "system", "tags": []string{"report", "daily"}},
+		},
+	}
+}
+
+func drain(clients []*Client) {
+	for _, c := range clients {
+		<-c.sendChan
+	}
+}
+
+//benchmarkEncodeEach is the old fan-out, every recipient encode and frame the msg itself
+func benchmarkEncodeEach(b *testing.B, encoding string) {
+	_, clients, _ := newBenchHub(benchRecipients, encoding)
+	msg := benchPushMsg()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range clients {
+			c.send(msg)
+		}
+		drain(clients)
+	}
+}
+
+//benchmarkPrepared is outMsgHandler, msg is encoded once and the frame is shared
+func benchmarkPrepared(b *testing.B, encoding string) {
+	h, clients, ids := newBenchHub(benchRecipients, encoding)
+	msg := benchPushMsg()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		outMsgHandler(&outMsg{h: h, ids: ids, msg: msg})
+		drain(clients)
+	}
+}
+
+func BenchmarkFanOut10kJSONEncodeEach(b *testing.B) {
+	benchmarkEncodeEach(b, encodingJSON)
+}
+
+func BenchmarkFanOut10kJSONPrepared(b *testing.B) {
+	benchmarkPrepared(b, encodingJSON)
+}
+
+func BenchmarkFanOut10kMsgpackEncodeEach(b *testing.B) {
+	benchmarkEncodeEach(b, encodingMsgpack)
+}
+
+func BenchmarkFanOut10kMsgpackPrepared(b *testing.B) {
+	benchmarkPrepared(b, encodingMsgpack)
+}
+
+//TestSendBatchOrder msgs of one push batch reach every client in order, even with many pool workers
+func TestSendBatchOrder(t *testing.T) {
+	h, clients, ids := newBenchHub(3, encodingJSON)
+	for _, c := range clients {
+		c.sendChan = make(chan *outFrame, 1000)
+	}
+	h.outMsgHandlerPool = NewRunGoPool("test.outMsgHandlerPool", 1000000000, time.Second, outMsgHandler)
+	h.outMsgHandlerPool.SetWorkers(16)
+	h.outMsgHandlerPool.Start()
+	defer h.outMsgHandlerPool.Stop()
+
+	const batches, batchLen = 20, 10
+	for b := 0; b < batches; b++ {
+		msgs := make([]*define.PushMsgStruct, 0, batchLen)
+		for i := 0; i < batchLen; i++ {
+			msgs = append(msgs, &define.PushMsgStruct{
+				IDs:  ids,
+				Data: &define.PushMsgDataStruct{Mid: strconv.Itoa(b) + "-" + strconv.Itoa(i)},
+			})
+		}
+		if err := h.sendBatch(msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range clients {
+		next := make(map[string]int)
+		for n := 0; n < batches*batchLen; n++ {
+			select {
+			case frame := <-c.sendChan:
+				parts := strings.SplitN(frame.mid, "-", 2)
+				if i, _ := strconv.Atoi(parts[1]); i != next[parts[0]] {
+					t.Fatalf("client %s got %s, want %s-%d", c.Cid, frame.mid, parts[0], next[parts[0]])
+				}
+				next[parts[0]]++
+			case <-time.After(time.Second * 2):
+				t.Fatalf("client %s got %d of %d msgs", c.Cid, n, batches*batchLen)
+			}
+		}
+	}
+}
+
+func TestSendBatchBadIDs(t *testing.T) {
+	h, _, _ := newBenchHub(1, encodingJSON)
+	err := h.sendBatch([]*define.PushMsgStruct{{IDs: 123, Data: &define.PushMsgDataStruct{Mid: "m"}}})
+	if err == nil {
+		t.Fatal("bad ids in batch accepted")
+	}
+}
+
+func TestSendBatchBadTarget(t *testing.T) {
+	h, _, _ := newBenchHub(1, encodingJSON)
+	err := h.sendBatch([]*define.PushMsgStruct{
+		{IDs: "u1", Data: &define.PushMsgDataStruct{Mid: "m1"}, Target: &define.TargetStruct{Versions: "< 2.3"}},
+		{IDs: "u1", Data: &define.PushMsgDataStruct{Mid: "m2"}, Target: &define.TargetStruct{Versions: ">= 2.0 <"}},
+	})
+	if err == nil {
+		t.Fatal("bad target in batch accepted")
+	}
+}
+
+//TestPushNullData push with data null is rejected before it reach the pool
+func TestPushNullData(t *testing.T) {
+	h, _, _ := newBenchHub(1, encodingJSON)
+	oldHub := gHub
+	gHub = h //no outMsgHandlerPool, queuing the push would panic
+	defer func() { gHub = oldHub }()
+
+	params := map[string]interface{}{"ids": "user0", "data": nil}
+	if _, err := actionPush(&protocol.MsRequest{Params: params}); err == nil {
+		t.Fatal("push with null data accepted")
+	}
+	eventInPush(&protocol.MsEvent{Data: params})
+
+	//null data already in the pool is not expired, encoded as before
+	_, clients, ids := newBenchHub(1, encodingJSON)
+	outMsgHandler(&outMsg{h: clients[0].hub, ids: ids, msg: (*define.PushMsgDataStruct)(nil)})
+	if frame := <-clients[0].sendChan; string(frame.data) != "null" {
+		t.Fatalf("null data sent %s", frame.data)
+	}
+}
+
+//TestOutMsgExpiredTopic expired publish is counted once per subscriber
+func TestOutMsgExpiredTopic(t *testing.T) {
+	h, clients, _ := newBenchHub(3, encodingJSON)
+	gMaxTopics = 10
+	for _, c := range clients {
+		h.subscribe(c, []string{"news"})
+	}
+	dropped := atomic.LoadUint64(&gDropExpired)
+	msg := &define.PushMsgDataStruct{Mid: "m1", ExpireAt: define.Timestamp(time.Now().Add(-time.Second))}
+	outMsgHandler(&outMsg{h: h, topic: "news", msg: msg})
+	if got := atomic.LoadUint64(&gDropExpired) - dropped; got != 3 {
+		t.Fatalf("expired publish counted %d drops, want 3", got)
+	}
+	for _, c := range clients {
+		if len(c.sendChan) > 0 {
+			t.Fatalf("client %s got expired publish", c.Cid)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync/atomic"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
+)
+
+var gTotalUpstream uint64
+var gTotalBadFrame uint64
+
+//handleClientFrame handle one frame from client.
+//frames without type are the old {"aid":...} / {"sub":[...]} format, still supported for json.
+//binary frames are decoded by client's negotiated encoding
+func handleClientFrame(h *Hub, c *Client, msg []byte, binary bool) {
+	frame := &define.FrameStruct{}
+	if binary {
+		if c.encoding == encodingJSON {
+			sendErrorFrame(c, "", define.FrameErrorBadFrame, "binary frame need msgpack or protobuf encoding")
+			return
+		}
+		err := decodeFrame(c.encoding, msg, frame)
+		if err != nil {
+			sendErrorFrame(c, "", define.FrameErrorBadFrame, "can't decode "+c.encoding+" frame")
+			return
+		}
+	} else {
+		err := jsoniter.Unmarshal(msg, frame)
+		if err != nil {
+			sendErrorFrame(c, "", define.FrameErrorBadFrame, "frame is not json object")
+			return
+		}
+	}
+	if frame.V > define.FrameVersion {
+		sendErrorFrame(c, frame.ID, define.FrameErrorBadVersion, "unsupported frame version")
+		return
+	}
+
+	switch frame.Type {
+	case "":
+		if binary {
+			sendErrorFrame(c, frame.ID, define.FrameErrorUnknownType, "frame type is empty")
+			return
+		}
+		handleLegacyFrame(h, c, msg)
+	case define.FrameTypeAck:
+		if len(frame.ID) < 1 {
+			sendErrorFrame(c, frame.ID, define.FrameErrorBadPayload, "ack id is empty")
+			return
+		}
+		broadcastAck(c, frame.ID)
+	case define.FrameTypePing:
+		c.send(&define.FrameStruct{
+			V:    define.FrameVersion,
+			Type: define.FrameTypePong,
+			ID:   frame.ID,
+		})
+	case define.FrameTypeSubscribe, define.FrameTypeUnsubscribe:
+		payload := &define.TopicsStruct{}
+		err := define.Decode(frame.Payload, payload)
+		if err != nil || len(payload.Topics) < 1 {
+			sendErrorFrame(c, frame.ID, define.FrameErrorBadPayload, "payload topics is empty")
+			return
+		}
+		if frame.Type == define.FrameTypeSubscribe {
+			h.subscribe(c, payload.Topics)
+		} else {
+			h.unsubscribe(c, payload.Topics)
+		}
+	case define.FrameTypeMessage:
+		if frame.Payload == nil {
+			sendErrorFrame(c, frame.ID, define.FrameErrorBadPayload, "payload is empty")
+			return
+		}
+		atomic.AddUint64(&gTotalUpstream, 1)
+		pBroker.Broadcast(define.WsConnectorOutMessage, &define.UpstreamMsgStruct{
+			ID:      frame.ID,
+			Payload: frame.Payload,
+			Client:  c.info(true),
+		})
+		//tell client the message is accepted
+		if len(frame.ID) > 0 {
+			c.send(&define.FrameStruct{
+				V:    define.FrameVersion,
+				Type: define.FrameTypeAck,
+				ID:   frame.ID,
+			})
+		}
+	default:
+		sendErrorFrame(c, frame.ID, define.FrameErrorUnknownType, "unknown frame type: "+frame.Type)
+	}
+}
+
+func handleLegacyFrame(h *Hub, c *Client, msg []byte) {
+	ackObj := &define.AckStruct{}
+	if jsoniter.Unmarshal(msg, ackObj) == nil && len(ackObj.Aid) > 0 {
+		broadcastAck(c, ackObj.Aid)
+		return
+	}
+	subObj := &define.SubscribeStruct{}
+	if jsoniter.Unmarshal(msg, subObj) == nil && (len(subObj.Sub) > 0 || len(subObj.Unsub) > 0) {
+		if len(subObj.Sub) > 0 {
+			h.subscribe(c, subObj.Sub)
+		}
+		if len(subObj.Unsub) > 0 {
+			h.unsubscribe(c, subObj.Unsub)
+		}
+		return
+	}
+	sendErrorFrame(c, "", define.FrameErrorUnknownType, "frame type is empty")
+}
+
+func broadcastAck(c *Client, aid string) {
+	atomic.AddUint64(&gTotalAck, 1)
+	c.acked(aid)
+	log.Info("handleClientFrame, handle ACK = ", aid)
+	pBroker.Broadcast(define.WsConnectorOutAck, &define.AckStruct{
+		Aid:    aid,
+		Cid:    c.Cid,
+		UserID: c.UserID,
+	})
+}
+
+func sendErrorFrame(c *Client, id string, code string, message string) {
+	atomic.AddUint64(&gTotalBadFrame, 1)
+	log.Infof("client[%s] bad frame, code[%s]: %s\n", c.Cid, code, message)
+	c.send(&define.FrameStruct{
+		V:    define.FrameVersion,
+		Type: define.FrameTypeError,
+		ID:   id,
+		Payload: &define.FrameErrorStruct{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+//gEpoch process start, ws-online expire clients of an older epoch when it changes
+var gEpoch = define.Timestamp(time.Now())
+
+var gHeartbeatStop = make(chan int, 1)
+
+func heartbeat() *define.HeartbeatStruct {
+	return &define.HeartbeatStruct{
+		NodeID:          gNodeID,
+		Epoch:           gEpoch,
+		Clients:         atomic.LoadInt64(&gCurrentClients),
+		Time:            define.Timestamp(time.Now()),
+		IntervalSeconds: gHeartbeatSeconds,
+	}
+}
+
+//startHeartbeat broadcast ws-connector.out.heartbeat every gHeartbeatSeconds until stopHeartbeat
+func startHeartbeat() {
+	if gHeartbeatSeconds < 1 {
+		return
+	}
+	go func() {
+		pBroker.Broadcast(define.WsConnectorOutHeartbeat, heartbeat())
+		ticker := time.NewTicker(time.Second * time.Duration(gHeartbeatSeconds))
+		for {
+			select {
+			case <-ticker.C:
+				pBroker.Broadcast(define.WsConnectorOutHeartbeat, heartbeat())
+			case <-gHeartbeatStop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func stopHeartbeat() {
+	if gHeartbeatSeconds < 1 {
+		return
+	}
+	gHeartbeatStop <- 1
+}
@@ -11,7 +11,8 @@ import (
 	"sync/atomic"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/gorilla/websocket"
+	"github.com/roytan883/micro-services/define"
 )
 
 // Hub maintains the set of active clients
@@ -20,6 +21,11 @@ type Hub struct {
 	clients     *sync.Map //~= sync.Map[string(Cid)]*Client
 	userID2Cids *sync.Map //~= sync.Map[string(UserID)]*sync.Map[string(Cid)]*Client
 
+	// Topic subscriptions, by Cid so reconnect with same Cid keep them.
+	topics      *sync.Map //~= sync.Map[string(topic)]*sync.Map[string(Cid)]struct{}
+	cidTopics   *sync.Map //~= sync.Map[string(Cid)]*sync.Map[string(topic)]struct{}
+	offlineCids *sync.Map //~= sync.Map[string(Cid)]time.Time, subscribed Cids waiting reconnect
+
 	// Register requests from the clients.
 	registerChan chan *Client
 
@@ -38,25 +44,51 @@ func newHub() *Hub {
 	hub := &Hub{
 		clients:        &sync.Map{},
 		userID2Cids:    &sync.Map{},
+		topics:         &sync.Map{},
+		cidTopics:      &sync.Map{},
+		offlineCids:    &sync.Map{},
 		hubClosed:      make(chan int, 10),
 		registerChan:   make(chan *Client, 2500),
 		unregisterChan: make(chan *Client, 2500),
 	}
 
-	rps := gRPS / 10
-	if rps < 1 {
-		rps = 1
-	}
-	log.Warn("config RPS = ", rps*10)
-
-	hub.inMsgHandlerPool = NewRunGoPool("hub.inMsgHandlerPool", rps, time.Millisecond*100, inMsgHandler)
+	hub.inMsgHandlerPool = NewRunGoPoolWithClasses("hub.inMsgHandlerPool", gRPS, time.Second, inMsgClasses, inMsgHandler)
+	hub.inMsgHandlerPool.SetWorkers(gPoolWorkers)
 	hub.inMsgHandlerPool.Start()
-	hub.outMsgHandlerPool = NewRunGoPool("hub.outMsgHandlerPool", rps, time.Millisecond*100, outMsgHandler)
+	hub.outMsgHandlerPool = NewRunGoPool("hub.outMsgHandlerPool", gRPS, time.Second, outMsgHandler)
+	hub.outMsgHandlerPool.SetWorkers(gPoolWorkers)
 	hub.outMsgHandlerPool.Start()
+	hub.setRateLimit(gRPS, gRateBurst)
 
 	return hub
 }
 
+//setRateLimit set RPS and burst of in and out pools, burst < 1 use rps / 10
+func (h *Hub) setRateLimit(rps int, burst int) *define.RateLimitStruct {
+	if rps < 1 {
+		rps = 1
+	}
+	if burst < 1 {
+		burst = rps / 10
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	h.inMsgHandlerPool.SetRate(rps, time.Second, burst)
+	h.outMsgHandlerPool.SetRate(rps, time.Second, burst)
+	log.Warnf("Hub setRateLimit, RPS = %d, burst = %d\n", rps, burst)
+	return h.rateLimit()
+}
+
+func (h *Hub) rateLimit() *define.RateLimitStruct {
+	rps, _, burst := h.inMsgHandlerPool.Rate()
+	return &define.RateLimitStruct{
+		NodeID: gNodeID,
+		RPS:    rps,
+		Burst:  burst,
+	}
+}
+
 // 枚举
 type inMsgType int
 
@@ -82,11 +114,37 @@ func (it inMsgType) String() string {
 	}
 }
 
+//inMsgHandlerPool classes in priority order, presence and acks beat bulk sync
+const (
+	inClassPresence = iota //clientOnline, clientOffline
+	inClassClient          //client frames, acks and upstream messages
+	inClassSync            //syncUsersInfo replays
+)
+
+var inMsgClasses = []PoolClass{
+	{Name: "presence", Capacity: 10000, Weight: 8},
+	{Name: "client", Capacity: 20000, Weight: 4},
+	{Name: "sync", Capacity: 10000, Weight: 1},
+}
+
+func (it inMsgType) class() int {
+	switch it {
+	case clientOnline, clientOffline:
+		return inClassPresence
+	case syncUsersInfo:
+		return inClassSync
+	default:
+		return inClassClient
+	}
+}
+
 type inMsg struct {
-	h   *Hub
-	c   *Client
-	t   inMsgType
-	msg []byte
+	h      *Hub
+	c      *Client
+	t      inMsgType
+	msg    []byte
+	binary bool
+	seq    uint64 //ClientInfo seq, not for clientMsg
 }
 
 func inMsgHandler(data interface{}) {
@@ -98,18 +156,8 @@ func inMsgHandler(data interface{}) {
 	log.Infof("inMsgHandler: from client[%s] msgType[%s] msg: %s\n", m.c.Cid, m.t, m.msg)
 
 	if m.t == clientMsg {
-		jsonObj := &ackStruct{}
-		err := jsoniter.Unmarshal(m.msg, jsonObj)
-		if err == nil {
-			if len(jsonObj.Aid) > 0 {
-				atomic.AddUint64(&gTotalAck, 1)
-				log.Info("inMsgHandler, handle ACK = ", jsonObj.Aid)
-				jsonObj.Cid = m.c.Cid
-				jsonObj.UserID = m.c.UserID
-				pBroker.Broadcast(cWsConnectorOutAck, jsonObj)
-			}
-			return
-		}
+		handleClientFrame(m.h, m.c, m.msg, m.binary)
+		return
 		// m.h.clients.Range(func(key, value interface{}) bool {
 		// 	value.(*Client).send(m.msg)
 		// 	return true
@@ -127,39 +175,35 @@ func inMsgHandler(data interface{}) {
 
 	}
 
-	info := &ClientInfo{
-		NodeID:         gNodeID,
-		Cid:            m.c.Cid,
-		UserID:         m.c.UserID,
-		Platform:       m.c.Platform,
-		Version:        m.c.Version,
-		Timestamp:      m.c.Timestamp,
-		Token:          m.c.Token,
-		ConnectTime:    m.c.ConnectTime,
-		DisconnectTime: m.c.DisconnectTime,
-	}
+	info := m.c.info(m.t != clientOffline)
+	info.Seq = m.seq
 
 	if m.t == syncUsersInfo {
-		pBroker.Broadcast(cWsConnectorOutSyncUsersInfo, info)
+		pBroker.Broadcast(define.WsConnectorOutSyncUsersInfo, info)
 		return
 	}
 
 	if m.t == clientOnline {
-		pBroker.Broadcast(cWsConnectorOutOnline, info)
+		pBroker.Broadcast(define.WsConnectorOutOnline, info)
 		return
 	}
 
 	if m.t == clientOffline {
-		pBroker.Broadcast(cWsConnectorOutOffline, info)
+		pBroker.Broadcast(define.WsConnectorOutOffline, info)
 		return
 	}
 
 }
 
 type outMsg struct {
-	h   *Hub
-	ids []string
-	msg interface{}
+	h      *Hub
+	ids    []string
+	topic  string //publish to subscribers of topic, ids is empty
+	msg    interface{}
+	target *define.TargetStruct
+	batch  []*outMsg //handled one by one in order, instead of ids and msg
+
+	pushTime time.Time //push or publish received, for push_to_write latency
 }
 
 func outMsgHandler(data interface{}) {
@@ -168,23 +212,46 @@ func outMsgHandler(data interface{}) {
 	if !ok {
 		return
 	}
+	for _, one := range m.batch {
+		outMsgHandler(one)
+	}
+	if len(m.batch) > 0 {
+		return
+	}
 
 	// log.Infof("Hub outMsgHandler from client[%s] msgType[%d] msg: %s\n", m.c.Cid, m.msgType, m.msg)
+	//resolve topic first, expired publish is counted per subscriber
+	if len(m.topic) > 0 {
+		m.ids = m.h.topicCids(m.topic)
+	}
+	if data, ok := m.msg.(*define.PushMsgDataStruct); ok && data.IsExpired(time.Now()) {
+		atomic.AddUint64(&gDropExpired, uint64(len(m.ids)))
+		log.Infof("Hub outMsgHandler drop expired msg, mid[%s] expireAt[%s]\n", data.Mid, data.ExpireAt)
+		return
+	}
+	prepared := newPreparedMsg(m.msg, m.pushTime)
+	send := func(clientObj *Client) {
+		frame, err := prepared.frame(clientObj.encoding)
+		if err != nil {
+			log.Infof("Hub outMsgHandler encode[%s] msg err: %v\n", clientObj.encoding, err)
+			return
+		}
+		atomic.AddUint64(&gTotalSend, 1)
+		clientObj.sendFrame(frame)
+	}
 	for _, clientID := range m.ids {
 		var sent = false
 
 		if client, ok := m.h.clients.Load(clientID); ok {
-			if clientObj, ok := client.(*Client); ok {
-				atomic.AddUint64(&gTotalSend, 1)
-				clientObj.send(m.msg)
+			if clientObj, ok := client.(*Client); ok && m.target.Match(clientObj.Platform, clientObj.Version) {
+				send(clientObj)
 				sent = true
 			}
 		}
 		if userID2Cids, ok := m.h.userID2Cids.Load(clientID); ok {
 			userID2Cids.(*sync.Map).Range(func(key, value interface{}) bool {
-				if clientObj, ok := value.(*Client); ok {
-					atomic.AddUint64(&gTotalSend, 1)
-					clientObj.send(m.msg)
+				if clientObj, ok := value.(*Client); ok && m.target.Match(clientObj.Platform, clientObj.Version) {
+					send(clientObj)
 					sent = true
 				}
 				return true
@@ -209,26 +276,75 @@ func (h *Hub) close() {
 	}
 }
 
-func (h *Hub) sendMessage(ids []string, msg interface{}) {
+func (h *Hub) sendMessage(ids []string, msg interface{}, target *define.TargetStruct) {
 	atomic.AddUint64(&gTotalTrySend, 1)
 	if atomic.LoadUint64(&gTotalTrySend)%10000 == 0 {
 		log.Warn("Hub gTotalTrySend: ", gTotalTrySend)
 	}
 	h.outMsgHandlerPool.Add(&outMsg{
-		h:   h,
-		ids: ids,
-		msg: msg,
+		h:        h,
+		ids:      ids,
+		msg:      msg,
+		target:   target,
+		pushTime: time.Now(),
 	})
 
 }
 
+//sendBatch push msgs as one pool item, a client gets them in order
+func (h *Hub) sendBatch(msgs []*define.PushMsgStruct) error {
+	now := time.Now()
+	batch := make([]*outMsg, 0, len(msgs))
+	for _, msg := range msgs {
+		ids, err := define.ParseIDs(msg.IDs)
+		if err != nil {
+			return err
+		}
+		if msg.Data == nil {
+			return errors.New("data is empty")
+		}
+		err = msg.Target.Parse()
+		if err != nil {
+			return err
+		}
+		msg.Data.ApplyTTL(now)
+		batch = append(batch, &outMsg{
+			h:        h,
+			ids:      ids,
+			msg:      msg.Data,
+			target:   msg.Target,
+			pushTime: now,
+		})
+	}
+	atomic.AddUint64(&gTotalTrySend, uint64(len(batch)))
+	h.outMsgHandlerPool.Add(&outMsg{
+		h:        h,
+		batch:    batch,
+		pushTime: now,
+	})
+	return nil
+}
+
+func (h *Hub) addInMsg(m *inMsg) {
+	if m.t != clientMsg {
+		seq, ok := m.c.nextSeq(m.t == clientOffline)
+		if !ok {
+			log.Infof("Hub addInMsg: client[%s] already offline, skip %s\n", m.c.Cid, m.t)
+			return
+		}
+		m.seq = seq
+	}
+	h.inMsgHandlerPool.AddClass(m.t.class(), m)
+}
+
 func (h *Hub) handleClientMessage(client *Client, msgType int, msg []byte) {
 	atomic.AddUint64(&gTotalTryAck, 1)
-	h.inMsgHandlerPool.Add(&inMsg{
-		h:   h,
-		c:   client,
-		t:   clientMsg,
-		msg: msg,
+	h.addInMsg(&inMsg{
+		h:      h,
+		c:      client,
+		t:      clientMsg,
+		msg:    msg,
+		binary: msgType == websocket.BinaryMessage,
 	})
 }
 
@@ -254,6 +370,8 @@ func (h *Hub) run() {
 	// 	}
 	// }()
 
+	h.runCleanTopics()
+
 	go func() {
 		for {
 			select {
@@ -264,6 +382,7 @@ func (h *Hub) run() {
 
 				//userID_platform save
 				h.clients.Store(client.Cid, client)
+				h.offlineCids.Delete(client.Cid)
 
 				//userID save
 				h.userID2Cids.LoadOrStore(client.UserID, &sync.Map{})
@@ -274,7 +393,7 @@ func (h *Hub) run() {
 						userID2CidsMap.Store(client.Cid, client)
 					}
 				}
-				h.inMsgHandlerPool.Add(&inMsg{
+				h.addInMsg(&inMsg{
 					h: h,
 					c: client,
 					t: clientOnline,
@@ -285,6 +404,9 @@ func (h *Hub) run() {
 				atomic.AddInt64(&gCurrentClients, -1)
 
 				h.clients.Delete(client.Cid)
+				if _, ok := h.cidTopics.Load(client.Cid); ok {
+					h.offlineCids.Store(client.Cid, time.Now())
+				}
 				userID2Cids, ok := h.userID2Cids.Load(client.UserID)
 				if ok {
 					if userID2CidsMap, ok := userID2Cids.(*sync.Map); ok {
@@ -301,7 +423,7 @@ func (h *Hub) run() {
 					// userID2Cids.(*sync.Map).Delete(client.Cid)
 				}
 
-				h.inMsgHandlerPool.Add(&inMsg{
+				h.addInMsg(&inMsg{
 					h: h,
 					c: client,
 					t: clientOffline,
@@ -348,12 +470,20 @@ func (h *Hub) count() int {
 
 //call ws-connector.count
 func (h *Hub) metrics() interface{} {
-	metrics := &metricsStruct{}
+	metrics := &define.MetricsStruct{}
 	var count uint64
+	encodings := make(map[string]uint64)
 	h.clients.Range(func(key, value interface{}) bool {
 		count++
+		if clientObj, ok := value.(*Client); ok {
+			encodings[clientObj.encoding]++
+		}
 		return true
 	})
+	metrics.Encodings = encodings
+	metrics.BytesSent = atomic.LoadUint64(&gBytesSent)
+	metrics.BytesBeforeCompress = atomic.LoadUint64(&gBytesBeforeCompress)
+	metrics.BytesAfterCompress = atomic.LoadUint64(&gBytesAfterCompress)
 	metrics.NodeID = gNodeID
 	metrics.Port = gPort
 	metrics.OnlineUsers = count
@@ -362,6 +492,38 @@ func (h *Hub) metrics() interface{} {
 	metrics.TotalTryAck = atomic.LoadUint64(&gTotalTryAck)
 	metrics.TotalAck = atomic.LoadUint64(&gTotalAck)
 	metrics.CurrentAccepting = atomic.LoadInt64(&gCurrentAccepting)
+	metrics.RejectBusy = atomic.LoadUint64(&gRejectBusy)
+	metrics.RejectParams = atomic.LoadUint64(&gRejectParams)
+	metrics.RejectInvalidToken = atomic.LoadUint64(&gRejectInvalidToken)
+	metrics.RejectVerifyError = atomic.LoadUint64(&gRejectVerifyError)
+	metrics.VerifyErrorPass = atomic.LoadUint64(&gVerifyErrorPass)
+	metrics.VerifyCacheHit = atomic.LoadUint64(&gVerifyCacheHit)
+	var topics uint64
+	h.topics.Range(func(key, value interface{}) bool {
+		topics++
+		return true
+	})
+	metrics.Topics = topics
+	metrics.TotalTryPublish = atomic.LoadUint64(&gTotalTryPublish)
+	metrics.TotalUpstream = atomic.LoadUint64(&gTotalUpstream)
+	metrics.TotalBadFrame = atomic.LoadUint64(&gTotalBadFrame)
+	metrics.Drops = map[string]uint64{
+		define.DropReasonExpired:      atomic.LoadUint64(&gDropExpired),
+		define.DropReasonSlowConsumer: atomic.LoadUint64(&gSlowConsumerDropped) + atomic.LoadUint64(&gSlowConsumerDropOldest),
+	}
+	metrics.SlowConsumerDropped = atomic.LoadUint64(&gSlowConsumerDropped)
+	metrics.SlowConsumerDropOldest = atomic.LoadUint64(&gSlowConsumerDropOldest)
+	metrics.SlowConsumerDisconnect = atomic.LoadUint64(&gSlowConsumerDisconnect)
+	metrics.Draining = isDraining()
+	metrics.RejectDraining = atomic.LoadUint64(&gRejectDraining)
+	metrics.Latency = gLatency.Latency()
+	metrics.PoolDrops = make(map[string]uint64)
+	for _, pool := range []*RunGoPool{h.inMsgHandlerPool, h.outMsgHandlerPool} {
+		metrics.Pools = append(metrics.Pools, pool.Stats())
+		for class, name := range pool.Classes() {
+			metrics.PoolDrops[pool.name+"."+name] = pool.ClassRejected(class)
+		}
+	}
 
 	log.Warn("Hub metrics: ", metrics)
 	return metrics
@@ -412,7 +574,7 @@ func (h *Hub) syncUsersInfo() {
 		if atomic.CompareAndSwapInt32(&h.isDoingSyncUsersInfo, 0, 1) {
 			h.clients.Range(func(key, value interface{}) bool {
 				client := value.(*Client)
-				h.inMsgHandlerPool.Add(&inMsg{
+				h.addInMsg(&inMsg{
 					h: h,
 					c: client,
 					t: syncUsersInfo,
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+var gLatency = &define.LatencyStats{}
+
+//maxWaitAck written push frames per client waiting ack, clients never ack (old versions) just reset it
+const maxWaitAck = 256
+
+//ackWait write time of pushed mids, for write_to_ack latency
+type ackWait struct {
+	mtx  sync.Mutex
+	mids map[string]time.Time
+}
+
+//observeSendToPush sendTime is set by ws-sender, empty for pushes from other services
+func observeSendToPush(sendTime string) {
+	if t, ok := define.ParseTimestamp(sendTime); ok {
+		gLatency.ObserveSince(define.LatencySendToPush, t)
+	}
+}
+
+//written called by writePump after frame is written to conn
+func (c *Client) written(frame *outFrame) {
+	if frame.pushTime.IsZero() {
+		return //not a push frame
+	}
+	now := time.Now()
+	gLatency.Observe(define.LatencyPushToWrite, now.Sub(frame.pushTime))
+	if len(frame.mid) < 1 {
+		return
+	}
+	c.ackWait.mtx.Lock()
+	if c.ackWait.mids == nil || len(c.ackWait.mids) >= maxWaitAck {
+		c.ackWait.mids = make(map[string]time.Time)
+	}
+	c.ackWait.mids[frame.mid] = now
+	c.ackWait.mtx.Unlock()
+}
+
+func (c *Client) acked(mid string) {
+	c.ackWait.mtx.Lock()
+	writeTime, ok := c.ackWait.mids[mid]
+	if ok {
+		delete(c.ackWait.mids, mid)
+	}
+	c.ackWait.mtx.Unlock()
+	if ok {
+		gLatency.Observe(define.LatencyWriteToAck, time.Since(writeTime))
+	}
+}
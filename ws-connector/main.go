@@ -112,7 +112,7 @@ func setDebug() {
 // ws-connector -s nats://192.168.1.223:12008
 // ws-connector -s nats://127.0.0.1:4222
 func usage() {
-	log.Fatalf("Usage: ws-connector [-s server (%s)] [-p port (12220)] [-i nodeID (0)] [-d debug (0)] [-r RPS (2500)] [-m MaxClients (500000 (20G) //400MB~10K user)] [-fe FastExit (0)] [-wf WriteLogToFile (0)]\n", nats.DefaultURL)
+	log.Fatalf("Usage: ws-connector [-s server (%s)] [-p port (12220)] [-i nodeID (0)] [-d debug (0)] [-r RPS (2500)] [-rb RateBurst (RPS/10)] [-pw PoolWorkers (64, 0 goroutine per msg)] [-m MaxClients (500000 (20G) //400MB~10K user)] [-fe FastExit (0)] [-wf WriteLogToFile (0)] [-vp VerifyPolicy (open|closed|grace, closed)] [-vg VerifyGraceSeconds (60)] [-vc VerifyCacheSeconds (60)] [-mt MaxTopics (100)] [-sk SubKeepSeconds (1800)] [-c Compress (0)] [-cl CompressLevel (1)] [-ct CompressThreshold (1024)] [-cd CompressDisablePlatforms (none, e.g. ios,android)] [-sq SendQueue (64)] [-sp SlowPolicy (drop|drop-oldest|disconnect, disconnect)] [-dw DrainSeconds (60)] [-mp PromPort (0)] [-hb HeartbeatSeconds (5)]\n", nats.DefaultURL)
 }
 
 /*
@@ -124,6 +124,7 @@ dev:
 ./ws-connector -s nats://127.0.0.1:12008 -p 12021 -i 1 -d 1 -fe 1 -wf 0
 */
 func main() {
+	bindExitSignals()
 	closer.Bind(cleanupFunc)
 
 	//get NATS server host
@@ -131,10 +132,26 @@ func main() {
 	_gPort := flag.Int("p", 12220, "listen websocket port")
 	_gID := flag.Int("i", 0, "ID of the service on this machine")
 	_gRPS := flag.Int("r", 2500, "max request per second")
+	_gRateBurst := flag.Int("rb", 0, "max burst of requests, 0 use RPS/10")
+	_gPoolWorkers := flag.Int("pw", 64, "workers of each msg handler pool, 0 start a goroutine per msg")
 	_gMaxClients := flag.Int("m", 500000, "max clients")
 	_gIsDebug := flag.Int("d", 0, "is debug")
 	_gFastExit := flag.Int("fe", 0, "fast exit")
 	_gWriteLogToFile := flag.Int("wf", 0, "write log to file")
+	_gVerifyPolicy := flag.String("vp", verifyPolicyClosed, "ws-token.verify error policy: open, closed, grace")
+	_gVerifyGraceSeconds := flag.Int("vg", 60, "grace policy: allow client within seconds after last successful verify")
+	_gVerifyCacheSeconds := flag.Int("vc", 60, "cache verify result seconds, 0 to disable")
+	_gMaxTopics := flag.Int("mt", 100, "max subscribed topics per client")
+	_gSubKeepSeconds := flag.Int("sk", 1800, "keep subscriptions seconds after client offline, restore them when reconnect with same cid")
+	_gCompress := flag.Int("c", 0, "enable permessage-deflate")
+	_gCompressLevel := flag.Int("cl", 1, "compression level, -2 ~ 9")
+	_gCompressThreshold := flag.Int("ct", 1024, "only compress frames bigger than bytes")
+	_gCompressDisablePlatforms := flag.String("cd", "", "disable compression for platforms (separated by comma)")
+	_gSendQueue := flag.Int("sq", 64, "client send queue depth")
+	_gSlowPolicy := flag.String("sp", slowPolicyDisconnect, "slow consumer policy when send queue is full: drop, drop-oldest, disconnect")
+	_gDrainSeconds := flag.Int("dw", 60, "drain window seconds, disconnect clients gradually on ws-connector.drain and SIGTERM")
+	_gPromPort := flag.Int("mp", 0, "prometheus /metrics http port, must not be the websocket port, 0 to disable")
+	_gHeartbeatSeconds := flag.Int("hb", 5, "broadcast ws-connector.out.heartbeat every seconds, 0 to disable")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -142,10 +159,28 @@ func main() {
 	gPort = *_gPort
 	gID = *_gID
 	gRPS = *_gRPS
+	gRateBurst = *_gRateBurst
+	gPoolWorkers = *_gPoolWorkers
 	gMaxClients = *_gMaxClients
 	gIsDebug = *_gIsDebug
 	gFastExit = *_gFastExit
 	gWriteLogToFile = *_gWriteLogToFile
+	gVerifyPolicy = *_gVerifyPolicy
+	gVerifyGraceSeconds = *_gVerifyGraceSeconds
+	gVerifyCacheSeconds = *_gVerifyCacheSeconds
+	gMaxTopics = *_gMaxTopics
+	gSubKeepSeconds = *_gSubKeepSeconds
+	gCompress = *_gCompress
+	gCompressLevel = *_gCompressLevel
+	gCompressThreshold = *_gCompressThreshold
+	if len(*_gCompressDisablePlatforms) > 0 {
+		gCompressDisablePlatforms = strings.Split(*_gCompressDisablePlatforms, ",")
+	}
+	gSendQueue = *_gSendQueue
+	gSlowPolicy = *_gSlowPolicy
+	gDrainSeconds = *_gDrainSeconds
+	gPromPort = *_gPromPort
+	gHeartbeatSeconds = *_gHeartbeatSeconds
 
 	setDebug()
 
@@ -157,7 +192,45 @@ func main() {
 	log.Warnf("gPort : %v\n", gPort)
 	log.Warnf("gID : %v\n", gID)
 	log.Warnf("gIsDebug : %v\n", gIsDebug)
+	log.Warnf("gRPS : %v\n", gRPS)
+	log.Warnf("gRateBurst : %v\n", gRateBurst)
+	log.Warnf("gPoolWorkers : %v\n", gPoolWorkers)
 	log.Warnf("gMaxClients : %v\n", gMaxClients)
+	log.Warnf("gVerifyPolicy : %v\n", gVerifyPolicy)
+	log.Warnf("gVerifyGraceSeconds : %v\n", gVerifyGraceSeconds)
+	log.Warnf("gVerifyCacheSeconds : %v\n", gVerifyCacheSeconds)
+	log.Warnf("gMaxTopics : %v\n", gMaxTopics)
+	log.Warnf("gSubKeepSeconds : %v\n", gSubKeepSeconds)
+	log.Warnf("gCompress : %v\n", gCompress)
+	log.Warnf("gCompressLevel : %v\n", gCompressLevel)
+	log.Warnf("gCompressThreshold : %v\n", gCompressThreshold)
+	log.Warnf("gCompressDisablePlatforms : %v\n", gCompressDisablePlatforms)
+	log.Warnf("gSendQueue : %v\n", gSendQueue)
+	log.Warnf("gSlowPolicy : %v\n", gSlowPolicy)
+	log.Warnf("gDrainSeconds : %v\n", gDrainSeconds)
+	log.Warnf("gPromPort : %v\n", gPromPort)
+	log.Warnf("gHeartbeatSeconds : %v\n", gHeartbeatSeconds)
+	if gCompressLevel < -2 || gCompressLevel > 9 {
+		log.Fatalf("invalid CompressLevel: %d\n", gCompressLevel)
+	}
+	if gRPS < 1 {
+		log.Fatalf("invalid RPS: %d\n", gRPS)
+	}
+	if gPoolWorkers < 0 {
+		log.Fatalf("invalid PoolWorkers: %d\n", gPoolWorkers)
+	}
+	if gSendQueue < 1 {
+		log.Fatalf("invalid SendQueue: %d\n", gSendQueue)
+	}
+	if gPromPort > 0 && gPromPort == gPort {
+		log.Fatalf("invalid PromPort: %d, /metrics must not be on the websocket port\n", gPromPort)
+	}
+	if !isValidSlowPolicy(gSlowPolicy) {
+		log.Fatalf("unknown SlowPolicy: %s\n", gSlowPolicy)
+	}
+	if gVerifyPolicy != verifyPolicyOpen && gVerifyPolicy != verifyPolicyClosed && gVerifyPolicy != verifyPolicyGrace {
+		log.Fatalf("unknown VerifyPolicy: %s\n", gVerifyPolicy)
+	}
 
 	gNodeID += "-" + strconv.Itoa(gID)
 	log.Warnf("gNodeID : %v\n", gNodeID)
@@ -185,6 +258,7 @@ func main() {
 	}
 
 	startWsService()
+	startHeartbeat()
 
 	log.Warn("================= Server Started ================= ")
 	demoWsString := "you can connect to the server by weboscket >>> wss://x.x.x.x:" + strconv.Itoa(gPort) + "/ws?userID=uaaa&platform=web&version=0.1.0&timestamp=1507870585757&token=73ce0b2d7b47b4af75f38dcabf8e3ce9894e6e6e"
@@ -200,7 +274,10 @@ func cleanupFunc() {
 	}
 	log.Infof("Hang on! %s is closing ...", AppName)
 	log.Warn("=================== exit start =================== ")
+	//rolling upgrade: move clients to other nodes gradually, pushes still work until they leave
+	waitDrain()
 	if pBroker != nil {
+		stopHeartbeat()
 		pBroker.Stop()
 	}
 	stopWsService()
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+//minimal MessagePack codec for json like values:
+//nil, bool, int64, float64, string, []byte, []interface{}, map[string]interface{}
+
+func msgpackEncode(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int64:
+		return msgpackEncodeInt(buf, val), nil
+	case float64:
+		buf = append(buf, 0xcb)
+		return appendUint64(buf, math.Float64bits(val)), nil
+	case string:
+		return msgpackEncodeString(buf, val), nil
+	case []byte:
+		n := len(val)
+		switch {
+		case n <= math.MaxUint8:
+			buf = append(buf, 0xc4, byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xc5)
+			buf = appendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xc6)
+			buf = appendUint32(buf, uint32(n))
+		}
+		return append(buf, val...), nil
+	case []interface{}:
+		n := len(val)
+		switch {
+		case n < 16:
+			buf = append(buf, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xdc)
+			buf = appendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdd)
+			buf = appendUint32(buf, uint32(n))
+		}
+		var err error
+		for _, item := range val {
+			buf, err = msgpackEncode(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		n := len(val)
+		switch {
+		case n < 16:
+			buf = append(buf, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			buf = append(buf, 0xde)
+			buf = appendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, 0xdf)
+			buf = appendUint32(buf, uint32(n))
+		}
+		//sorted keys, same msg always encode to same bytes
+		keys := make([]string, 0, n)
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, key := range keys {
+			buf = msgpackEncodeString(buf, key)
+			buf, err = msgpackEncode(buf, val[key])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, errors.New("msgpack: unsupported type")
+}
+
+func msgpackEncodeInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 127:
+		return append(buf, byte(i))
+	case i < 0 && i >= -32:
+		return append(buf, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		return append(buf, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		return appendUint16(append(buf, 0xcd), uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		return appendUint32(append(buf, 0xce), uint32(i))
+	case i >= 0:
+		return appendUint64(append(buf, 0xcf), uint64(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return appendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return appendUint32(append(buf, 0xd2), uint32(i))
+	}
+	return appendUint64(append(buf, 0xd3), uint64(i))
+}
+
+func msgpackEncodeString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = appendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = appendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+//msgpackDecode decode one value, map keys must be string
+func msgpackDecode(data []byte) (interface{}, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: extra data after value")
+	}
+	return v, nil
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+//maxDecodeDepth protect from deep nested frames
+const maxDecodeDepth = 64
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errors.New("msgpack: too deep")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		//copy, data is reused by the caller; empty bin stays []byte{}, not nil
+		ret := make([]byte, len(bin))
+		copy(ret, bin)
+		return ret, nil
+	case 0xca:
+		v, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(v))), nil
+	case 0xcb:
+		v, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return float64(v), nil
+		}
+		return int64(v), nil
+	case 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	}
+	return nil, errors.New("msgpack: unsupported type byte")
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	ret := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	ret := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map key is not string")
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = v
+	}
+	return ret, nil
+}
@@ -5,100 +5,310 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/roytan883/micro-services/define"
 )
 
 //PoolHander ...
 type PoolHander func(data interface{})
 
+//poolHandlerBuckets handler time histogram upper bounds in seconds
+var poolHandlerBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+//poolRunner run hander of pool items on a fixed number of workers,
+//or a goroutine per item when workers is 0, and keep handler stats
+type poolRunner struct {
+	hander   PoolHander
+	workers  int
+	inFlight int64
+	handled  uint64
+	latency  *define.Histogram
+}
+
+func newPoolRunner(hander PoolHander) poolRunner {
+	return poolRunner{
+		hander:  hander,
+		latency: define.NewHistogram(poolHandlerBuckets),
+	}
+}
+
+//startWorkers return the chan workers read items from, nil if workers is 0.
+//close it to stop the workers
+func (r *poolRunner) startWorkers() chan interface{} {
+	if r.workers < 1 {
+		return nil
+	}
+	work := make(chan interface{})
+	for i := 0; i < r.workers; i++ {
+		go func() {
+			for data := range work {
+				r.handle(data)
+			}
+		}()
+	}
+	return work
+}
+
+//dispatch block until a worker takes data, work nil run it in a new goroutine
+func (r *poolRunner) dispatch(work chan interface{}, data interface{}) {
+	atomic.AddInt64(&r.inFlight, 1)
+	if work == nil {
+		go r.handle(data)
+		return
+	}
+	work <- data
+}
+
+func (r *poolRunner) handle(data interface{}) {
+	start := time.Now()
+	r.hander(data)
+	r.latency.Observe(time.Since(start))
+	atomic.AddUint64(&r.handled, 1)
+	atomic.AddInt64(&r.inFlight, -1)
+}
+
+func (r *poolRunner) stats(name string, queued int64, rejected uint64) *define.PoolStatsStruct {
+	return &define.PoolStatsStruct{
+		Name:     name,
+		Workers:  r.workers,
+		Queued:   queued,
+		InFlight: atomic.LoadInt64(&r.inFlight),
+		Rejected: rejected,
+		Handled:  atomic.LoadUint64(&r.handled),
+		P99:      float64(r.latency.Percentile(0.99)) / float64(time.Millisecond),
+	}
+}
+
+//PoolClass priority class of RunGoPool, each class has its own queue
+type PoolClass struct {
+	Name     string
+	Capacity int //max queued items, Add drops more
+	Weight   int //items taken from this class in one scheduling round
+}
+
+//defaultPoolCapacity queued items of a single class RunGoPool
+const defaultPoolCapacity = 30000
+
+type poolLane struct {
+	PoolClass
+	dataChan chan interface{}
+	dropped  uint64
+}
+
 //RunGoPool ...
 type RunGoPool struct {
-	name            string
-	rate            *RateLimiter
-	dataChan        chan interface{}
-	dataChanLen     int64
-	waitDataChanLen int64
-	hander          PoolHander
-	stopChan        chan int
-	stoped          uint32
+	poolRunner
+	name     string
+	rate     *RateLimiter
+	lanes    []*poolLane
+	notify   chan int
+	mtx      sync.RWMutex //Start and Stop hold it, Add hold RLock so nothing is queued after Stop
+	stopChan chan int     //nil when not running
+	stoped   uint32
 }
 
-// NewRunGoPool creates a new rate limiter for the limit and interval.
+// NewRunGoPool creates a new rate limiter for the limit and interval, with one class.
 func NewRunGoPool(name string, limit int, interval time.Duration, hander PoolHander) *RunGoPool {
+	return NewRunGoPoolWithClasses(name, limit, interval, []PoolClass{{Name: "default", Capacity: defaultPoolCapacity, Weight: 1}}, hander)
+}
+
+// NewRunGoPoolWithClasses classes are in priority order, AddClass(i, data) queue data to classes[i].
+// Every round takes up to Weight items of each class in order, so a busy low class can not starve a higher one.
+func NewRunGoPoolWithClasses(name string, limit int, interval time.Duration, classes []PoolClass, hander PoolHander) *RunGoPool {
 	pool := &RunGoPool{
-		name:     name,
-		hander:   hander,
-		stopChan: make(chan int, 1),
-		dataChan: make(chan interface{}, 10000), //若缓存太大会开销太多内存
+		poolRunner: newPoolRunner(hander),
+		name:       name,
+		notify:     make(chan int, 1),
+	}
+	for _, class := range classes {
+		if class.Capacity < 1 {
+			class.Capacity = defaultPoolCapacity
+		}
+		if class.Weight < 1 {
+			class.Weight = 1
+		}
+		pool.lanes = append(pool.lanes, &poolLane{
+			PoolClass: class,
+			dataChan:  make(chan interface{}, class.Capacity),
+		})
 	}
 	pool.rate = NewRateLimiter(limit, interval)
 	return pool
 }
 
-//Start ...
+//SetWorkers run items on workers goroutines, 0 run a goroutine per item. Call before Start
+func (p *RunGoPool) SetWorkers(workers int) {
+	p.workers = workers
+}
+
+//Start items added before Start are kept and handled, Start a running pool does nothing
 func (p *RunGoPool) Start() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.stopChan != nil {
+		return
+	}
 	atomic.StoreUint32(&p.stoped, 0)
+	stopChan := make(chan int)
+	p.stopChan = stopChan
+	work := p.startWorkers()
 	go func() {
+		if work != nil {
+			defer close(work)
+		}
 		for {
 			select {
-			case <-p.stopChan:
+			case <-stopChan:
 				return
-			case data := <-p.dataChan:
-				atomic.AddInt64(&p.dataChanLen, -1)
-				p.rate.Wait()
-				go p.hander(data)
+			default:
+			}
+			if p.runRound(work) > 0 {
+				continue
+			}
+			select {
+			case <-stopChan:
+				return
+			case <-p.notify:
 			}
 		}
 	}()
 }
 
-//Stop ...
+//runRound take up to Weight items of every class, return items handled
+func (p *RunGoPool) runRound(work chan interface{}) int {
+	handled := 0
+	for _, lane := range p.lanes {
+	lane:
+		for i := 0; i < lane.Weight; i++ {
+			select {
+			case data := <-lane.dataChan:
+				p.rate.Wait()
+				p.dispatch(work, data)
+				handled++
+			default:
+				break lane
+			}
+		}
+	}
+	return handled
+}
+
+//Stop after Stop Add rejects items, items still queued stay until next Start.
+//Stop twice or before Start only mark the pool stopped
 func (p *RunGoPool) Stop() {
-	atomic.AddUint32(&p.stoped, 1)
-	p.stopChan <- 1
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	atomic.StoreUint32(&p.stoped, 1)
+	if p.stopChan != nil {
+		close(p.stopChan)
+		p.stopChan = nil
+	}
 }
 
-//Add ...
+//Add queue data to the first class
 func (p *RunGoPool) Add(data interface{}) {
+	p.AddClass(0, data)
+}
+
+//AddClass queue data to class, drop it if the class is full or the pool is stopped
+func (p *RunGoPool) AddClass(class int, data interface{}) {
+	if class < 0 || class >= len(p.lanes) {
+		class = len(p.lanes) - 1
+	}
+	lane := p.lanes[class]
+	p.mtx.RLock()
 	if atomic.LoadUint32(&p.stoped) > 0 {
+		p.mtx.RUnlock()
+		dropped := atomic.AddUint64(&lane.dropped, 1)
+		if dropped == 1 || dropped%1000 == 0 {
+			log.Warnf("RunGoPool[%s] class[%s] stopped, drop, total dropped = %d\n", p.name, lane.Name, dropped)
+		}
 		return
 	}
-	//dataChan最大缓存10000，所以9000以下的时候，直接放进去
-	//省掉了开go协程的开销
-	if atomic.LoadInt64(&p.dataChanLen) < 9000 {
-		p.dataChan <- data
-		atomic.AddInt64(&p.dataChanLen, 1)
-	} else {
-		if atomic.LoadInt64(&p.waitDataChanLen) > 20000 {
-			log.Warnf("RunGoPool[%s] Add: waitDataChanLen > 20000, reject\n", p.name)
-			return
+	select {
+	case lane.dataChan <- data:
+		p.mtx.RUnlock()
+	default:
+		p.mtx.RUnlock()
+		dropped := atomic.AddUint64(&lane.dropped, 1)
+		if dropped == 1 || dropped%1000 == 0 {
+			log.Warnf("RunGoPool[%s] class[%s] full (%d), drop, total dropped = %d\n", p.name, lane.Name, lane.Capacity, dropped)
 		}
-		//dataChan最大缓存10000，所以9000以上的时候
-		//可能dataChan缓存已经满了，所以要开一个go 协程写入，当满缓存的时候不会卡住外面
-		log.Warnf("RunGoPool[%s] Add: dataChanLen = %d\n", p.name, atomic.LoadInt64(&p.dataChanLen))
-		atomic.AddInt64(&p.waitDataChanLen, 1)
-		log.Warnf("RunGoPool[%s] Add: waitDataChanLen = %d\n", p.name, atomic.LoadInt64(&p.waitDataChanLen))
-		go func() {
-			p.dataChan <- data
-			atomic.AddInt64(&p.dataChanLen, 1)
-			atomic.AddInt64(&p.waitDataChanLen, -1)
-		}()
+		return
+	}
+	select {
+	case p.notify <- 1:
+	default:
+	}
+}
+
+//Classes names of classes in priority order
+func (p *RunGoPool) Classes() []string {
+	names := make([]string, 0, len(p.lanes))
+	for _, lane := range p.lanes {
+		names = append(names, lane.Name)
+	}
+	return names
+}
+
+//SetRate change the rate limit at runtime, see RateLimiter.Set
+func (p *RunGoPool) SetRate(limit int, interval time.Duration, burst int) {
+	p.rate.Set(limit, interval, burst)
+}
+
+//Rate current limit, interval and burst
+func (p *RunGoPool) Rate() (limit int, interval time.Duration, burst int) {
+	return p.rate.Config()
+}
+
+//Queued items waiting in all classes
+func (p *RunGoPool) Queued() int64 {
+	var queued int64
+	for _, lane := range p.lanes {
+		queued += int64(len(lane.dataChan))
 	}
+	return queued
+}
+
+//Rejected items dropped because class is full or pool is stopped, all classes
+func (p *RunGoPool) Rejected() uint64 {
+	var rejected uint64
+	for _, lane := range p.lanes {
+		rejected += atomic.LoadUint64(&lane.dropped)
+	}
+	return rejected
+}
+
+//ClassQueued items waiting in class
+func (p *RunGoPool) ClassQueued(class int) int64 {
+	return int64(len(p.lanes[class].dataChan))
+}
+
+//ClassRejected items dropped because class is full or pool is stopped
+func (p *RunGoPool) ClassRejected(class int) uint64 {
+	return atomic.LoadUint64(&p.lanes[class].dropped)
+}
+
+//Stats backpressure of the pool
+func (p *RunGoPool) Stats() *define.PoolStatsStruct {
+	return p.stats(p.name, p.Queued(), p.Rejected())
 }
 
 //RunTimerPool ...
 type RunTimerPool struct {
+	poolRunner
 	rate     *RateLimiter
 	queue    *list.List
-	mtx      sync.RWMutex
-	hander   PoolHander
-	stopChan chan int
+	mtx      sync.RWMutex //queue, stopChan and stoped
+	stopChan chan int     //nil when not running
+	stoped   uint32
+	rejected uint64
 }
 
 // NewRunTimerPool creates a new rate limiter for the limit and interval(>100ms).
 func NewRunTimerPool(limit int, interval time.Duration, hander PoolHander) *RunTimerPool {
 	pool := &RunTimerPool{
-		hander:   hander,
-		stopChan: make(chan int, 1),
+		poolRunner: newPoolRunner(hander),
 	}
 	if interval < time.Millisecond*100 {
 		interval = time.Millisecond * 100
@@ -108,83 +318,173 @@ func NewRunTimerPool(limit int, interval time.Duration, hander PoolHander) *RunT
 	return pool
 }
 
-//Start ...
+//SetWorkers run items on workers goroutines, 0 run a goroutine per item. Call before Start
+func (p *RunTimerPool) SetWorkers(workers int) {
+	p.workers = workers
+}
+
+//Start items added before Start are kept and handled, Start a running pool does nothing
 func (p *RunTimerPool) Start() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.stopChan != nil {
+		return
+	}
+	atomic.StoreUint32(&p.stoped, 0)
+	stopChan := make(chan int)
+	p.stopChan = stopChan
+	work := p.startWorkers()
 	go func() {
 		ticker := time.NewTicker(time.Millisecond * 1)
+		defer ticker.Stop()
+		if work != nil {
+			defer close(work)
+		}
 		for {
 			select {
-			case <-p.stopChan:
-				ticker.Stop()
+			case <-stopChan:
 				return
 			case <-ticker.C:
-				p.mtx.RLock()
-				len := p.queue.Len()
-				p.mtx.RUnlock()
-				if len > 0 {
-					ok := true
-					for ok {
-						ok, _ = p.rate.Try()
-						if ok {
-							p.mtx.RLock()
-							item := p.queue.Front()
-							p.mtx.RUnlock()
-							if item != nil {
-								data := item.Value
-								p.mtx.Lock()
-								p.queue.Remove(item)
-								p.mtx.Unlock()
-								go p.hander(data)
-							} else {
-								ok = false
-								break
-							}
-						} else {
-							p.mtx.RLock()
-							log.Info("RunTimerPool limited, remain len = ", p.queue.Len())
-							p.mtx.RUnlock()
-						}
-					}
-				}
+				p.runQueued(work)
 			}
 		}
 	}()
 }
 
-//Stop ...
+//runQueued handle queued items until queue is empty or rate limited,
+//a token is only taken when there is an item for it
+func (p *RunTimerPool) runQueued(work chan interface{}) {
+	for {
+		p.mtx.RLock()
+		len := p.queue.Len()
+		p.mtx.RUnlock()
+		if len < 1 {
+			return
+		}
+		if ok, _ := p.rate.Try(); !ok {
+			log.Info("RunTimerPool limited, remain len = ", len)
+			return
+		}
+		p.mtx.Lock()
+		item := p.queue.Front()
+		p.queue.Remove(item)
+		p.mtx.Unlock()
+		p.dispatch(work, item.Value)
+	}
+}
+
+//Stop after Stop Add rejects items, items still queued stay until next Start
 func (p *RunTimerPool) Stop() {
-	p.stopChan <- 1
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	atomic.StoreUint32(&p.stoped, 1)
+	if p.stopChan != nil {
+		close(p.stopChan)
+		p.stopChan = nil
+	}
 }
 
-//Add ...
+//Add reject data if the pool is stopped
 func (p *RunTimerPool) Add(data interface{}) {
 	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if atomic.LoadUint32(&p.stoped) > 0 {
+		atomic.AddUint64(&p.rejected, 1)
+		return
+	}
 	p.queue.PushBack(data)
-	p.mtx.Unlock()
 }
 
-// A RateLimiter limits the rate at which an action can be performed.  It
-// applies neither smoothing (like one could achieve in a token bucket system)
-// nor does it offer any conception of warmup, wherein the rate of actions
-// granted are steadily increased until a steady throughput equilibrium is
-// reached.
+//Stats backpressure of the pool, rejected are items added after Stop
+func (p *RunTimerPool) Stats() *define.PoolStatsStruct {
+	p.mtx.RLock()
+	queued := int64(p.queue.Len())
+	p.mtx.RUnlock()
+	return p.stats("", queued, atomic.LoadUint64(&p.rejected))
+}
+
+// A RateLimiter is a token bucket. Tokens are added at limit per interval
+// up to burst, each granted action takes one. Try is O(1) and does not
+// allocate. limit and burst can be changed at runtime with Set.
 type RateLimiter struct {
+	mtx      sync.Mutex
 	limit    int
 	interval time.Duration
-	mtx      sync.Mutex
-	times    list.List
+	burst    int
+	perToken float64 //nanoseconds to add one token
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(d time.Duration)
 }
 
-// NewRateLimiter creates a new rate limiter for the limit and interval.
+// NewRateLimiter creates a new rate limiter for the limit and interval,
+// burst is limit and the bucket starts full.
 func NewRateLimiter(limit int, interval time.Duration) *RateLimiter {
 	lim := &RateLimiter{
-		limit:    limit,
-		interval: interval,
+		now:   time.Now,
+		sleep: time.Sleep,
 	}
-	lim.times.Init()
+	lim.Set(limit, interval, limit)
+	lim.tokens = float64(lim.burst)
 	return lim
 }
 
+// Set changes limit, interval and burst, tokens already in the bucket are
+// kept (up to the new burst).
+func (r *RateLimiter) Set(limit int, interval time.Duration, burst int) {
+	if limit < 1 {
+		limit = 1
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.perToken > 0 {
+		r.refill(r.now())
+	} else {
+		r.last = r.now()
+	}
+	r.limit = limit
+	r.interval = interval
+	r.burst = burst
+	r.perToken = float64(interval) / float64(limit)
+	if r.tokens > float64(burst) {
+		r.tokens = float64(burst)
+	}
+}
+
+// Config returns current limit, interval and burst.
+func (r *RateLimiter) Config() (limit int, interval time.Duration, burst int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.limit, r.interval, r.burst
+}
+
+//setClock replace time.Now and time.Sleep, for tests, call before the limiter is used
+func (r *RateLimiter) setClock(now func() time.Time, sleep func(d time.Duration)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.now = now
+	r.sleep = sleep
+	r.last = now()
+}
+
+//refill must hold mtx
+func (r *RateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(r.last); elapsed > 0 {
+		r.tokens += float64(elapsed) / r.perToken
+		if r.tokens > float64(r.burst) {
+			r.tokens = float64(r.burst)
+		}
+		r.last = now
+	}
+}
+
 // Wait blocks if the rate limit has been reached.  Wait offers no guarantees
 // of fairness for multiple actors if the allowed rate has been temporarily
 // exhausted.
@@ -194,25 +494,19 @@ func (r *RateLimiter) Wait() {
 		if ok {
 			break
 		}
-		time.Sleep(remaining)
+		r.sleep(remaining)
 	}
 }
 
-// Try returns true if under the rate limit, or false if over and the
-// remaining time before the rate limit expires.
+// Try returns true and takes one token if there is one, or false and the
+// time until the next token.
 func (r *RateLimiter) Try() (ok bool, remaining time.Duration) {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	now := time.Now()
-	if l := r.times.Len(); l < r.limit {
-		r.times.PushBack(now)
+	r.refill(r.now())
+	if r.tokens >= 1 {
+		r.tokens--
 		return true, 0
 	}
-	frnt := r.times.Front()
-	if diff := now.Sub(frnt.Value.(time.Time)); diff < r.interval {
-		return false, r.interval - diff
-	}
-	frnt.Value = now
-	r.times.MoveToBack(frnt)
-	return true, 0
+	return false, time.Duration((1-r.tokens)*r.perToken) + 1
 }
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/sirupsen/logrus"
+)
+
+//fakeClock only moves when Sleep or Advance is called
+type fakeClock struct {
+	mtx sync.Mutex
+	t   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.t = c.t.Add(d)
+	c.mtx.Unlock()
+}
+
+func newFakeRateLimiter(limit int, interval time.Duration, burst int) (*RateLimiter, *fakeClock) {
+	clock := newFakeClock()
+	r := NewRateLimiter(limit, interval)
+	r.setClock(clock.Now, clock.Sleep)
+	r.Set(limit, interval, burst)
+	return r, clock
+}
+
+//fastPool rate limit that never waits in tests
+const fastPoolRate = 1000000000
+
+func quietLog() {
+	log.SetLevel(logrus.ErrorLevel)
+}
+
+//waitGoroutines wait until goroutines are back to n, they exit asynchronously after Stop
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: %d running, want %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func waitCount(t *testing.T, count *int64, n int64) {
+	deadline := time.Now().Add(time.Second * 2)
+	for atomic.LoadInt64(count) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d items, want %d", atomic.LoadInt64(count), n)
+		}
+		time.Sleep(time.Millisecond * 1)
+	}
+}
+
+//waitIdle wait until handlers returned and stats are updated
+func waitIdle(t *testing.T, stats func() *define.PoolStatsStruct) {
+	deadline := time.Now().Add(time.Second * 2)
+	for stats().InFlight > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool not idle: %+v", stats())
+		}
+		time.Sleep(time.Millisecond * 1)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	r, _ := newFakeRateLimiter(100, time.Second, 10)
+	for i := 0; i < 10; i++ {
+		if ok, _ := r.Try(); !ok {
+			t.Fatalf("Try %d in burst rejected", i)
+		}
+	}
+	ok, remaining := r.Try()
+	if ok {
+		t.Fatal("Try over burst allowed")
+	}
+	if remaining <= 0 || remaining > time.Millisecond*10+1 {
+		t.Fatalf("remaining = %v, want about 10ms", remaining)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	r, clock := newFakeRateLimiter(100, time.Second, 10)
+	for ok, _ := r.Try(); ok; ok, _ = r.Try() {
+	}
+	clock.Advance(time.Millisecond * 35)
+	granted := 0
+	for ok, _ := r.Try(); ok; ok, _ = r.Try() {
+		granted++
+	}
+	if granted != 3 {
+		t.Fatalf("granted %d after 35ms at 100/s, want 3", granted)
+	}
+	//idle for long only refill up to burst
+	clock.Advance(time.Hour)
+	granted = 0
+	for ok, _ := r.Try(); ok; ok, _ = r.Try() {
+		granted++
+	}
+	if granted != 10 {
+		t.Fatalf("granted %d after idle, want burst 10", granted)
+	}
+}
+
+func TestRateLimiterWaitRate(t *testing.T) {
+	r, clock := newFakeRateLimiter(100, time.Second, 10)
+	start := clock.Now()
+	for i := 0; i < 1010; i++ {
+		r.Wait()
+	}
+	//10 from the full bucket, 1000 at 100/s
+	elapsed := clock.Now().Sub(start)
+	if elapsed < time.Second*10-time.Millisecond || elapsed > time.Second*10+time.Millisecond {
+		t.Fatalf("1010 Wait took %v, want 10s", elapsed)
+	}
+}
+
+func TestRateLimiterSet(t *testing.T) {
+	r, clock := newFakeRateLimiter(100, time.Second, 100)
+	r.Set(10, time.Second, 5)
+	limit, interval, burst := r.Config()
+	if limit != 10 || interval != time.Second || burst != 5 {
+		t.Fatalf("Config = %d %v %d, want 10 1s 5", limit, interval, burst)
+	}
+	granted := 0
+	for ok, _ := r.Try(); ok; ok, _ = r.Try() {
+		granted++
+	}
+	if granted != 5 {
+		t.Fatalf("granted %d after lowering burst, want 5", granted)
+	}
+	clock.Advance(time.Millisecond * 250)
+	granted = 0
+	for ok, _ := r.Try(); ok; ok, _ = r.Try() {
+		granted++
+	}
+	if granted != 2 {
+		t.Fatalf("granted %d after 250ms at 10/s, want 2", granted)
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	r, _ := newFakeRateLimiter(1000, time.Second, 500)
+	var granted int64
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if ok, _ := r.Try(); ok {
+					atomic.AddInt64(&granted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 500 {
+		t.Fatalf("granted %d with frozen clock, want burst 500", granted)
+	}
+}
+
+func TestRateLimiterTryNoAlloc(t *testing.T) {
+	r := NewRateLimiter(1000, time.Second)
+	allocs := testing.AllocsPerRun(1000, func() {
+		r.Try()
+	})
+	if allocs != 0 {
+		t.Fatalf("Try allocs = %v, want 0", allocs)
+	}
+}
+
+func TestRunGoPoolHandleAll(t *testing.T) {
+	quietLog()
+	for _, workers := range []int{0, 4} {
+		var handled int64
+		p := NewRunGoPool("test", fastPoolRate, time.Second, func(data interface{}) {
+			atomic.AddInt64(&handled, 1)
+		})
+		p.SetWorkers(workers)
+		p.Start()
+		for i := 0; i < 1000; i++ {
+			p.Add(i)
+		}
+		waitCount(t, &handled, 1000)
+		p.Stop()
+		stats := p.Stats()
+		if stats.Rejected != 0 || stats.Queued != 0 {
+			t.Fatalf("workers %d: stats = %+v, want nothing queued or rejected", workers, stats)
+		}
+	}
+}
+
+func TestRunGoPoolRate(t *testing.T) {
+	quietLog()
+	var handled int64
+	p := NewRunGoPool("test", 100, time.Second, func(data interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	clock := newFakeClock()
+	p.rate.setClock(clock.Now, clock.Sleep)
+	p.SetRate(100, time.Second, 10)
+	start := clock.Now()
+	for i := 0; i < 210; i++ {
+		p.Add(i)
+	}
+	p.Start()
+	waitCount(t, &handled, 210)
+	p.Stop()
+	elapsed := clock.Now().Sub(start)
+	if elapsed < time.Second*2-time.Millisecond || elapsed > time.Second*2+time.Millisecond {
+		t.Fatalf("210 items at 100/s burst 10 took %v, want 2s", elapsed)
+	}
+}
+
+func TestRunGoPoolWorkersBound(t *testing.T) {
+	quietLog()
+	var running, maxRunning, handled int64
+	release := make(chan int)
+	p := NewRunGoPool("test", fastPoolRate, time.Second, func(data interface{}) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			max := atomic.LoadInt64(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(&running, -1)
+		atomic.AddInt64(&handled, 1)
+	})
+	p.SetWorkers(3)
+	p.Start()
+	for i := 0; i < 20; i++ {
+		p.Add(i)
+	}
+	for atomic.LoadInt64(&running) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := p.Stats(); stats.InFlight < 3 || stats.Queued+stats.InFlight != 20 {
+		t.Fatalf("stats = %+v, want 3+ in flight and the rest queued", stats)
+	}
+	close(release)
+	waitCount(t, &handled, 20)
+	waitIdle(t, p.Stats)
+	p.Stop()
+	if max := atomic.LoadInt64(&maxRunning); max != 3 {
+		t.Fatalf("max concurrent handlers = %d, want 3", max)
+	}
+	if stats := p.Stats(); stats.Handled != 20 || stats.InFlight != 0 {
+		t.Fatalf("stats = %+v, want 20 handled and none in flight", stats)
+	}
+}
+
+func TestRunGoPoolPriority(t *testing.T) {
+	quietLog()
+	var mtx sync.Mutex
+	order := make([]int, 0)
+	var handled int64
+	p := NewRunGoPoolWithClasses("test", fastPoolRate, time.Second, []PoolClass{
+		{Name: "high", Capacity: 100, Weight: 4},
+		{Name: "low", Capacity: 100, Weight: 1},
+	}, func(data interface{}) {
+		mtx.Lock()
+		order = append(order, data.(int))
+		mtx.Unlock()
+		atomic.AddInt64(&handled, 1)
+	})
+	p.SetWorkers(1)
+	//low first, high must still be handled mostly before it
+	for i := 0; i < 10; i++ {
+		p.AddClass(1, 1)
+	}
+	for i := 0; i < 20; i++ {
+		p.AddClass(0, 0)
+	}
+	p.Start()
+	waitCount(t, &handled, 30)
+	p.Stop()
+	mtx.Lock()
+	defer mtx.Unlock()
+	want := []int{0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+	for i, class := range want {
+		if order[i] != class {
+			t.Fatalf("order = %v, want weighted %v first", order, want)
+		}
+	}
+}
+
+func TestRunGoPoolRejected(t *testing.T) {
+	quietLog()
+	p := NewRunGoPoolWithClasses("test", fastPoolRate, time.Second, []PoolClass{
+		{Name: "a", Capacity: 5, Weight: 1},
+		{Name: "b", Capacity: 2, Weight: 1},
+	}, func(data interface{}) {})
+	for i := 0; i < 8; i++ {
+		p.AddClass(0, i)
+	}
+	for i := 0; i < 3; i++ {
+		p.AddClass(1, i)
+	}
+	if p.ClassRejected(0) != 3 || p.ClassRejected(1) != 1 || p.Rejected() != 4 {
+		t.Fatalf("rejected = %d %d %d, want 3 1 4", p.ClassRejected(0), p.ClassRejected(1), p.Rejected())
+	}
+	if p.ClassQueued(0) != 5 || p.ClassQueued(1) != 2 || p.Queued() != 7 {
+		t.Fatalf("queued = %d %d %d, want 5 2 7", p.ClassQueued(0), p.ClassQueued(1), p.Queued())
+	}
+}
+
+func TestRunGoPoolAddAfterStop(t *testing.T) {
+	quietLog()
+	var handled int64
+	p := NewRunGoPool("test", fastPoolRate, time.Second, func(data interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	p.SetWorkers(2)
+	p.Start()
+	p.Stop()
+	for i := 0; i < 10; i++ {
+		p.Add(i)
+	}
+	if p.Queued() != 0 || p.Rejected() != 10 {
+		t.Fatalf("queued %d rejected %d after Stop, want 0 and 10", p.Queued(), p.Rejected())
+	}
+	//restart handle new items again
+	p.Start()
+	p.Add(1)
+	waitCount(t, &handled, 1)
+	p.Stop()
+}
+
+func TestRunGoPoolStopRace(t *testing.T) {
+	quietLog()
+	var handled int64
+	p := NewRunGoPool("test", fastPoolRate, time.Second, func(data interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	p.SetWorkers(4)
+	p.Start()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				p.Add(i)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	p.Stop()
+	wg.Wait()
+	//every item is handled, queued or rejected, none lost
+	time.Sleep(time.Millisecond * 20)
+	n := atomic.LoadInt64(&handled)
+	accounted := uint64(n) + uint64(p.Queued()) + p.Rejected()
+	if accounted != 4000 {
+		t.Fatalf("handled %d + queued %d + rejected %d = %d, want 4000", n, p.Queued(), p.Rejected(), accounted)
+	}
+}
+
+func TestRunGoPoolStopTwice(t *testing.T) {
+	p := NewRunGoPool("test", fastPoolRate, time.Second, func(data interface{}) {})
+	done := make(chan int)
+	go func() {
+		p.Stop() //before Start
+		p.Start()
+		p.Stop()
+		p.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+}
+
+func TestRunGoPoolNoLeak(t *testing.T) {
+	quietLog()
+	base := runtime.NumGoroutine()
+	for _, workers := range []int{0, 8} {
+		var handled int64
+		p := NewRunGoPoolWithClasses("test", fastPoolRate, time.Second, inMsgClasses, func(data interface{}) {
+			atomic.AddInt64(&handled, 1)
+		})
+		p.SetWorkers(workers)
+		p.Start()
+		for i := 0; i < 300; i++ {
+			p.AddClass(i%3, i)
+		}
+		waitCount(t, &handled, 300)
+		p.Stop()
+		waitGoroutines(t, base)
+	}
+}
+
+func TestRunTimerPool(t *testing.T) {
+	quietLog()
+	base := runtime.NumGoroutine()
+	var handled int64
+	p := NewRunTimerPool(fastPoolRate, time.Second, func(data interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	p.SetWorkers(2)
+	for i := 0; i < 100; i++ {
+		p.Add(i)
+	}
+	p.Start()
+	waitCount(t, &handled, 100)
+	waitIdle(t, p.Stats)
+	p.Stop()
+	p.Stop()
+	p.Add(1)
+	if stats := p.Stats(); stats.Rejected != 1 || stats.Queued != 0 || stats.Handled != 100 {
+		t.Fatalf("stats = %+v, want 100 handled, 1 rejected after Stop", stats)
+	}
+	waitGoroutines(t, base)
+}
+
+func TestRunTimerPoolRate(t *testing.T) {
+	quietLog()
+	var handled int64
+	p := NewRunTimerPool(10, time.Second, func(data interface{}) {
+		atomic.AddInt64(&handled, 1)
+	})
+	clock := newFakeClock()
+	p.rate.setClock(clock.Now, clock.Sleep)
+	p.rate.Set(10, time.Second, 5)
+	p.Start()
+	defer p.Stop()
+	//one item at a time must not waste tokens on an empty queue
+	for i := int64(1); i <= 5; i++ {
+		p.Add(i)
+		waitCount(t, &handled, i)
+	}
+	for i := 0; i < 3; i++ {
+		p.Add(i)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if n := atomic.LoadInt64(&handled); n != 5 {
+		t.Fatalf("handled %d with empty bucket and frozen clock, want 5", n)
+	}
+	clock.Advance(time.Millisecond * 300)
+	waitCount(t, &handled, 8)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+var gRPCStats = &define.RPCStats{}
+
+//startPromService serve /metrics on gPromPort (http), never on the public websocket port
+func startPromService() {
+	err := define.StartPromService(gPromPort, writeProm)
+	if err != nil {
+		log.Warnf("metrics http port[%d] listen err, /metrics disabled: %v\n", gPromPort, err)
+	}
+}
+
+func writeProm(p *define.PromWriter) {
+	platforms := make(map[string]int)
+	encodings := make(map[string]int)
+	gHub.clients.Range(func(key, value interface{}) bool {
+		if clientObj, ok := value.(*Client); ok {
+			platforms[clientObj.Platform]++
+			encodings[clientObj.encoding]++
+		}
+		return true
+	})
+	for _, platform := range define.SortedKeys(platforms) {
+		p.Gauge("ws_connector_clients", "connected clients by platform", float64(platforms[platform]), "platform", platform)
+	}
+	for _, encoding := range define.SortedKeys(encodings) {
+		p.Gauge("ws_connector_clients_encoding", "connected clients by frame encoding", float64(encodings[encoding]), "encoding", encoding)
+	}
+	p.Gauge("ws_connector_accepting", "websocket upgrades in progress", float64(atomic.LoadInt64(&gCurrentAccepting)))
+	p.Gauge("ws_connector_draining", "1 when node is draining", boolToFloat(isDraining()))
+
+	p.Counter("ws_connector_push_try_total", "push requests", float64(atomic.LoadUint64(&gTotalTrySend)))
+	p.Counter("ws_connector_push_sent_total", "frames queued to clients by push and publish", float64(atomic.LoadUint64(&gTotalSend)))
+	p.Counter("ws_connector_publish_try_total", "publish requests", float64(atomic.LoadUint64(&gTotalTryPublish)))
+	p.Counter("ws_connector_ack_try_total", "frames from clients", float64(atomic.LoadUint64(&gTotalTryAck)))
+	p.Counter("ws_connector_ack_total", "acks from clients", float64(atomic.LoadUint64(&gTotalAck)))
+	p.Counter("ws_connector_upstream_total", "upstream messages from clients", float64(atomic.LoadUint64(&gTotalUpstream)))
+	p.Counter("ws_connector_bad_frame_total", "bad frames from clients", float64(atomic.LoadUint64(&gTotalBadFrame)))
+
+	p.Counter("ws_connector_drops_total", "dropped push frames by reason", float64(atomic.LoadUint64(&gDropExpired)), "reason", define.DropReasonExpired)
+	p.Counter("ws_connector_drops_total", "", float64(atomic.LoadUint64(&gSlowConsumerDropped)), "reason", slowPolicyDrop)
+	p.Counter("ws_connector_drops_total", "", float64(atomic.LoadUint64(&gSlowConsumerDropOldest)), "reason", slowPolicyDropOldest)
+	p.Counter("ws_connector_slow_consumer_disconnect_total", "clients disconnected by slow consumer policy", float64(atomic.LoadUint64(&gSlowConsumerDisconnect)))
+
+	p.Counter("ws_connector_reject_total", "rejected websocket upgrades by reason", float64(atomic.LoadUint64(&gRejectBusy)), "reason", "busy")
+	p.Counter("ws_connector_reject_total", "", float64(atomic.LoadUint64(&gRejectParams)), "reason", "params")
+	p.Counter("ws_connector_reject_total", "", float64(atomic.LoadUint64(&gRejectInvalidToken)), "reason", "invalid_token")
+	p.Counter("ws_connector_reject_total", "", float64(atomic.LoadUint64(&gRejectVerifyError)), "reason", "verify_error")
+	p.Counter("ws_connector_reject_total", "", float64(atomic.LoadUint64(&gRejectDraining)), "reason", "draining")
+	p.Counter("ws_connector_verify_error_pass_total", "ws-token.verify errors allowed by policy", float64(atomic.LoadUint64(&gVerifyErrorPass)))
+	p.Counter("ws_connector_verify_cache_hit_total", "token verify cache hits", float64(atomic.LoadUint64(&gVerifyCacheHit)))
+
+	p.Counter("ws_connector_bytes_sent_total", "frame payload bytes", float64(atomic.LoadUint64(&gBytesSent)))
+	p.Counter("ws_connector_bytes_before_compress_total", "payload bytes of compressed frames", float64(atomic.LoadUint64(&gBytesBeforeCompress)))
+	p.Counter("ws_connector_bytes_after_compress_total", "compressed frames bytes", float64(atomic.LoadUint64(&gBytesAfterCompress)))
+
+	pools := []*RunGoPool{gHub.inMsgHandlerPool, gHub.outMsgHandlerPool}
+	for _, pool := range pools {
+		for class, name := range pool.Classes() {
+			p.Gauge("ws_connector_pool_queued", "RunGoPool queued items by class", float64(pool.ClassQueued(class)), "pool", pool.name, "class", name)
+		}
+	}
+	for _, pool := range pools {
+		p.Gauge("ws_connector_pool_in_flight", "RunGoPool items being handled", float64(atomic.LoadInt64(&pool.inFlight)), "pool", pool.name)
+	}
+	for _, pool := range pools {
+		p.Gauge("ws_connector_pool_workers", "RunGoPool workers, 0 goroutine per item", float64(pool.workers), "pool", pool.name)
+	}
+	for _, pool := range pools {
+		p.Histogram("ws_connector_pool_handler_seconds", "RunGoPool handler time", pool.latency, "pool", pool.name)
+	}
+	for _, pool := range pools {
+		rps, _, _ := pool.Rate()
+		p.Gauge("ws_connector_pool_rate_limit", "RunGoPool RPS", float64(rps), "pool", pool.name)
+	}
+	for _, pool := range pools {
+		_, _, burst := pool.Rate()
+		p.Gauge("ws_connector_pool_rate_burst", "RunGoPool burst", float64(burst), "pool", pool.name)
+	}
+	for _, pool := range pools {
+		for class, name := range pool.Classes() {
+			p.Counter("ws_connector_pool_rejected_total", "RunGoPool items dropped because class is full", float64(pool.ClassRejected(class)), "pool", pool.name, "class", name)
+		}
+	}
+
+	gLatency.WriteProm(p, "ws_connector_latency_seconds")
+	gRPCStats.WriteProm(p, "ws_connector")
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+//protobuf frames are google.protobuf.Value (struct.proto), so clients decode them without our own .proto:
+//Value     { NullValue null_value = 1; double number_value = 2; string string_value = 3;
+//            bool bool_value = 4; Struct struct_value = 5; ListValue list_value = 6; }
+//Struct    { map<string, Value> fields = 1; }
+//ListValue { repeated Value values = 1; }
+
+const (
+	pbWireVarint  = 0
+	pbWireFixed64 = 1
+	pbWireBytes   = 2
+	pbWireFixed32 = 5
+)
+
+func pbAppendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func pbAppendTag(buf []byte, field int, wire int) []byte {
+	return pbAppendVarint(buf, uint64(field<<3|wire))
+}
+
+func pbAppendBytes(buf []byte, field int, b []byte) []byte {
+	buf = pbAppendTag(buf, field, pbWireBytes)
+	buf = pbAppendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+//protobufEncode encode json like value as google.protobuf.Value
+func protobufEncode(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		buf = pbAppendTag(buf, 1, pbWireVarint)
+		return pbAppendVarint(buf, 0), nil
+	case float64:
+		buf = pbAppendTag(buf, 2, pbWireFixed64)
+		return appendUint64LE(buf, math.Float64bits(val)), nil
+	case int64:
+		buf = pbAppendTag(buf, 2, pbWireFixed64)
+		return appendUint64LE(buf, math.Float64bits(float64(val))), nil
+	case string:
+		return pbAppendBytes(buf, 3, []byte(val)), nil
+	case bool:
+		buf = pbAppendTag(buf, 4, pbWireVarint)
+		if val {
+			return pbAppendVarint(buf, 1), nil
+		}
+		return pbAppendVarint(buf, 0), nil
+	case map[string]interface{}:
+		structBuf, err := protobufEncodeStruct(nil, val)
+		if err != nil {
+			return nil, err
+		}
+		return pbAppendBytes(buf, 5, structBuf), nil
+	case []interface{}:
+		var listBuf []byte
+		for _, item := range val {
+			itemBuf, err := protobufEncode(nil, item)
+			if err != nil {
+				return nil, err
+			}
+			listBuf = pbAppendBytes(listBuf, 1, itemBuf)
+		}
+		return pbAppendBytes(buf, 6, listBuf), nil
+	}
+	return nil, errors.New("protobuf: unsupported type")
+}
+
+func protobufEncodeStruct(buf []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		valueBuf, err := protobufEncode(nil, m[key])
+		if err != nil {
+			return nil, err
+		}
+		var entryBuf []byte
+		entryBuf = pbAppendBytes(entryBuf, 1, []byte(key))
+		entryBuf = pbAppendBytes(entryBuf, 2, valueBuf)
+		buf = pbAppendBytes(buf, 1, entryBuf)
+	}
+	return buf, nil
+}
+
+func appendUint64LE(buf []byte, v uint64) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+var errProtobufShort = errors.New("protobuf: unexpected end of data")
+
+type pbField struct {
+	num    int
+	wire   int
+	varint uint64
+	bytes  []byte
+}
+
+//pbReadFields split one message into fields
+func pbReadFields(data []byte) ([]pbField, error) {
+	fields := make([]pbField, 0, 4)
+	pos := 0
+	readVarint := func() (uint64, error) {
+		var v uint64
+		for shift := uint(0); shift < 64; shift += 7 {
+			if pos >= len(data) {
+				return 0, errProtobufShort
+			}
+			b := data[pos]
+			pos++
+			v |= uint64(b&0x7f) << shift
+			if b < 0x80 {
+				return v, nil
+			}
+		}
+		return 0, errors.New("protobuf: bad varint")
+	}
+	for pos < len(data) {
+		tag, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		f := pbField{num: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case pbWireVarint:
+			f.varint, err = readVarint()
+			if err != nil {
+				return nil, err
+			}
+		case pbWireFixed64:
+			if pos+8 > len(data) {
+				return nil, errProtobufShort
+			}
+			for i := 7; i >= 0; i-- {
+				f.varint = f.varint<<8 | uint64(data[pos+i])
+			}
+			pos += 8
+		case pbWireFixed32:
+			if pos+4 > len(data) {
+				return nil, errProtobufShort
+			}
+			pos += 4
+		case pbWireBytes:
+			n, err := readVarint()
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(len(data)-pos) {
+				return nil, errProtobufShort
+			}
+			f.bytes = data[pos : pos+int(n)]
+			pos += int(n)
+		default:
+			return nil, errors.New("protobuf: unsupported wire type")
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+//protobufDecode decode google.protobuf.Value to json like value
+func protobufDecode(data []byte) (interface{}, error) {
+	return protobufDecodeValue(data, 0)
+}
+
+func protobufDecodeValue(data []byte, depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errors.New("protobuf: too deep")
+	}
+	fields, err := pbReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+	var ret interface{}
+	//last field wins, as protobuf oneof
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.wire == pbWireVarint:
+			ret = nil
+		case f.num == 2 && f.wire == pbWireFixed64:
+			ret = math.Float64frombits(f.varint)
+		case f.num == 3 && f.wire == pbWireBytes:
+			ret = string(f.bytes)
+		case f.num == 4 && f.wire == pbWireVarint:
+			ret = f.varint != 0
+		case f.num == 5 && f.wire == pbWireBytes:
+			ret, err = protobufDecodeStruct(f.bytes, depth)
+			if err != nil {
+				return nil, err
+			}
+		case f.num == 6 && f.wire == pbWireBytes:
+			items, err := pbReadFields(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			list := make([]interface{}, 0, len(items))
+			for _, item := range items {
+				if item.num != 1 || item.wire != pbWireBytes {
+					continue
+				}
+				v, err := protobufDecodeValue(item.bytes, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			ret = list
+		}
+	}
+	return ret, nil
+}
+
+func protobufDecodeStruct(data []byte, depth int) (map[string]interface{}, error) {
+	entries, err := pbReadFields(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		if entry.num != 1 || entry.wire != pbWireBytes {
+			continue
+		}
+		kv, err := pbReadFields(entry.bytes)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		var value interface{}
+		for _, f := range kv {
+			if f.wire != pbWireBytes {
+				continue
+			}
+			if f.num == 1 {
+				key = string(f.bytes)
+			} else if f.num == 2 {
+				value, err = protobufDecodeValue(f.bytes, depth+1)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		ret[key] = value
+	}
+	return ret, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+//slow consumer policy, what to do when client send queue is full
+const (
+	slowPolicyDrop       = "drop"        //drop the new msg
+	slowPolicyDropOldest = "drop-oldest" //drop the oldest queued msg, then queue the new one
+	slowPolicyDisconnect = "disconnect"  //close the client with reason slow_consumer
+)
+
+var gSlowConsumerDropped uint64
+var gSlowConsumerDropOldest uint64
+var gSlowConsumerDisconnect uint64
+
+func isValidSlowPolicy(policy string) bool {
+	return policy == slowPolicyDrop || policy == slowPolicyDropOldest || policy == slowPolicyDisconnect
+}
+
+//enqueue never block the caller, a stalled client can't hold the hub goroutines.
+//queueMu make sure sendChan is not closed while sending to it
+func (c *Client) enqueue(frame *outFrame) bool {
+	c.queueMu.Lock()
+	if atomic.LoadInt32(&c.closed) > 0 {
+		c.queueMu.Unlock()
+		return false
+	}
+	select {
+	case c.sendChan <- frame:
+		c.queueMu.Unlock()
+		return true
+	default:
+	}
+
+	switch gSlowPolicy {
+	case slowPolicyDrop:
+		c.queueMu.Unlock()
+		atomic.AddUint64(&gSlowConsumerDropped, 1)
+		atomic.AddUint64(&c.dropped, 1)
+		log.Warnf("client[%s] send queue full, drop new msg\n", c.Cid)
+		return false
+	case slowPolicyDropOldest:
+		//writePump may take one at the same time, then the select below just succeed
+		select {
+		case <-c.sendChan:
+			atomic.AddUint64(&gSlowConsumerDropOldest, 1)
+			atomic.AddUint64(&c.dropped, 1)
+		default:
+		}
+		select {
+		case c.sendChan <- frame:
+		default:
+			//still no room, the new msg is lost too and must not be counted as sent
+			c.queueMu.Unlock()
+			atomic.AddUint64(&gSlowConsumerDropped, 1)
+			atomic.AddUint64(&c.dropped, 1)
+			log.Warnf("client[%s] send queue full, drop new msg\n", c.Cid)
+			return false
+		}
+		c.queueMu.Unlock()
+		log.Warnf("client[%s] send queue full, drop oldest msg\n", c.Cid)
+		return true
+	}
+
+	c.queueMu.Unlock()
+	atomic.AddUint64(&gSlowConsumerDisconnect, 1)
+	atomic.AddUint64(&c.dropped, 1)
+	log.Warnf("client[%s] send queue full, disconnect slow consumer\n", c.Cid)
+	c.setOfflineReason(define.OfflineReasonSlowConsumer)
+	//close write to conn with deadline, don't do it in hub goroutine
+	go c.close()
+	return false
+}
+
+func (c *Client) setOfflineReason(reason string) {
+	c.offlineReason.Store(reason)
+}
+
+func (c *Client) getOfflineReason() string {
+	if reason, ok := c.offlineReason.Load().(string); ok {
+		return reason
+	}
+	return ""
+}
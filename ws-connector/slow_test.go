@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func testSlowClient(policy string, queue int) *Client {
+	_, clients, _ := newBenchHub(1, encodingJSON)
+	gSlowPolicy = policy
+	clients[0].sendChan = make(chan *outFrame, queue)
+	return clients[0]
+}
+
+func TestEnqueueDrop(t *testing.T) {
+	c := testSlowClient(slowPolicyDrop, 1)
+	first, _ := newOutFrame(encodingJSON, []byte(`1`))
+	second, _ := newOutFrame(encodingJSON, []byte(`2`))
+	dropped := atomic.LoadUint64(&gSlowConsumerDropped)
+	if !c.enqueue(first) || c.enqueue(second) {
+		t.Fatal("drop: second msg should be rejected")
+	}
+	if <-c.sendChan != first {
+		t.Fatal("drop: queued msg replaced")
+	}
+	if atomic.LoadUint64(&gSlowConsumerDropped) != dropped+1 || c.dropped != 1 {
+		t.Fatal("drop not counted")
+	}
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	c := testSlowClient(slowPolicyDropOldest, 1)
+	first, _ := newOutFrame(encodingJSON, []byte(`1`))
+	second, _ := newOutFrame(encodingJSON, []byte(`2`))
+	dropOldest := atomic.LoadUint64(&gSlowConsumerDropOldest)
+	if !c.enqueue(first) || !c.enqueue(second) {
+		t.Fatal("drop-oldest: new msg should be queued")
+	}
+	if <-c.sendChan != second {
+		t.Fatal("drop-oldest: oldest msg not dropped")
+	}
+	if atomic.LoadUint64(&gSlowConsumerDropOldest) != dropOldest+1 || c.dropped != 1 {
+		t.Fatal("drop oldest not counted")
+	}
+}
+
+//TestEnqueueDropOldestLost new msg that still finds no room is a drop, not sent
+func TestEnqueueDropOldestLost(t *testing.T) {
+	c := testSlowClient(slowPolicyDropOldest, 0)
+	frame, _ := newOutFrame(encodingJSON, []byte(`1`))
+	dropped := atomic.LoadUint64(&gSlowConsumerDropped)
+	sent := atomic.LoadUint64(&gBytesSent)
+	if c.enqueue(frame) {
+		t.Fatal("lost msg reported as queued")
+	}
+	c.sendFrame(frame)
+	if atomic.LoadUint64(&gSlowConsumerDropped) != dropped+2 || c.dropped != 2 {
+		t.Fatal("lost msg not counted as drop")
+	}
+	if atomic.LoadUint64(&gBytesSent) != sent {
+		t.Fatal("lost msg counted as sent")
+	}
+}
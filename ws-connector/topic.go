@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+const maxTopicLength = 128
+
+//subscribe add client's Cid to topics, index is by Cid so it survive reconnect with same Cid
+func (h *Hub) subscribe(c *Client, topics []string) {
+	newCidTopics := &sync.Map{}
+	cidTopics, _ := h.cidTopics.LoadOrStore(c.Cid, newCidTopics)
+	cidTopicsMap, ok := cidTopics.(*sync.Map)
+	if !ok {
+		return
+	}
+	count := 0
+	cidTopicsMap.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	for _, topic := range topics {
+		if len(topic) < 1 || len(topic) > maxTopicLength {
+			log.Infof("client[%s] subscribe invalid topic: %s\n", c.Cid, topic)
+			continue
+		}
+		if _, ok := cidTopicsMap.Load(topic); ok {
+			continue
+		}
+		if count >= gMaxTopics {
+			log.Infof("client[%s] subscribe too many topics, drop: %s\n", c.Cid, topic)
+			continue
+		}
+		count++
+		cidTopicsMap.Store(topic, struct{}{})
+		topicCids, _ := h.topics.LoadOrStore(topic, &sync.Map{})
+		if topicCidsMap, ok := topicCids.(*sync.Map); ok {
+			topicCidsMap.Store(c.Cid, struct{}{})
+		}
+	}
+	log.Infof("client[%s] subscribe topics: %v\n", c.Cid, topics)
+}
+
+func (h *Hub) unsubscribe(c *Client, topics []string) {
+	cidTopics, ok := h.cidTopics.Load(c.Cid)
+	if !ok {
+		return
+	}
+	if cidTopicsMap, ok := cidTopics.(*sync.Map); ok {
+		for _, topic := range topics {
+			cidTopicsMap.Delete(topic)
+			h.removeTopicCid(topic, c.Cid)
+		}
+	}
+	log.Infof("client[%s] unsubscribe topics: %v\n", c.Cid, topics)
+}
+
+func (h *Hub) removeTopicCid(topic string, cid string) {
+	topicCids, ok := h.topics.Load(topic)
+	if !ok {
+		return
+	}
+	if topicCidsMap, ok := topicCids.(*sync.Map); ok {
+		topicCidsMap.Delete(cid)
+		count := 0
+		topicCidsMap.Range(func(key, value interface{}) bool {
+			count++
+			return false
+		})
+		if count == 0 {
+			h.topics.Delete(topic)
+		}
+	}
+}
+
+//topicCids return Cids subscribed topic, include offline ones waiting reconnect
+func (h *Hub) topicCids(topic string) []string {
+	ret := make([]string, 0)
+	topicCids, ok := h.topics.Load(topic)
+	if !ok {
+		return ret
+	}
+	if topicCidsMap, ok := topicCids.(*sync.Map); ok {
+		topicCidsMap.Range(func(key, value interface{}) bool {
+			if cid, ok := key.(string); ok {
+				ret = append(ret, cid)
+			}
+			return true
+		})
+	}
+	return ret
+}
+
+func (h *Hub) publish(topic string, msg interface{}, target *define.TargetStruct) {
+	atomic.AddUint64(&gTotalTryPublish, 1)
+	h.outMsgHandlerPool.Add(&outMsg{
+		h:        h,
+		topic:    topic,
+		msg:      msg,
+		target:   target,
+		pushTime: time.Now(),
+	})
+}
+
+//runCleanTopics drop subscriptions of Cids which not reconnect in gSubKeepSeconds
+func (h *Hub) runCleanTopics() {
+	go func() {
+		ticker := time.NewTicker(time.Minute * 1)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				h.offlineCids.Range(func(key, value interface{}) bool {
+					cid, ok1 := key.(string)
+					offlineTime, ok2 := value.(time.Time)
+					if !ok1 || !ok2 {
+						h.offlineCids.Delete(key)
+						return true
+					}
+					if _, ok := h.clients.Load(cid); ok {
+						//reconnected, old client unregister after new one register
+						h.offlineCids.Delete(key)
+						return true
+					}
+					if now.Sub(offlineTime) < time.Second*time.Duration(gSubKeepSeconds) {
+						return true
+					}
+					h.offlineCids.Delete(key)
+					if cidTopics, ok := h.cidTopics.Load(cid); ok {
+						h.cidTopics.Delete(cid)
+						if cidTopicsMap, ok := cidTopics.(*sync.Map); ok {
+							cidTopicsMap.Range(func(key, value interface{}) bool {
+								if topic, ok := key.(string); ok {
+									h.removeTopicCid(topic, cid)
+								}
+								return true
+							})
+						}
+					}
+					return true
+				})
+			case <-h.hubClosed:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+//what to do when ws-token.verify call error or timeout
+const (
+	verifyPolicyOpen   = "open"   //let client connect
+	verifyPolicyClosed = "closed" //reject client
+	verifyPolicyGrace  = "grace"  //let client connect within gVerifyGraceSeconds after last successful verify
+)
+
+//max verify results kept in local cache
+const maxVerifyCacheSize = 100000
+
+var gRejectBusy uint64
+var gRejectParams uint64
+var gRejectInvalidToken uint64
+var gRejectVerifyError uint64
+var gVerifyCacheHit uint64
+var gVerifyErrorPass uint64
+
+type verifyCacheItem struct {
+	invalid  bool
+	expireAt time.Time
+}
+
+//TokenVerifier call ws-token.verify with local result cache and verify error policy
+type TokenVerifier struct {
+	cache        *sync.Map  //~= sync.Map[string(userID\nplatform\nversion\ntimestamp\ntoken)]*verifyCacheItem
+	cacheMtx     sync.Mutex //guard cache writes, so cacheSize is changed only by who really add or remove
+	cacheSize    int64
+	lastVerifyOK int64  //UnixNano of last successful ws-token.verify call
+	revokeGen    uint64 //add 1 on every ws-token.in.revoke, verify started before it must not cache valid
+	closed       chan int
+}
+
+func newTokenVerifier() *TokenVerifier {
+	v := &TokenVerifier{
+		cache:  &sync.Map{},
+		closed: make(chan int, 1),
+	}
+	if gVerifyCacheSeconds > 0 {
+		v.runCleanCache()
+	}
+	return v
+}
+
+//token is bound to userID/platform/version/timestamp, so all of them are part of the cache key
+func verifyCacheKey(v *define.VerifyTokenStruct) string {
+	return v.UserID + "\n" + v.Platform + "\n" + v.Version + "\n" + v.Timestamp + "\n" + v.Token
+}
+
+//verify return http status code 200 if client can connect, otherwise 403/503 and reason
+func (t *TokenVerifier) verify(verifyToken *define.VerifyTokenStruct) (int, string) {
+	key := verifyCacheKey(verifyToken)
+	if gVerifyCacheSeconds > 0 {
+		if item, ok := t.cache.Load(key); ok {
+			itemObj := item.(*verifyCacheItem)
+			if time.Now().Before(itemObj.expireAt) {
+				atomic.AddUint64(&gVerifyCacheHit, 1)
+				if itemObj.invalid {
+					atomic.AddUint64(&gRejectInvalidToken, 1)
+					return 403, "token is not valid"
+				}
+				return 200, ""
+			}
+		}
+	}
+
+	gen := atomic.LoadUint64(&t.revokeGen)
+	start := time.Now()
+	res, err := call(define.WsTokenActionVerify, verifyToken, nil)
+	gRPCStats.Observe(define.WsTokenActionVerify, start, err)
+	if err != nil {
+		return t.onVerifyError(verifyToken, err)
+	}
+	jsonObj := &define.VerifyTokenResultStruct{}
+	err = define.Decode(res, jsonObj)
+	if err != nil {
+		return t.onVerifyError(verifyToken, err)
+	}
+
+	atomic.StoreInt64(&t.lastVerifyOK, time.Now().UnixNano())
+	t.store(key, jsonObj.Invalid, gen)
+	if jsonObj.Invalid {
+		log.Warn("RPC ws-token.verify Invalid: ", verifyToken.String())
+		atomic.AddUint64(&gRejectInvalidToken, 1)
+		return 403, "token is not valid"
+	}
+	return 200, ""
+}
+
+func (t *TokenVerifier) onVerifyError(verifyToken *define.VerifyTokenStruct, err error) (int, string) {
+	switch gVerifyPolicy {
+	case verifyPolicyOpen:
+		log.Warnf("RPC ws-token.verify err: %v, policy[%s] allow client: %s_%s\n", err, gVerifyPolicy, verifyToken.UserID, verifyToken.Platform)
+		atomic.AddUint64(&gVerifyErrorPass, 1)
+		return 200, ""
+	case verifyPolicyGrace:
+		lastOK := atomic.LoadInt64(&t.lastVerifyOK)
+		if lastOK > 0 && time.Since(time.Unix(0, lastOK)) < time.Second*time.Duration(gVerifyGraceSeconds) {
+			log.Warnf("RPC ws-token.verify err: %v, policy[%s] allow client: %s_%s\n", err, gVerifyPolicy, verifyToken.UserID, verifyToken.Platform)
+			atomic.AddUint64(&gVerifyErrorPass, 1)
+			return 200, ""
+		}
+	}
+	log.Warnf("RPC ws-token.verify err: %v, policy[%s] reject client: %s_%s\n", err, gVerifyPolicy, verifyToken.UserID, verifyToken.Platform)
+	atomic.AddUint64(&gRejectVerifyError, 1)
+	return 503, "Service Unavailable: verify token"
+}
+
+//store result of a verify started at revokeGen gen
+func (t *TokenVerifier) store(key string, invalid bool, gen uint64) {
+	if gVerifyCacheSeconds < 1 {
+		return
+	}
+	item := &verifyCacheItem{
+		invalid:  invalid,
+		expireAt: time.Now().Add(time.Second * time.Duration(gVerifyCacheSeconds)),
+	}
+	t.cacheMtx.Lock()
+	if _, loaded := t.cache.Load(key); loaded {
+		t.cache.Store(key, item)
+	} else if atomic.LoadInt64(&t.cacheSize) < maxVerifyCacheSize {
+		t.cache.Store(key, item)
+		atomic.AddInt64(&t.cacheSize, 1)
+	}
+	t.cacheMtx.Unlock()
+	//a revoke came while ws-token.verify was running, its Range may have missed this item
+	if !invalid && atomic.LoadUint64(&t.revokeGen) != gen {
+		t.evict(key, item)
+	}
+}
+
+//evict remove key if it still holds item, return false if someone else already removed or replaced it
+func (t *TokenVerifier) evict(key interface{}, item interface{}) bool {
+	t.cacheMtx.Lock()
+	defer t.cacheMtx.Unlock()
+	if value, ok := t.cache.Load(key); !ok || value != item {
+		return false
+	}
+	t.cache.Delete(key)
+	atomic.AddInt64(&t.cacheSize, -1)
+	return true
+}
+
+//revoke evict cached valid results of revoked token, or of all tokens of revoked userID,
+//so they are verified by ws-token again on next connect
+func (t *TokenVerifier) revoke(r *define.RevokeTokenStruct) {
+	atomic.AddUint64(&t.revokeGen, 1)
+	evicted := 0
+	t.cache.Range(func(key, value interface{}) bool {
+		if value.(*verifyCacheItem).invalid {
+			return true
+		}
+		keyString := key.(string)
+		if (len(r.Token) > 0 && strings.HasSuffix(keyString, "\n"+r.Token)) ||
+			(len(r.UserID) > 0 && strings.HasPrefix(keyString, r.UserID+"\n")) {
+			if t.evict(key, value) {
+				evicted++
+			}
+		}
+		return true
+	})
+	log.Infof("TokenVerifier revoke token[%s] userID[%s], evicted %d cached results\n", r.Token, r.UserID, evicted)
+}
+
+//cleanCache evict items expired at now
+func (t *TokenVerifier) cleanCache(now time.Time) {
+	t.cache.Range(func(key, value interface{}) bool {
+		if now.After(value.(*verifyCacheItem).expireAt) {
+			t.evict(key, value)
+		}
+		return true
+	})
+}
+
+func (t *TokenVerifier) runCleanCache() {
+	go func() {
+		ticker := time.NewTicker(time.Second * 10)
+		for {
+			select {
+			case <-ticker.C:
+				t.cleanCache(time.Now())
+			case <-t.closed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (t *TokenVerifier) close() {
+	t.closed <- 1
+}
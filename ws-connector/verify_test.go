@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+	"github.com/sirupsen/logrus"
+)
+
+//stubVerify ws-token.verify answer invalid, or err when err != nil, return the call count
+func stubVerify(invalid *bool, err *error) *int64 {
+	var calls int64
+	call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		if *err != nil {
+			return nil, *err
+		}
+		return &define.VerifyTokenResultStruct{Invalid: *invalid}, nil
+	}
+	return &calls
+}
+
+//newTestVerifier TokenVerifier without the clean goroutine
+func newTestVerifier(policy string, cacheSeconds int) *TokenVerifier {
+	log.SetLevel(logrus.ErrorLevel)
+	gVerifyPolicy = policy
+	gVerifyGraceSeconds = 60
+	gVerifyCacheSeconds = cacheSeconds
+	return &TokenVerifier{
+		cache:  &sync.Map{},
+		closed: make(chan int, 1),
+	}
+}
+
+func testVerifyToken(userID string, token string) *define.VerifyTokenStruct {
+	return &define.VerifyTokenStruct{UserID: userID, Platform: "ios", Version: "1.0", Timestamp: "1500000000000", Token: token}
+}
+
+func TestVerifyPolicy(t *testing.T) {
+	invalid := false
+	var callErr error
+	stubVerify(&invalid, &callErr)
+	down := errors.New("timeout")
+
+	cases := []struct {
+		name     string
+		policy   string
+		lastOK   time.Duration //0: never verified ok, otherwise time since last ok
+		wantCode int
+	}{
+		{"open", verifyPolicyOpen, 0, 200},
+		{"closed", verifyPolicyClosed, time.Second, 503},
+		{"grace never ok", verifyPolicyGrace, 0, 503},
+		{"grace within", verifyPolicyGrace, time.Second * 30, 200},
+		{"grace expired", verifyPolicyGrace, time.Second * 61, 503},
+	}
+	for _, c := range cases {
+		v := newTestVerifier(c.policy, 0)
+		if c.lastOK > 0 {
+			v.lastVerifyOK = time.Now().Add(-c.lastOK).UnixNano()
+		}
+		callErr = down
+		if code, _ := v.verify(testVerifyToken("u1", "k1.a")); code != c.wantCode {
+			t.Errorf("%s: verify error got %d, want %d", c.name, code, c.wantCode)
+		}
+	}
+
+	//a successful verify starts the grace window
+	v := newTestVerifier(verifyPolicyGrace, 0)
+	callErr = nil
+	if code, _ := v.verify(testVerifyToken("u1", "k1.a")); code != 200 {
+		t.Fatalf("verify ok got %d", code)
+	}
+	callErr = down
+	if code, _ := v.verify(testVerifyToken("u2", "k1.b")); code != 200 {
+		t.Fatalf("grace after ok verify got %d", code)
+	}
+
+	//invalid token is always rejected, whatever the policy
+	callErr = nil
+	invalid = true
+	for _, policy := range []string{verifyPolicyOpen, verifyPolicyClosed, verifyPolicyGrace} {
+		v := newTestVerifier(policy, 0)
+		if code, _ := v.verify(testVerifyToken("u1", "k1.a")); code != 403 {
+			t.Errorf("%s: invalid token got %d, want 403", policy, code)
+		}
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	invalid := false
+	var callErr error
+	calls := stubVerify(&invalid, &callErr)
+
+	v := newTestVerifier(verifyPolicyClosed, 60)
+	for i := 0; i < 3; i++ {
+		if code, _ := v.verify(testVerifyToken("u1", "k1.a")); code != 200 {
+			t.Fatalf("verify %d got %d", i, code)
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("%d ws-token.verify calls for one cached token, want 1", *calls)
+	}
+
+	//every bound field is part of the key
+	other := testVerifyToken("u1", "k1.a")
+	other.Version = "1.1"
+	v.verify(other)
+	if *calls != 2 {
+		t.Fatalf("other version used cached result")
+	}
+
+	//invalid result is cached too
+	invalid = true
+	v.verify(testVerifyToken("u1", "k1.bad"))
+	invalid = false
+	if code, _ := v.verify(testVerifyToken("u1", "k1.bad")); code != 403 || *calls != 3 {
+		t.Fatalf("cached invalid got %d with %d calls", code, *calls)
+	}
+
+	//expired item is verified again
+	item, _ := v.cache.Load(verifyCacheKey(testVerifyToken("u1", "k1.a")))
+	item.(*verifyCacheItem).expireAt = time.Now().Add(-time.Second)
+	v.verify(testVerifyToken("u1", "k1.a"))
+	if *calls != 4 {
+		t.Fatalf("expired cache item not verified again")
+	}
+
+	//errors are not cached
+	callErr = errors.New("timeout")
+	v.verify(testVerifyToken("u9", "k1.err"))
+	callErr = nil
+	if code, _ := v.verify(testVerifyToken("u9", "k1.err")); code != 200 || *calls != 6 {
+		t.Fatalf("after error got %d with %d calls", code, *calls)
+	}
+
+	//-vc 0 never cache
+	v = newTestVerifier(verifyPolicyClosed, 0)
+	*calls = 0
+	v.verify(testVerifyToken("u1", "k1.a"))
+	v.verify(testVerifyToken("u1", "k1.a"))
+	if *calls != 2 {
+		t.Fatalf("cache disabled made %d calls, want 2", *calls)
+	}
+}
+
+func TestVerifyCacheMaxSize(t *testing.T) {
+	invalid := false
+	var callErr error
+	stubVerify(&invalid, &callErr)
+	v := newTestVerifier(verifyPolicyClosed, 60)
+	v.cacheSize = maxVerifyCacheSize - 1
+	v.verify(testVerifyToken("u1", "k1.a"))
+	v.verify(testVerifyToken("u2", "k1.b"))
+	if _, ok := v.cache.Load(verifyCacheKey(testVerifyToken("u2", "k1.b"))); ok {
+		t.Fatal("stored beyond maxVerifyCacheSize")
+	}
+	if v.cacheSize != maxVerifyCacheSize {
+		t.Fatalf("cacheSize %d", v.cacheSize)
+	}
+}
+
+func TestVerifyRevoke(t *testing.T) {
+	invalid := false
+	var callErr error
+	calls := stubVerify(&invalid, &callErr)
+	v := newTestVerifier(verifyPolicyClosed, 60)
+	tokens := []*define.VerifyTokenStruct{
+		testVerifyToken("u1", "k1.a"),
+		testVerifyToken("u1", "k1.b"),
+		testVerifyToken("u2", "k1.c"),
+		testVerifyToken("u10", "k1.d"),
+	}
+	for _, token := range tokens {
+		v.verify(token)
+	}
+	cached := func(token *define.VerifyTokenStruct) bool {
+		_, ok := v.cache.Load(verifyCacheKey(token))
+		return ok
+	}
+
+	v.revoke(&define.RevokeTokenStruct{Token: "k1.a"})
+	if cached(tokens[0]) || !cached(tokens[1]) || !cached(tokens[2]) {
+		t.Fatal("token revoke evicted wrong items")
+	}
+	v.revoke(&define.RevokeTokenStruct{UserID: "u1"})
+	if cached(tokens[1]) || !cached(tokens[2]) || !cached(tokens[3]) {
+		t.Fatal("user revoke evicted wrong items")
+	}
+	if v.cacheSize != 2 {
+		t.Fatalf("cacheSize %d after revoke, want 2", v.cacheSize)
+	}
+
+	//revoked token is verified by ws-token again
+	*calls = 0
+	invalid = true
+	if code, _ := v.verify(tokens[0]); code != 403 || *calls != 1 {
+		t.Fatalf("revoked token got %d with %d calls", code, *calls)
+	}
+}
+
+//TestVerifyRevokeDuringCall a valid result of a verify running when revoke came is not cached
+func TestVerifyRevokeDuringCall(t *testing.T) {
+	v := newTestVerifier(verifyPolicyClosed, 60)
+	var calls int64
+	call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		v.revoke(&define.RevokeTokenStruct{Token: "k1.a"})
+		return &define.VerifyTokenResultStruct{Invalid: false}, nil
+	}
+	if code, _ := v.verify(testVerifyToken("u1", "k1.a")); code != 200 {
+		t.Fatalf("verify got %d", code)
+	}
+	if _, ok := v.cache.Load(verifyCacheKey(testVerifyToken("u1", "k1.a"))); ok {
+		t.Fatal("result of verify running during revoke was cached")
+	}
+	if v.cacheSize != 0 {
+		t.Fatalf("cacheSize %d, want 0", v.cacheSize)
+	}
+}
+
+//TestVerifyCacheSizeConcurrentEvict revoke and clean evict the same items at once, each item is counted once
+func TestVerifyCacheSizeConcurrentEvict(t *testing.T) {
+	invalid := false
+	var callErr error
+	stubVerify(&invalid, &callErr)
+	for round := 0; round < 20; round++ {
+		v := newTestVerifier(verifyPolicyClosed, 60)
+		for i := 0; i < 200; i++ {
+			v.verify(testVerifyToken("u1", "k1."+strconv.Itoa(i)))
+		}
+		if v.cacheSize != 200 {
+			t.Fatalf("cacheSize %d after 200 verify", v.cacheSize)
+		}
+		expired := time.Now().Add(time.Minute * 2)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				v.revoke(&define.RevokeTokenStruct{UserID: "u1"})
+			}()
+			go func() {
+				defer wg.Done()
+				v.cleanCache(expired)
+			}()
+		}
+		wg.Wait()
+		if v.cacheSize != 0 {
+			t.Fatalf("round %d: cacheSize %d after evicting all, want 0", round, v.cacheSize)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"net"
@@ -11,18 +10,21 @@ import (
 	"os"
 	"runtime/pprof"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/json-iterator/go"
 	"golang.org/x/net/netutil"
 
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
 
 var gMoleculerService *moleculer.Service
 
+var call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+	return pBroker.Call(action, params, opts)
+}
+
 func createMoleculerService() moleculer.Service {
 	gMoleculerService = &moleculer.Service{
 		ServiceName: ServiceName,
@@ -31,17 +33,21 @@ func createMoleculerService() moleculer.Service {
 	}
 
 	//init actions handlers
-	gMoleculerService.Actions["push"] = actionPush
-	gMoleculerService.Actions["count"] = actionCount
-	gMoleculerService.Actions["metrics"] = actionMetrics
-	gMoleculerService.Actions["userInfo"] = actionUserInfo
+	gMoleculerService.Actions["push"] = define.TimedAction(gRPCStats, define.WsConnectorActionPush, actionPush)
+	gMoleculerService.Actions["count"] = define.TimedAction(gRPCStats, define.WsConnectorActionCount, actionCount)
+	gMoleculerService.Actions["metrics"] = define.TimedAction(gRPCStats, define.WsConnectorActionMetrics, actionMetrics)
+	gMoleculerService.Actions["userInfo"] = define.TimedAction(gRPCStats, define.WsConnectorActionUserInfo, actionUserInfo)
+	gMoleculerService.Actions["drain"] = define.TimedAction(gRPCStats, define.WsConnectorActionDrain, actionDrain)
+	gMoleculerService.Actions["rateLimit"] = define.TimedAction(gRPCStats, define.WsConnectorActionRateLimit, actionRateLimit)
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorInKickClient] = eventInKickClient
-	gMoleculerService.Events[cWsConnectorInKickUser] = eventInKickUser
-	gMoleculerService.Events[cWsConnectorInPush] = eventInPush
-	gMoleculerService.Events[cWsConnectorInSyncUsersInfo] = eventInSyncUsersInfo
-	gMoleculerService.Events[cWsConnectorInSyncMetrics] = eventInSyncMetrics
+	gMoleculerService.Events[define.WsConnectorInKickClient] = eventInKickClient
+	gMoleculerService.Events[define.WsConnectorInKickUser] = eventInKickUser
+	gMoleculerService.Events[define.WsConnectorInPush] = eventInPush
+	gMoleculerService.Events[define.WsConnectorInPublish] = eventInPublish
+	gMoleculerService.Events[define.WsConnectorInSyncUsersInfo] = eventInSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorInSyncMetrics] = eventInSyncMetrics
+	gMoleculerService.Events[define.WsTokenInRevoke] = eventWsTokenInRevoke
 
 	return *gMoleculerService
 }
@@ -65,20 +71,15 @@ func eventInSyncMetrics(req *protocol.MsEvent) {
 	log.Info("run eventInSyncMetrics")
 	metrics := gHub.metrics()
 	log.Info("run eventInSyncMetrics, metrics: ", metrics)
-	pBroker.Broadcast(cWsConnectorOutSyncMetrics, metrics)
+	pBroker.Broadcast(define.WsConnectorOutSyncMetrics, metrics)
 }
 
 func actionUserInfo(req *protocol.MsRequest) (interface{}, error) {
 	log.Info("run actionUserInfo, req.Params = ", req.Params)
-	jsonString, err := jsoniter.Marshal(req.Params)
-	if err != nil {
-		log.Warn("run eventInKick, parse req.Data to jsonString error: ", err)
-		return nil, errors.New("parse error")
-	}
-	jsonObj := &userIDStruct{}
-	err = jsoniter.Unmarshal(jsonString, jsonObj)
+	jsonObj := &define.UserIDStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run eventInKick, parse req.Data to jsonObj userIDStruct error: ", err)
+		log.Warn("run actionUserInfo, parse req.Params to jsonObj UserIDStruct error: ", err)
 		return nil, errors.New("parse error")
 	}
 	if len(jsonObj.UserID) > 0 {
@@ -87,22 +88,104 @@ func actionUserInfo(req *protocol.MsRequest) (interface{}, error) {
 	return nil, errors.New("userID error: " + jsonObj.UserID)
 }
 
+//mol $ call ws-connector.drain --windowSeconds 120
+//call it on one node with CallOptions NodeID
+func actionDrain(req *protocol.MsRequest) (interface{}, error) {
+	log.Warn("run actionDrain, req.Params = ", req.Params)
+	jsonObj := &define.DrainStruct{}
+	if req.Params != nil {
+		err := define.Decode(req.Params, jsonObj)
+		if err != nil {
+			log.Warn("run actionDrain, parse req.Params to jsonObj DrainStruct error: ", err)
+			return nil, errors.New("parse error")
+		}
+	}
+	window := gDrainSeconds
+	if jsonObj.WindowSeconds > 0 {
+		window = jsonObj.WindowSeconds
+	}
+	return gHub.drain(time.Second * time.Duration(window)), nil
+}
+
+//mol $ call ws-connector.rateLimit --rps 500 --burst 50
+//without rps return current limit
+func actionRateLimit(req *protocol.MsRequest) (interface{}, error) {
+	log.Warn("run actionRateLimit, req.Params = ", req.Params)
+	jsonObj := &define.RateLimitStruct{}
+	if req.Params != nil {
+		err := define.Decode(req.Params, jsonObj)
+		if err != nil {
+			log.Warn("run actionRateLimit, parse req.Params to jsonObj RateLimitStruct error: ", err)
+			return nil, errors.New("parse error")
+		}
+	}
+	if jsonObj.RPS < 1 {
+		return gHub.rateLimit(), nil
+	}
+	return gHub.setRateLimit(jsonObj.RPS, jsonObj.Burst), nil
+}
+
+//mol repl:
+//emit ws-connector.in.publish --topic news --data.mid m123 --data.msg.a hello
+func eventInPublish(req *protocol.MsEvent) {
+	log.Info("run eventInPublish, req.Data = ", req.Data)
+	jsonObj := &define.PublishStruct{}
+	err := define.Decode(req.Data, jsonObj)
+	if err != nil {
+		log.Warn("run eventInPublish, parse req.Data to jsonObj PublishStruct error: ", err)
+		return
+	}
+	if len(jsonObj.Topic) < 1 || jsonObj.Data == nil {
+		log.Info("run eventInPublish, topic or data is empty")
+		return
+	}
+	err = jsonObj.Target.Parse()
+	if err != nil {
+		log.Info("run eventInPublish, bad target: ", err)
+		return
+	}
+	jsonObj.Data.ApplyTTL(time.Now())
+	gHub.publish(jsonObj.Topic, jsonObj.Data, jsonObj.Target)
+}
+
+//emit ws-connector.in.syncUsersInfo --nodeID ws-connector-0
+//without nodeID every node sync
 func eventInSyncUsersInfo(req *protocol.MsEvent) {
-	log.Info("run eventInSyncUsersInfo")
+	log.Info("run eventInSyncUsersInfo, req.Data = ", req.Data)
+	jsonObj := &define.SyncUsersInfoStruct{}
+	if req.Data != nil {
+		err := define.Decode(req.Data, jsonObj)
+		if err != nil {
+			log.Warn("run eventInSyncUsersInfo, parse req.Data to jsonObj SyncUsersInfoStruct error: ", err)
+			return
+		}
+	}
+	if len(jsonObj.NodeID) > 0 && jsonObj.NodeID != gNodeID {
+		return
+	}
 	gHub.syncUsersInfo()
 }
 
-func eventInKickClient(req *protocol.MsEvent) {
-	log.Info("run eventInKickClient, req.Data = ", req.Data)
-	jsonString, err := jsoniter.Marshal(req.Data)
+//ws-token broadcast it on every revoke, drop cached verify results of revoked tokens
+func eventWsTokenInRevoke(req *protocol.MsEvent) {
+	log.Info("run eventWsTokenInRevoke, req.Data = ", req.Data)
+	jsonObj := &define.RevokeTokenStruct{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
-		log.Warn("run eventInKickClient, parse req.Data to jsonString error: ", err)
+		log.Warn("run eventWsTokenInRevoke, parse req.Data to jsonObj RevokeTokenStruct error: ", err)
 		return
 	}
-	jsonObj := &cidStruct{}
-	err = jsoniter.Unmarshal(jsonString, jsonObj)
+	if gTokenVerifier != nil {
+		gTokenVerifier.revoke(jsonObj)
+	}
+}
+
+func eventInKickClient(req *protocol.MsEvent) {
+	log.Info("run eventInKickClient, req.Data = ", req.Data)
+	jsonObj := &define.CidStruct{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
-		log.Warn("run eventInKickClient, parse req.Data to jsonObj cidStruct error: ", err)
+		log.Warn("run eventInKickClient, parse req.Data to jsonObj CidStruct error: ", err)
 		return
 	}
 	if len(jsonObj.Cid) > 0 {
@@ -112,15 +195,10 @@ func eventInKickClient(req *protocol.MsEvent) {
 
 func eventInKickUser(req *protocol.MsEvent) {
 	log.Info("run eventInKickUser, req.Data = ", req.Data)
-	jsonString, err := jsoniter.Marshal(req.Data)
+	jsonObj := &define.UserIDStruct{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
-		log.Warn("run eventInKickUser, parse req.Data to jsonString error: ", err)
-		return
-	}
-	jsonObj := &userIDStruct{}
-	err = jsoniter.Unmarshal(jsonString, jsonObj)
-	if err != nil {
-		log.Warn("run eventInKickUser, parse req.Data to jsonObj userIDStruct error: ", err)
+		log.Warn("run eventInKickUser, parse req.Data to jsonObj UserIDStruct error: ", err)
 		return
 	}
 	if len(jsonObj.UserID) > 0 {
@@ -131,39 +209,34 @@ func eventInKickUser(req *protocol.MsEvent) {
 func actionPush(req *protocol.MsRequest) (interface{}, error) {
 
 	log.Info("run actionPush, req.Params = ", req.Params)
-	jsonString, err := jsoniter.Marshal(req.Params)
+	jsonObj := &define.PushMsgStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run actionPush, parse req.Data to jsonString error: ", err)
+		log.Warn("run actionPush, parse req.Params to jsonObj error: ", err)
 		return nil, err
 	}
-	jsonObj := &pushMsgStruct{}
-	err = jsoniter.Unmarshal(jsonString, jsonObj)
+	log.Info("run actionPush, jsonObj = ", jsonObj)
+	observeSendToPush(jsonObj.SendTime)
+
+	if len(jsonObj.Msgs) > 0 {
+		return nil, gHub.sendBatch(jsonObj.Msgs)
+	}
+	ids, err := define.ParseIDs(jsonObj.IDs)
 	if err != nil {
-		log.Warn("run eventInPush, parse req.Data to jsonObj error: ", err)
+		log.Info("can't parse jsonObj.IDs")
 		return nil, err
 	}
-	log.Info("run eventInPush, jsonObj = ", jsonObj)
-
-	// log.Info("type:", reflect.TypeOf(jsonObj.IDs))
-
-	ids := make([]string, 0)
-	switch jsonObj.IDs.(type) {
-	case []string:
-		ids = jsonObj.IDs.([]string)
-	case []interface{}:
-		_ids := jsonObj.IDs.([]interface{})
-		for _, v := range _ids {
-			if sv, ok := v.(string); ok {
-				ids = append(ids, sv)
-			}
-		}
-	case string:
-		ids = strings.Split(jsonObj.IDs.(string), ",")
-	default:
-		log.Info("can't parse jsonObj.IDs")
-		return nil, errors.New("can't parse ids")
+	if jsonObj.Data == nil {
+		log.Info("run actionPush, data is empty")
+		return nil, errors.New("data is empty")
 	}
-	gHub.sendMessage(ids, jsonObj.Data)
+	err = jsonObj.Target.Parse()
+	if err != nil {
+		log.Info("run actionPush, bad target: ", err)
+		return nil, err
+	}
+	jsonObj.Data.ApplyTTL(time.Now())
+	gHub.sendMessage(ids, jsonObj.Data, jsonObj.Target)
 
 	return nil, nil
 }
@@ -173,38 +246,38 @@ func actionPush(req *protocol.MsRequest) (interface{}, error) {
 //emit ws-connector.in.push --ids utest-0 --Data.mid aaaabbbb --Data.msg.a hello --Data.msg.b 123 --Data.msg.c true
 func eventInPush(req *protocol.MsEvent) {
 	log.Info("run eventInPush, req.Data = ", req.Data)
-	jsonString, err := jsoniter.Marshal(req.Data)
-	if err != nil {
-		log.Warn("run eventInPush, parse req.Data to jsonString error: ", err)
-		return
-	}
-	jsonObj := &pushMsgStruct{}
-	err = jsoniter.Unmarshal(jsonString, jsonObj)
+	jsonObj := &define.PushMsgStruct{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
 		log.Warn("run eventInPush, parse req.Data to jsonObj error: ", err)
 		return
 	}
 	log.Info("run eventInPush, jsonObj = ", jsonObj)
+	observeSendToPush(jsonObj.SendTime)
 
-	// log.Info("type:", reflect.TypeOf(jsonObj.IDs))
-	ids := make([]string, 0)
-	switch jsonObj.IDs.(type) {
-	case []string:
-		ids = jsonObj.IDs.([]string)
-	case []interface{}:
-		_ids := jsonObj.IDs.([]interface{})
-		for _, v := range _ids {
-			if sv, ok := v.(string); ok {
-				ids = append(ids, sv)
-			}
+	if len(jsonObj.Msgs) > 0 {
+		err = gHub.sendBatch(jsonObj.Msgs)
+		if err != nil {
+			log.Info("run eventInPush, sendBatch err: ", err)
 		}
-	case string:
-		ids = strings.Split(jsonObj.IDs.(string), ",")
-	default:
+		return
+	}
+	ids, err := define.ParseIDs(jsonObj.IDs)
+	if err != nil {
 		log.Info("can't parse jsonObj.IDs")
 		return
 	}
-	gHub.sendMessage(ids, jsonObj.Data)
+	if jsonObj.Data == nil {
+		log.Info("run eventInPush, data is empty")
+		return
+	}
+	err = jsonObj.Target.Parse()
+	if err != nil {
+		log.Info("run eventInPush, bad target: ", err)
+		return
+	}
+	jsonObj.Data.ApplyTTL(time.Now())
+	gHub.sendMessage(ids, jsonObj.Data, jsonObj.Target)
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -220,59 +293,6 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "home.html")
 }
 
-//TODO: change this salt in PRODUCTION
-const sha256salt string = "d9cd5e3663eefbe5868e903cc68f895bd849b3bb374b2aa0cff80bb16cb4e63d"
-
-func genSha1String(s string) string {
-	h := sha1.New()
-	h.Write([]byte(s))
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-func gettoken(w http.ResponseWriter, r *http.Request) {
-	queryValues := r.URL.Query()
-
-	log.Printf("gettoken queryValues = %v", queryValues)
-	if len(queryValues) < 1 {
-		w.WriteHeader(401)
-		w.Write([]byte("Need Query Values in URL"))
-		return
-	}
-	userID := queryValues.Get("userID")
-	if len(userID) < 1 {
-		w.WriteHeader(401)
-		w.Write([]byte("Need Query Values [userID] in URL"))
-		return
-	}
-	platform := queryValues.Get("platform")
-	if len(platform) < 1 {
-		w.WriteHeader(401)
-		w.Write([]byte("Need Query Values [platform] in URL"))
-		return
-	}
-	version := queryValues.Get("version")
-	if len(version) < 1 {
-		w.WriteHeader(401)
-		w.Write([]byte("Need Query Values [version] in URL"))
-		return
-	}
-	timestamp := strconv.Itoa(int(time.Now().UnixNano() / 1e6))
-
-	encodeString := userID + platform + version + timestamp + sha256salt
-	genToken := genSha1String(encodeString)
-	w.WriteHeader(200)
-	data, err := jsoniter.Marshal(map[string]interface{}{
-		"timestamp": timestamp,
-		"token":     genToken,
-	})
-	if err != nil {
-		log.Error("gettoken: Marshal data err: ", err)
-		w.WriteHeader(500)
-		return
-	}
-	w.Write(data)
-}
-
 // var gClientID uint64
 
 // serveWs handles websocket requests from the peer.
@@ -287,9 +307,17 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
+	if isDraining() {
+		atomic.AddUint64(&gRejectDraining, 1)
+		w.WriteHeader(503)
+		w.Write([]byte("Service Unavailable: Draining"))
+		return
+	}
+
 	//max concurrenty accept new webscoket 500
 	if atomic.LoadInt64(&gCurrentAccepting) > maxConcurrentAccept {
 		log.Warn("Too Busy: gCurrentAccepting = ", gCurrentAccepting)
+		atomic.AddUint64(&gRejectBusy, 1)
 		w.WriteHeader(503)
 		w.Write([]byte("Service Unavailable: Busy"))
 		return
@@ -301,12 +329,14 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("serveWs queryValues = %v", queryValues)
 	if len(queryValues) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values in URL"))
 		return
 	}
 	userID := queryValues.Get("userID")
 	if len(userID) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values [userID] in URL"))
 		return
@@ -314,6 +344,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	platform := queryValues.Get("platform")
 	if len(platform) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values [platform] in URL"))
 		return
@@ -321,6 +352,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	version := queryValues.Get("version")
 	if len(version) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values [version] in URL"))
 		return
@@ -328,6 +360,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	timestamp := queryValues.Get("timestamp")
 	if len(timestamp) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values [timestamp] in URL"))
 		return
@@ -335,15 +368,14 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 
 	token := queryValues.Get("token")
 	if len(token) < 1 {
+		atomic.AddUint64(&gRejectParams, 1)
 		w.WriteHeader(401)
 		w.Write([]byte("Need Query Values [token] in URL"))
 		return
 	}
 
-	//only if ws-token.verify return invalid == true to reject client
-	//request timeout or error , default let it pass
-
-	verifyToken := &verifyTokenStruct{
+	//ws-token.verify error or timeout is handled by gVerifyPolicy
+	verifyToken := &define.VerifyTokenStruct{
 		URL:       r.URL.String(),
 		UserID:    userID,
 		Platform:  platform,
@@ -351,36 +383,21 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		Timestamp: timestamp,
 		Token:     token,
 	}
-	// res, err := pBroker.Call("pushConnector.verify", verifyToken, nil)
-	res, err := pBroker.Call(cWsTokenActionVerify, verifyToken, nil)
-	if err == nil {
-		jsonByte, err := jsoniter.Marshal(res)
-		if err == nil {
-			jsonObj := &verifyTokenResultStruct{}
-			err := jsoniter.Unmarshal(jsonByte, jsonObj)
-			if err == nil {
-				if jsonObj.Invalid {
-					log.Warn("RPC ws-token.verify Invalid: ", verifyToken.String())
-					w.WriteHeader(403)
-					w.Write([]byte("token is not valid"))
-					return
-				}
-			}
-		}
-	} else {
-		// log.Warn("RPC ws-token.verify err: ", err)
-		// log.Warn("RPC ws-token.verify err, default allow client connection: ", userID+"_"+platform)
+	if code, reason := gTokenVerifier.verify(verifyToken); code != 200 {
+		w.WriteHeader(code)
+		w.Write([]byte(reason))
+		return
 	}
 
-	// encodeString := userID + platform + version + timestamp + sha256salt
-	// genToken := genSha1String(encodeString)
-	// if token != genToken {
-	// 	w.WriteHeader(403)
-	// 	w.Write([]byte("token is not valid"))
-	// 	return
-	// }
+	encoding, err := negotiateEncoding(r)
+	if err != nil {
+		atomic.AddUint64(&gRejectParams, 1)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	//TODO: just parse id and platform from token, validate token, return fail
+	compress := clientCompress(r, platform)
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -389,6 +406,14 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		// log.Println(err)
 		return
 	}
+	//default level of the conn is 1, set gCompressLevel so frames match what deflatedSize counts
+	if compress {
+		err = conn.SetCompressionLevel(gCompressLevel)
+		if err != nil {
+			log.Warnf("websocket SetCompressionLevel(%d) err: %v, disable compression for client\n", gCompressLevel, err)
+			compress = false
+		}
+	}
 
 	// atomic.AddUint64(&gClientID, 1)
 	// log.Warn("websocket connection times: ", atomic.LoadUint64(&gClientID))
@@ -403,9 +428,12 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		Token:          token,
 		ConnectTime:    strconv.Itoa(int(time.Now().UnixNano() / 1e6)),
 		DisconnectTime: "0",
+		connSeq:        atomic.AddUint64(&gConnSeq, 1),
 		hub:            hub,
+		encoding:       encoding,
+		compress:       compress,
 		conn:           conn,
-		sendChan:       make(chan []byte, 10),
+		sendChan:       make(chan *outFrame, gSendQueue),
 		sendPongChan:   make(chan int, 10),
 	}
 	gHub.register(client)
@@ -417,12 +445,12 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 }
 
 func startWsService() {
+	gTokenVerifier = newTokenVerifier()
 	gHub = newHub()
 	gHub.run()
+	upgrader.EnableCompression = gCompress > 0
+	startPromService()
 	// http.HandleFunc("/", serveHome)
-	// http.HandleFunc("/gettoken", func(w http.ResponseWriter, r *http.Request) {
-	// 	gettoken(w, r)
-	// })
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(gHub, w, r)
 	})
@@ -460,4 +488,7 @@ func stopWsService() {
 	if gHub != nil {
 		gHub.close()
 	}
+	if gTokenVerifier != nil {
+		gTokenVerifier.close()
+	}
 }
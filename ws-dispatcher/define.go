@@ -36,53 +36,3 @@ const (
 )
 
 type gCmdType uint32
-
-const (
-	cWsConnectorActionCount      = "count"
-	cWsConnectorActionMetrics    = "metrics"
-	cWsConnectorActionUserInfo   = "userInfo"
-	cWsConnectorInPush           = "ws-connector.in.push"
-	cWsConnectorInKickClient     = "ws-connector.in.kickClient"
-	cWsConnectorInKickUser       = "ws-connector.in.kickUser"
-	cWsConnectorOutOnline        = "ws-connector.out.online"
-	cWsConnectorOutOffline       = "ws-connector.out.offline"
-	cWsConnectorInSyncUsersInfo  = "ws-connector.in.syncUsersInfo"
-	cWsConnectorOutSyncUsersInfo = "ws-connector.out.syncUsersInfo"
-	cWsConnectorOutAck           = "ws-connector.out.ack"
-	cWsConnectorInSyncMetrics    = "ws-connector.in.syncMetrics"
-	cWsConnectorOutSyncMetrics   = "ws-connector.out.syncMetrics"
-
-	cWsTokenActionVerify = "ws-token.verify"
-
-	cWsOnlineActionUserInfo = "userInfo"
-	cWsOnlineOutOnline      = "ws-online.out.online"
-	cWsOnlineOutOffline     = "ws-online.out.offline"
-)
-
-type ackStruct struct {
-	Aid    string `json:"aid"`
-	Cid    string `json:"cid"`
-	UserID string `json:"userID"`
-}
-
-type pushMsgStruct struct {
-	IDs  interface{} `json:"ids"`
-	Data interface{} `json:"data"`
-}
-
-type pushMsgDataStruct struct {
-	Mid string      `json:"mid"`
-	Msg interface{} `json:"msg"`
-}
-
-type kickClientStruct struct {
-	Cid string `json:"cid"`
-}
-
-type kickUserStruct struct {
-	UserID string `json:"userID"`
-}
-
-type getUserOnlineInfoStruct struct {
-	UserID string `json:"userID"`
-}
@@ -4,6 +4,7 @@ import (
 
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
@@ -18,12 +19,12 @@ func createMoleculerService() moleculer.Service {
 	}
 
 	//init actions handlers
-	gMoleculerService.Actions[cWsOnlineActionUserInfo] = actionUserInfo
+	gMoleculerService.Actions["userInfo"] = actionUserInfo
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutOnline] = eventWsConnectorOutOnline
-	gMoleculerService.Events[cWsConnectorOutOffline] = eventWsConnectorOutOffline
-	gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutOnline] = eventWsConnectorOutOnline
+	gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
 
 	return *gMoleculerService
 }
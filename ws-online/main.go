@@ -109,7 +109,7 @@ var upgrader = websocket.Upgrader{
 }
 
 func usage() {
-	log.Fatalf("Usage: ws-online [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-a AbandonMinutes (30)] [-y SyncDelaySeconds (30)] \n")
+	log.Fatalf("Usage: ws-online [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-a AbandonMinutes (30)] [-y SyncDelaySeconds (30)] [-mp PromPort (0)] [-ht HeartbeatTimeoutSeconds (15)] \n")
 }
 
 var gCloseChan chan int
@@ -127,6 +127,8 @@ func main() {
 	_gSyncDelaySeconds := flag.Int("y", 30, "sync userInfo from ws-connector after 30s delay")
 	_gIsDebug := flag.Int("d", 0, "is debug")
 	_gWriteLogToFile := flag.Int("wf", 0, "write log to file")
+	_gPromPort := flag.Int("mp", 0, "prometheus /metrics http port, 0 to disable")
+	_gHeartbeatTimeoutSeconds := flag.Int("ht", 15, "expire clients of ws-connector without heartbeat for 15s")
 	// _gTestCount := flag.Int("c", 1, "test send message RPS")
 	// _gTestUserName := flag.String("u", "gotest-user-", "TestUserName prefix")
 	// _gTestUserNameRange := flag.Int("ur", 9999, "TestUserName range")
@@ -139,6 +141,8 @@ func main() {
 	gSyncDelaySeconds = *_gSyncDelaySeconds
 	gIsDebug = *_gIsDebug
 	gWriteLogToFile = *_gWriteLogToFile
+	gPromPort = *_gPromPort
+	gHeartbeatTimeoutSeconds = *_gHeartbeatTimeoutSeconds
 	// gTestCount = *_gTestCount
 	// gTestUserName = *_gTestUserName
 	// gTestUserNameRange = *_gTestUserNameRange
@@ -151,6 +155,8 @@ func main() {
 
 	gNodeID += "-" + strconv.Itoa(gID)
 	log.Warnf("gNodeID : %v\n", gNodeID)
+	log.Warnf("gPromPort : %v\n", gPromPort)
+	log.Warnf("gHeartbeatTimeoutSeconds : %v\n", gHeartbeatTimeoutSeconds)
 
 	//init service and broker
 	config := &moleculer.ServiceBrokerConfig{
@@ -174,6 +180,8 @@ func main() {
 		return
 	}
 
+	startPromService()
+
 	log.Warn("================= Server Started ================= ")
 
 	closer.Hold()
@@ -183,6 +191,7 @@ func cleanupFunc() {
 	log.Infof("Hang on! %s is closing ...", AppName)
 	log.Warn("=================== exit start =================== ")
 	gShortOnlineHub.Close()
+	gNodeHub.Close()
 	time.Sleep(time.Second * 1)
 	log.Warn("=================== exit end   =================== ")
 	log.Infof("%s is closed", AppName)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/roytan883/moleculer-go/protocol"
+)
+
+var gTotalHeartbeat uint64
+var gTotalNodeLapsed uint64
+var gTotalNodeResync uint64
+var gTotalExpiredByNode uint64
+
+type nodeState struct {
+	nodeID        string
+	epoch         string
+	clients       int64
+	interval      time.Duration
+	lastHeartbeat time.Time
+	lapsed        bool
+}
+
+var gNodeHub *NodeHub
+
+//NodeHub ws-connector nodes by heartbeat. Clients of a node whose heartbeat lapses
+//(killed with fast exit, partitioned from NATS) are expired, a returning node is asked to resync
+type NodeHub struct {
+	mtx       sync.Mutex
+	nodes     map[string]*nodeState
+	startTime time.Time
+	hubClosed chan int
+}
+
+func newNodeHub() *NodeHub {
+	return &NodeHub{
+		nodes:     make(map[string]*nodeState),
+		startTime: time.Now(),
+		hubClosed: make(chan int, 1),
+	}
+}
+
+func eventWsConnectorOutHeartbeat(req *protocol.MsEvent) {
+	log.Info("run eventWsConnectorOutHeartbeat, req.Data = ", req.Data)
+	atomic.AddUint64(&gTotalHeartbeat, 1)
+	heartbeat := &define.HeartbeatStruct{}
+	err := define.Decode(req.Data, heartbeat)
+	if err != nil {
+		log.Warn("run eventWsConnectorOutHeartbeat, parse req.Data to HeartbeatStruct error: ", err)
+		return
+	}
+	if len(heartbeat.NodeID) < 1 || len(heartbeat.Epoch) < 1 {
+		return
+	}
+	gNodeHub.onHeartbeat(heartbeat)
+}
+
+func (h *NodeHub) onHeartbeat(heartbeat *define.HeartbeatStruct) {
+	now := time.Now()
+	resync := false
+	restarted := false
+	h.mtx.Lock()
+	node, ok := h.nodes[heartbeat.NodeID]
+	if !ok {
+		node = &nodeState{nodeID: heartbeat.NodeID}
+		h.nodes[heartbeat.NodeID] = node
+		//startup sync asked every node, a node first seen after that may have missed it
+		resync = now.Sub(h.startTime) > time.Second*time.Duration(gSyncDelaySeconds)
+	} else {
+		if node.lapsed {
+			resync = true
+		}
+		if node.epoch != heartbeat.Epoch {
+			restarted = true
+			resync = true
+		}
+	}
+	node.epoch = heartbeat.Epoch
+	node.clients = heartbeat.Clients
+	node.interval = time.Second * time.Duration(heartbeat.IntervalSeconds)
+	node.lastHeartbeat = now
+	node.lapsed = false
+	h.mtx.Unlock()
+
+	if restarted {
+		//clients connected before the new epoch were on the old process, their offline events are lost
+		epochTime, _ := define.ParseTimestamp(heartbeat.Epoch)
+		expired := expireNodeClients(heartbeat.NodeID, define.OfflineReasonNodeRestarted, epochTime)
+		log.Warnf("NodeHub node[%s] restarted, epoch = %s, expired clients = %d\n", heartbeat.NodeID, heartbeat.Epoch, expired)
+	}
+	if resync {
+		log.Warnf("NodeHub node[%s] back, ask it to resync users info\n", heartbeat.NodeID)
+		atomic.AddUint64(&gTotalNodeResync, 1)
+		pBroker.Broadcast(define.WsConnectorInSyncUsersInfo, &define.SyncUsersInfoStruct{NodeID: heartbeat.NodeID})
+	}
+}
+
+//timeout node lapses after gHeartbeatTimeoutSeconds, or 3 of its heartbeat intervals if longer
+func (node *nodeState) timeout() time.Duration {
+	timeout := time.Second * time.Duration(gHeartbeatTimeoutSeconds)
+	if node.interval*3 > timeout {
+		timeout = node.interval * 3
+	}
+	return timeout
+}
+
+func (h *NodeHub) checkNodes(now time.Time) {
+	lapsed := make([]string, 0)
+	h.mtx.Lock()
+	for nodeID, node := range h.nodes {
+		if !node.lapsed && now.Sub(node.lastHeartbeat) > node.timeout() {
+			node.lapsed = true
+			lapsed = append(lapsed, nodeID)
+		}
+	}
+	h.mtx.Unlock()
+	for _, nodeID := range lapsed {
+		atomic.AddUint64(&gTotalNodeLapsed, 1)
+		expired := expireNodeClients(nodeID, define.OfflineReasonNodeLapsed, time.Time{})
+		log.Warnf("NodeHub node[%s] heartbeat lapsed, expired clients = %d\n", nodeID, expired)
+	}
+}
+
+//expireNodeClients mark online clients of nodeID offline now, before not zero only clients connected before it
+func expireNodeClients(nodeID string, reason string, before time.Time) int {
+	expired := make([]*define.ClientInfo, 0)
+	gShortOnlineHub.Users.Range(func(key, value interface{}) bool {
+		if userInfoObj, ok := value.(*UserInfo); ok {
+			userInfoObj.Clients.Range(func(key, value interface{}) bool {
+				if clientInfo, ok := value.(*define.ClientInfo); ok && clientInfo.IsOnline && clientInfo.NodeID == nodeID {
+					if !before.IsZero() {
+						connectTime, ok := define.ParseTimestamp(clientInfo.ConnectTime)
+						if ok && !connectTime.Before(before) {
+							return true
+						}
+					}
+					expired = append(expired, clientInfo)
+				}
+				return true
+			})
+		}
+		return true
+	})
+	now := define.Timestamp(time.Now())
+	for _, clientInfo := range expired {
+		offlineInfo := *clientInfo
+		offlineInfo.DisconnectTime = now
+		offlineInfo.Reason = reason
+		updateClientInfo(&offlineInfo, true)
+	}
+	atomic.AddUint64(&gTotalExpiredByNode, uint64(len(expired)))
+	return len(expired)
+}
+
+//nodeCounts alive and lapsed nodes
+func (h *NodeHub) nodeCounts() (alive int, lapsed int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, node := range h.nodes {
+		if node.lapsed {
+			lapsed++
+		} else {
+			alive++
+		}
+	}
+	return
+}
+
+//nodeClients clients count of alive nodes in their last heartbeat
+func (h *NodeHub) nodeClients() map[string]int64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	ret := make(map[string]int64)
+	for nodeID, node := range h.nodes {
+		if !node.lapsed {
+			ret[nodeID] = node.clients
+		}
+	}
+	return ret
+}
+
+//Close ...
+func (h *NodeHub) Close() {
+	h.hubClosed <- 1
+}
+
+func (h *NodeHub) runCheckNodes() {
+	go func() {
+		ticker := time.NewTicker(time.Second * 1)
+		for {
+			select {
+			case now := <-ticker.C:
+				h.checkNodes(now)
+			case <-h.hubClosed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+var gRPCStats = &define.RPCStats{}
+
+//startPromService serve /metrics on gPromPort, 0 to disable
+func startPromService() {
+	err := define.StartPromService(gPromPort, writeProm)
+	if err != nil {
+		log.Warnf("metrics http port[%d] listen err, /metrics disabled: %v\n", gPromPort, err)
+	}
+}
+
+func writeProm(p *define.PromWriter) {
+	var users int
+	online := make(map[string]int)
+	offline := make(map[string]int)
+	gShortOnlineHub.Users.Range(func(key, value interface{}) bool {
+		users++
+		if userInfoObj, ok := value.(*UserInfo); ok {
+			userInfoObj.Clients.Range(func(key, value interface{}) bool {
+				if clientInfo, ok := value.(*define.ClientInfo); ok {
+					if clientInfo.IsOnline {
+						online[clientInfo.Platform]++
+					} else {
+						offline[clientInfo.Platform]++
+					}
+				}
+				return true
+			})
+		}
+		return true
+	})
+	var abandon int
+	gShortOnlineHub.AbandonUsers.Range(func(key, value interface{}) bool {
+		abandon++
+		return true
+	})
+
+	p.Gauge("ws_online_users", "short online users (online, or offline less than AbandonMinutes)", float64(users))
+	for _, platform := range define.SortedKeys(online) {
+		p.Gauge("ws_online_clients", "clients by platform and state", float64(online[platform]), "platform", platform, "state", "online")
+	}
+	for _, platform := range define.SortedKeys(offline) {
+		p.Gauge("ws_online_clients", "clients by platform and state", float64(offline[platform]), "platform", platform, "state", "offline")
+	}
+	p.Gauge("ws_online_abandon_pending", "offline clients waiting to be abandoned", float64(abandon))
+
+	p.Counter("ws_online_events_total", "ws-connector events by type", float64(atomic.LoadUint64(&gTotalOnlineEvent)), "event", define.WsConnectorOutOnline)
+	p.Counter("ws_online_events_total", "", float64(atomic.LoadUint64(&gTotalOfflineEvent)), "event", define.WsConnectorOutOffline)
+	p.Counter("ws_online_events_total", "", float64(atomic.LoadUint64(&gTotalSyncEvent)), "event", define.WsConnectorOutSyncUsersInfo)
+	p.Counter("ws_online_bad_client_info_total", "events with invalid ClientInfo", float64(atomic.LoadUint64(&gTotalBadClientInfo)))
+	p.Counter("ws_online_stale_client_info_total", "ClientInfo events older than the stored one of their Cid", float64(atomic.LoadUint64(&gTotalStaleClientInfo)))
+	p.Counter("ws_online_events_total", "", float64(atomic.LoadUint64(&gTotalHeartbeat)), "event", define.WsConnectorOutHeartbeat)
+
+	alive, lapsed := gNodeHub.nodeCounts()
+	p.Gauge("ws_online_nodes", "ws-connector nodes by heartbeat state", float64(alive), "state", "alive")
+	p.Gauge("ws_online_nodes", "", float64(lapsed), "state", "lapsed")
+	nodeClients := gNodeHub.nodeClients()
+	nodeIDs := make([]string, 0, len(nodeClients))
+	for nodeID := range nodeClients {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		p.Gauge("ws_online_node_clients", "clients of alive ws-connector in its last heartbeat", float64(nodeClients[nodeID]), "node", nodeID)
+	}
+	p.Counter("ws_online_node_lapsed_total", "ws-connector heartbeat lapses", float64(atomic.LoadUint64(&gTotalNodeLapsed)))
+	p.Counter("ws_online_node_resync_total", "targeted syncUsersInfo asked from returning ws-connector", float64(atomic.LoadUint64(&gTotalNodeResync)))
+	p.Counter("ws_online_expired_clients_total", "clients expired because their node lapsed or restarted", float64(atomic.LoadUint64(&gTotalExpiredByNode)))
+
+	gRPCStats.WriteProm(p, "ws_online")
+}
@@ -3,20 +3,25 @@ package main
 import (
 	"errors"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
 	"sync"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
 
 var gMoleculerService *moleculer.Service
 
+//broadcast pBroker.Broadcast, replaced in tests
+var broadcast = func(event string, data interface{}) {
+	pBroker.Broadcast(event, data)
+}
+
 func createMoleculerService() moleculer.Service {
 	gMoleculerService = &moleculer.Service{
 		ServiceName: ServiceName,
@@ -25,13 +30,14 @@ func createMoleculerService() moleculer.Service {
 	}
 
 	//init actions handlers
-	gMoleculerService.Actions["onlineStatus"] = actionOnlineStatus
-	gMoleculerService.Actions["onlineStatusBulk"] = actionOnlineStatusBulk
+	gMoleculerService.Actions["onlineStatus"] = define.TimedAction(gRPCStats, define.WsOnlineActionOnlineStatus, actionOnlineStatus)
+	gMoleculerService.Actions["onlineStatusBulk"] = define.TimedAction(gRPCStats, define.WsOnlineActionOnlineStatusBulk, actionOnlineStatusBulk)
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutOnline] = eventWsConnectorOutOnline
-	gMoleculerService.Events[cWsConnectorOutOffline] = eventWsConnectorOutOffline
-	gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutOnline] = eventWsConnectorOutOnline
+	gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutHeartbeat] = eventWsConnectorOutHeartbeat
 
 	gShortOnlineHub = &ShortOnlineHub{
 		Users:        &sync.Map{},
@@ -40,8 +46,11 @@ func createMoleculerService() moleculer.Service {
 	}
 	gShortOnlineHub.runCheckAbandonUsers()
 
+	gNodeHub = newNodeHub()
+	gNodeHub.runCheckNodes()
+
 	time.AfterFunc(time.Second*time.Duration(gSyncDelaySeconds), func() {
-		pBroker.Broadcast(cWsConnectorInSyncUsersInfo, nil)
+		pBroker.Broadcast(define.WsConnectorInSyncUsersInfo, nil)
 	})
 
 	return *gMoleculerService
@@ -63,40 +72,23 @@ func actionOnlineStatus(req *protocol.MsRequest) (interface{}, error) {
 //mol $ call ws-online.onlineStatusBulk --ids gotest-user-0,gotest-user-1
 func actionOnlineStatusBulk(req *protocol.MsRequest) (interface{}, error) {
 
-	jsonByte, err := jsoniter.Marshal(req.Params)
-	if err != nil {
-		log.Warn("run actionOnlineStatusBulk, parse req.Data to jsonByte error: ", err)
-		return nil, err
-	}
-	jsonObj := &idsStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
+	jsonObj := &define.IDsStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run actionOnlineStatusBulk, parse req.Data to jsonObj idsStruct error: ", err)
+		log.Warn("run actionOnlineStatusBulk, parse req.Params to jsonObj IDsStruct error: ", err)
 		return nil, err
 	}
 
 	log.Info("run actionOnlineStatusBulk jsonObj.IDs: ", jsonObj.IDs)
 
-	ids := make([]string, 0)
-	switch jsonObj.IDs.(type) {
-	case []string:
-		ids = jsonObj.IDs.([]string)
-	case []interface{}:
-		_ids := jsonObj.IDs.([]interface{})
-		for _, v := range _ids {
-			if sv, ok := v.(string); ok {
-				ids = append(ids, sv)
-			}
-		}
-	case string:
-		ids = strings.Split(jsonObj.IDs.(string), ",")
-	default:
+	ids, err := define.ParseIDs(jsonObj.IDs)
+	if err != nil {
 		log.Info("can't parse jsonObj.IDs")
-		return nil, errors.New("can't parse ids")
+		return nil, err
 	}
 
-	onlineStatusBulk := &onlineStatusBulkStruct{
-		OnlineStatusBulk: make([]*onlineStatusStruct, 0),
+	onlineStatusBulk := &define.OnlineStatusBulkStruct{
+		OnlineStatusBulk: make([]*define.OnlineStatusStruct, 0),
 	}
 	for _, userID := range ids {
 		onlineStatus := getOnlineStatus(userID)
@@ -106,19 +98,19 @@ func actionOnlineStatusBulk(req *protocol.MsRequest) (interface{}, error) {
 	return onlineStatusBulk, nil
 }
 
-func getOnlineStatus(userID string) *onlineStatusStruct {
-	onlineStatus := &onlineStatusStruct{
+func getOnlineStatus(userID string) *define.OnlineStatusStruct {
+	onlineStatus := &define.OnlineStatusStruct{
 		UserID:          userID,
-		RealOnlineInfos: make([]*ClientInfo, 0),
+		RealOnlineInfos: make([]*define.ClientInfo, 0),
 	}
 
 	if userInfo, ok := gShortOnlineHub.Users.Load(userID); ok {
 		onlineStatus.IsShortOnline = true
 		userInfoObj, ok := userInfo.(*UserInfo)
 		if ok {
-			realOnlineInfos := make([]*ClientInfo, 0)
+			realOnlineInfos := make([]*define.ClientInfo, 0)
 			userInfoObj.Clients.Range(func(key, value interface{}) bool {
-				if clientInfo, ok := value.(*ClientInfo); ok {
+				if clientInfo, ok := value.(*define.ClientInfo); ok {
 					if clientInfo.IsOnline {
 						onlineStatus.IsRealOnline = true
 					}
@@ -133,15 +125,10 @@ func getOnlineStatus(userID string) *onlineStatusStruct {
 }
 
 func parseUserID(req *protocol.MsRequest) string {
-	jsonByte, err := jsoniter.Marshal(req.Params)
+	jsonObj := &define.UserIDStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run parseUserID, parse req.Data to jsonByte error: ", err)
-		return ""
-	}
-	jsonObj := &userIDStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
-	if err != nil {
-		log.Warn("run parseUserID, parse req.Data to jsonObj userIDStruct error: ", err)
+		log.Warn("run parseUserID, parse req.Params to jsonObj UserIDStruct error: ", err)
 		return ""
 	}
 	return jsonObj.UserID
@@ -149,16 +136,19 @@ func parseUserID(req *protocol.MsRequest) string {
 
 func eventWsConnectorOutOffline(req *protocol.MsEvent) {
 	log.Info("run eventWsConnectorOutOffline")
+	atomic.AddUint64(&gTotalOfflineEvent, 1)
 	handlerClientInfo(req)
 }
 
 func eventWsConnectorOutOnline(req *protocol.MsEvent) {
 	log.Info("run eventWsConnectorOutOnline")
+	atomic.AddUint64(&gTotalOnlineEvent, 1)
 	handlerClientInfo(req)
 }
 
 func eventWsConnectorOutSyncUsersInfo(req *protocol.MsEvent) {
 	log.Info("run eventWsConnectorOutSyncUsersInfo")
+	atomic.AddUint64(&gTotalSyncEvent, 1)
 	handlerClientInfo(req)
 }
 
@@ -167,9 +157,10 @@ type UserInfo struct {
 	UserID          string
 	LastOnlineTime  time.Time
 	LastOfflineTime time.Time
-	LastClientInfo  *ClientInfo
-	Clients         *sync.Map //~= sync.Map[string(Cid)]*ClientInfo //only real online clientInfos
+	LastClientInfo  *define.ClientInfo
+	Clients         *sync.Map //~= sync.Map[string(Cid)]*define.ClientInfo //only real online clientInfos
 
+	mtx sync.Mutex //serialize updates of the user, events of a Cid may be handled out of order
 }
 
 var gShortOnlineHub *ShortOnlineHub
@@ -182,21 +173,23 @@ type ShortOnlineHub struct {
 }
 
 func handlerClientInfo(req *protocol.MsEvent) {
-	jsonByte, err := jsoniter.Marshal(req.Data)
-	if err != nil {
-		log.Warn("handlerClientInfo, parse req.Data to jsonByte error: ", err)
-		return
-	}
-	clientInfo := &ClientInfo{}
-	err = jsoniter.Unmarshal(jsonByte, clientInfo)
+	clientInfo := &define.ClientInfo{}
+	err := define.Decode(req.Data, clientInfo)
 	if err != nil {
 		log.Warn("handlerClientInfo, parse req.Data to ClientInfo error: ", err)
+		atomic.AddUint64(&gTotalBadClientInfo, 1)
 		return
 	}
 	if clientInfo == nil || len(clientInfo.NodeID) < 1 || len(clientInfo.Cid) < 1 || len(clientInfo.UserID) < 1 || len(clientInfo.ConnectTime) < 1 || len(clientInfo.DisconnectTime) < 1 {
+		atomic.AddUint64(&gTotalBadClientInfo, 1)
 		return
 	}
+	updateClientInfo(clientInfo, false)
+}
 
+//updateClientInfo store clientInfo of an event, or built by ws-online when expiring a node (force).
+//clientInfo older than the stored one of its Cid is stale and dropped, force only overrides the same event
+func updateClientInfo(clientInfo *define.ClientInfo, force bool) {
 	onlineTimestamp, err := strconv.Atoi(clientInfo.ConnectTime)
 	if err != nil {
 		log.Warn("handlerClientInfo, parseclientInfo.ConnectTime error: ", err)
@@ -227,10 +220,23 @@ func handlerClientInfo(req *protocol.MsEvent) {
 		return
 	}
 
+	userInfoObj.mtx.Lock()
+	defer userInfoObj.mtx.Unlock()
+
+	if old, ok := userInfoObj.Clients.Load(clientInfo.Cid); ok {
+		oldInfo, ok := old.(*define.ClientInfo)
+		if ok && !clientInfo.NewerThan(oldInfo) && !(force && clientInfo.SameEvent(oldInfo)) {
+			atomic.AddUint64(&gTotalStaleClientInfo, 1)
+			log.Infof("handlerClientInfo drop stale clientInfo[%s] epoch[%s] connSeq[%d] seq[%d], stored epoch[%s] connSeq[%d] seq[%d]\n",
+				clientInfo.Cid, clientInfo.Epoch, clientInfo.ConnSeq, clientInfo.Seq, oldInfo.Epoch, oldInfo.ConnSeq, oldInfo.Seq)
+			return
+		}
+	}
+
 	log.Infof("handlerClientInfo userInfoObj = %+v\n", userInfoObj)
 
 	if !isOld && isOnline {
-		pBroker.Broadcast(cWsOnlineOutOnline, clientInfo)
+		broadcast(define.WsOnlineOutOnline, clientInfo)
 	}
 
 	userInfoObj.LastClientInfo = clientInfo
@@ -238,7 +244,7 @@ func handlerClientInfo(req *protocol.MsEvent) {
 	if isOnline {
 		userInfoObj.LastOnlineTime = newUserInfo.LastOnlineTime
 		userInfoObj.Clients.Store(clientInfo.Cid, clientInfo)
-		gShortOnlineHub.AbandonUsers.Delete(userInfoObj.UserID)
+		gShortOnlineHub.AbandonUsers.Delete(clientInfo.Cid)
 	} else {
 		userInfoObj.LastOfflineTime = newUserInfo.LastOfflineTime
 		userInfoObj.Clients.Store(clientInfo.Cid, clientInfo)
@@ -269,7 +275,7 @@ func handlerClientInfo(req *protocol.MsEvent) {
 	// log.Infof("handlerClientInfo newUserInfo Clients %+v", userInfoObj.Clients)
 
 	userInfoObj.Clients.Range(func(key, value interface{}) bool {
-		clientInfoObj, ok := value.(*ClientInfo)
+		clientInfoObj, ok := value.(*define.ClientInfo)
 		if ok {
 			log.Infof("handlerClientInfo userInfoObj.clientInfoObj = %+v\n", clientInfoObj)
 		}
@@ -312,7 +318,7 @@ func (h *ShortOnlineHub) runCheckAbandonUsers() {
 									})
 									if !hasOtherClients {
 										gShortOnlineHub.Users.Delete(abandon.UserID)
-										pBroker.Broadcast(cWsOnlineOutOffline, userInfoObj.LastClientInfo)
+										pBroker.Broadcast(define.WsOnlineOutOffline, userInfoObj.LastClientInfo)
 									}
 								}
 							}
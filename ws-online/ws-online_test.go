@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+//resetHub fresh gShortOnlineHub, broadcasts are counted instead of sent
+func resetHub() *sync.Map {
+	log = logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	gShortOnlineHub = &ShortOnlineHub{
+		Users:        &sync.Map{},
+		AbandonUsers: &sync.Map{},
+		hubClosed:    make(chan int, 1),
+	}
+	broadcasts := &sync.Map{}
+	broadcast = func(event string, data interface{}) {
+		count, _ := broadcasts.LoadOrStore(event, new(uint64))
+		atomic.AddUint64(count.(*uint64), 1)
+	}
+	return broadcasts
+}
+
+//presenceStream events of every Cid as ws-connector sends them: per node and epoch connections
+//get increasing ConnSeq, each connection sends online, some syncs and, except the last one, offline.
+//node-1 restarts once. last is the newest event of each Cid
+func presenceStream() (events []*define.ClientInfo, last map[string]*define.ClientInfo) {
+	last = make(map[string]*define.ClientInfo)
+	nodes := []struct {
+		nodeID string
+		epochs []int64
+	}{
+		{"ws-connector-0", []int64{1500000000000}},
+		{"ws-connector-1", []int64{1500000000000, 1500000900000}},
+	}
+	platforms := []string{"ios", "android", "web"}
+	for _, node := range nodes {
+		for _, epoch := range node.epochs {
+			connSeq := uint64(0)
+			for u := 0; u < 4; u++ {
+				userID := fmt.Sprintf("user-%d", u)
+				for _, platform := range platforms {
+					cid := userID + "_" + platform + "_" + node.nodeID
+					for conn := 0; conn < 3; conn++ {
+						connSeq++
+						connectTime := epoch + int64(connSeq)*1000
+						base := define.ClientInfo{
+							NodeID:         node.nodeID,
+							Cid:            cid,
+							UserID:         userID,
+							Platform:       platform,
+							ConnectTime:    strconv.FormatInt(connectTime, 10),
+							DisconnectTime: "0",
+							Epoch:          strconv.FormatInt(epoch, 10),
+							ConnSeq:        connSeq,
+						}
+						seq := uint64(0)
+						add := func(info define.ClientInfo) {
+							seq++
+							info.Seq = seq
+							events = append(events, &info)
+							last[cid] = &info
+						}
+						add(base) //online
+						for s := 0; s < conn; s++ {
+							add(base) //syncUsersInfo
+						}
+						if conn < 2 || platform == "web" {
+							offline := base
+							offline.DisconnectTime = strconv.FormatInt(connectTime+500, 10)
+							add(offline)
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func checkFinalState(t *testing.T, last map[string]*define.ClientInfo) {
+	for cid, want := range last {
+		userInfo, ok := gShortOnlineHub.Users.Load(want.UserID)
+		if !ok {
+			t.Fatalf("user %s not stored", want.UserID)
+		}
+		got, ok := userInfo.(*UserInfo).Clients.Load(cid)
+		if !ok {
+			t.Fatalf("client %s not stored", cid)
+		}
+		gotInfo := got.(*define.ClientInfo)
+		if !gotInfo.SameEvent(want) {
+			t.Fatalf("client %s: got epoch %s connSeq %d seq %d, want epoch %s connSeq %d seq %d",
+				cid, gotInfo.Epoch, gotInfo.ConnSeq, gotInfo.Seq, want.Epoch, want.ConnSeq, want.Seq)
+		}
+		wantOnline := want.DisconnectTime == "0"
+		if gotInfo.IsOnline != wantOnline {
+			t.Fatalf("client %s: got IsOnline %v, want %v", cid, gotInfo.IsOnline, wantOnline)
+		}
+		_, abandoned := gShortOnlineHub.AbandonUsers.Load(cid)
+		if abandoned == wantOnline {
+			t.Fatalf("client %s: abandoned %v, online %v", cid, abandoned, wantOnline)
+		}
+	}
+}
+
+func TestShuffledPresenceFinalState(t *testing.T) {
+	events, last := presenceStream()
+	for seed := int64(1); seed <= 200; seed++ {
+		resetHub()
+		shuffled := append([]*define.ClientInfo(nil), events...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		for _, info := range shuffled {
+			handlerClientInfo(&protocol.MsEvent{Data: info})
+		}
+		checkFinalState(t, last)
+	}
+}
+
+func TestConcurrentPresenceFinalState(t *testing.T) {
+	events, last := presenceStream()
+	for seed := int64(1); seed <= 20; seed++ {
+		resetHub()
+		shuffled := append([]*define.ClientInfo(nil), events...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		wg := sync.WaitGroup{}
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(shuffled); i += 8 {
+					handlerClientInfo(&protocol.MsEvent{Data: shuffled[i]})
+				}
+			}(w)
+		}
+		wg.Wait()
+		checkFinalState(t, last)
+	}
+}
+
+func TestStalePresenceDropped(t *testing.T) {
+	broadcasts := resetHub()
+	online := &define.ClientInfo{
+		NodeID: "ws-connector-0", Cid: "user-0_ios_ws-connector-0", UserID: "user-0", Platform: "ios",
+		ConnectTime: "1500000001000", DisconnectTime: "0", Epoch: "1500000000000", ConnSeq: 1, Seq: 1,
+	}
+	offline := *online
+	offline.DisconnectTime = "1500000002000"
+	offline.Seq = 2
+
+	handlerClientInfo(&protocol.MsEvent{Data: &offline})
+	handlerClientInfo(&protocol.MsEvent{Data: online})
+	checkFinalState(t, map[string]*define.ClientInfo{online.Cid: &offline})
+	if _, ok := broadcasts.Load(define.WsOnlineOutOnline); ok {
+		t.Fatal("stale online event broadcast ws-online.out.online")
+	}
+}
+
+func TestExpiredClientIgnoresStaleSync(t *testing.T) {
+	resetHub()
+	online := &define.ClientInfo{
+		NodeID: "ws-connector-0", Cid: "user-0_ios_ws-connector-0", UserID: "user-0", Platform: "ios",
+		ConnectTime: define.Timestamp(time.Now().Add(-time.Minute)), DisconnectTime: "0", Epoch: "1500000000000", ConnSeq: 1, Seq: 2,
+	}
+	handlerClientInfo(&protocol.MsEvent{Data: online})
+	if expired := expireNodeClients(online.NodeID, define.OfflineReasonNodeLapsed, time.Time{}); expired != 1 {
+		t.Fatalf("expired %d clients, want 1", expired)
+	}
+
+	//a delayed sync sent before the node lapsed must not bring the client back
+	syncInfo := *online
+	syncInfo.Seq = 1
+	handlerClientInfo(&protocol.MsEvent{Data: &syncInfo})
+	userInfo, _ := gShortOnlineHub.Users.Load(online.UserID)
+	got, _ := userInfo.(*UserInfo).Clients.Load(online.Cid)
+	if gotInfo := got.(*define.ClientInfo); gotInfo.IsOnline || gotInfo.Reason != define.OfflineReasonNodeLapsed {
+		t.Fatalf("got IsOnline %v reason %q, want offline %q", gotInfo.IsOnline, gotInfo.Reason, define.OfflineReasonNodeLapsed)
+	}
+
+	//the node was alive after all, its next sync is newer
+	syncInfo.Seq = 3
+	handlerClientInfo(&protocol.MsEvent{Data: &syncInfo})
+	got, _ = userInfo.(*UserInfo).Clients.Load(online.Cid)
+	if !got.(*define.ClientInfo).IsOnline {
+		t.Fatal("newer sync after expiry not accepted")
+	}
+}
@@ -16,12 +16,23 @@ var gFastExit int
 var gIsDebug int
 var gWriteLogToFile int
 var gNodeID = AppName
+var gPromPort int
 var gWaitAckSeconds int
+var gLedgerSeconds int
+var gDeliveredEvent int
+var gRetryMaxAttempts int
+var gRetryMaxBackoffSeconds int
 
 func initFlag() {
 	_gUrls := flag.String("s", nats.DefaultURL, "The nats server URLs (separated by comma, default localhost:4222)")
 	_gID := flag.Int("i", 0, "ID of the service on this machine")
 	_gWaitAckSeconds := flag.Int("w", 10, "wait 10s ack")
+	_gRetryMaxAttempts := flag.Int("ra", 3, "max push attempts before move to ws-cache")
+	_gRetryMaxBackoffSeconds := flag.Int("rb", 60, "max wait ack seconds between retries")
+	_gLedgerSeconds := flag.Int("l", 1800, "keep delivery state 1800s, then expire not acked")
+	_gDeliveredEvent := flag.Int("de", 0, "broadcast ws-sender.out.delivered when acked")
+
+	_gPromPort := flag.Int("mp", 0, "prometheus /metrics http port, 0 to disable")
 
 	_gFastExit := flag.Int("fe", 0, "fast exit")
 	_gIsDebug := flag.Int("d", 0, "is debug")
@@ -36,8 +47,13 @@ func initFlag() {
 	gIsDebug = *_gIsDebug
 	gFastExit = *_gFastExit
 	gWriteLogToFile = *_gWriteLogToFile
+	gPromPort = *_gPromPort
 
 	gWaitAckSeconds = *_gWaitAckSeconds
+	gRetryMaxAttempts = *_gRetryMaxAttempts
+	gRetryMaxBackoffSeconds = *_gRetryMaxBackoffSeconds
+	gLedgerSeconds = *_gLedgerSeconds
+	gDeliveredEvent = *_gDeliveredEvent
 
 	gNatsHosts = strings.Split(gUrls, ",")
 
@@ -52,5 +68,10 @@ func printFlag() {
 	log.Warnf("gNodeID : %v\n", gNodeID)
 	log.Warnf("gUrls : %v\n", gUrls)
 	log.Warnf("gNatsHosts : %v\n", gNatsHosts)
+	log.Warnf("gPromPort : %v\n", gPromPort)
 	log.Warnf("gWaitAckSeconds : %v\n", gWaitAckSeconds)
+	log.Warnf("gRetryMaxAttempts : %v\n", gRetryMaxAttempts)
+	log.Warnf("gRetryMaxBackoffSeconds : %v\n", gRetryMaxBackoffSeconds)
+	log.Warnf("gLedgerSeconds : %v\n", gLedgerSeconds)
+	log.Warnf("gDeliveredEvent : %v\n", gDeliveredEvent)
 }
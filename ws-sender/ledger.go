@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+type deliveryEntry struct {
+	UserID     string
+	Cid        string
+	State      string
+	UpdateTime time.Time
+}
+
+type midLedger struct {
+	mtx        sync.Mutex
+	createTime time.Time
+	entries    map[string]*deliveryEntry //~= map[string(UserID.Cid)]*deliveryEntry
+}
+
+var gDeliveryLedger *DeliveryLedger
+
+//DeliveryLedger keeps delivery state of every (mid, userID, cid) for gLedgerSeconds
+type DeliveryLedger struct {
+	mids      *sync.Map //~= sync.Map[string(Mid)]*midLedger
+	hubClosed chan int
+}
+
+func isFinalDeliveryState(state string) bool {
+	return state == define.DeliveryStateAcked || state == define.DeliveryStateExpired
+}
+
+func (l *DeliveryLedger) getMidLedger(mid string) *midLedger {
+	newMidLedger := &midLedger{
+		createTime: time.Now(),
+		entries:    make(map[string]*deliveryEntry),
+	}
+	one, _ := l.mids.LoadOrStore(mid, newMidLedger)
+	return one.(*midLedger)
+}
+
+//update move (mid, userID, cid) to state, acked and expired are final
+func (l *DeliveryLedger) update(mid string, userID string, cid string, state string) {
+	m := l.getMidLedger(mid)
+	key := userID + "." + cid
+	m.mtx.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &deliveryEntry{
+			UserID: userID,
+			Cid:    cid,
+		}
+		m.entries[key] = entry
+	} else if isFinalDeliveryState(entry.State) {
+		m.mtx.Unlock()
+		return
+	}
+	entry.State = state
+	entry.UpdateTime = time.Now()
+	m.mtx.Unlock()
+}
+
+//acked move an entry of this ws-sender to acked. Acks are broadcast to every ws-sender,
+//acks of msgs this one never sent (or client made up mids) are ignored and create nothing
+func (l *DeliveryLedger) acked(mid string, userID string, cid string) bool {
+	one, ok := l.mids.Load(mid)
+	if !ok {
+		return false
+	}
+	m := one.(*midLedger)
+	m.mtx.Lock()
+	entry, ok := m.entries[userID+"."+cid]
+	if !ok || isFinalDeliveryState(entry.State) {
+		m.mtx.Unlock()
+		return false
+	}
+	entry.State = define.DeliveryStateAcked
+	entry.UpdateTime = time.Now()
+	status := entryToStatus(mid, entry)
+	m.mtx.Unlock()
+
+	if gDeliveredEvent > 0 {
+		broadcast(define.WsSenderOutDelivered, status)
+	}
+	return true
+}
+
+//sending start a new round of delivery for (mid, userID, cid):
+//cached entries of this user become redelivered, otherwise a new pending entry
+func (l *DeliveryLedger) sending(mid string, userID string, cid string) {
+	m := l.getMidLedger(mid)
+	key := userID + "." + cid
+	now := time.Now()
+	m.mtx.Lock()
+	for _, entry := range m.entries {
+		if entry.UserID == userID && entry.State == define.DeliveryStateCached {
+			entry.State = define.DeliveryStateRedelivered
+			entry.UpdateTime = now
+		}
+	}
+	if _, ok := m.entries[key]; !ok {
+		m.entries[key] = &deliveryEntry{
+			UserID:     userID,
+			Cid:        cid,
+			State:      define.DeliveryStatePending,
+			UpdateTime: now,
+		}
+	}
+	m.mtx.Unlock()
+}
+
+//pushed only move pending to pushed, redelivered entries keep their state until acked
+func (l *DeliveryLedger) pushed(mid string, userID string, cid string) {
+	m := l.getMidLedger(mid)
+	m.mtx.Lock()
+	if entry, ok := m.entries[userID+"."+cid]; ok && entry.State == define.DeliveryStatePending {
+		entry.State = define.DeliveryStatePushed
+		entry.UpdateTime = time.Now()
+	}
+	m.mtx.Unlock()
+}
+
+func (l *DeliveryLedger) status(mid string, userID string) *define.MsgStatusStruct {
+	ret := &define.MsgStatusStruct{
+		Mid:        mid,
+		Recipients: make([]*define.DeliveryStatusStruct, 0),
+	}
+	one, ok := l.mids.Load(mid)
+	if !ok {
+		return ret
+	}
+	m := one.(*midLedger)
+	m.mtx.Lock()
+	for _, entry := range m.entries {
+		if len(userID) > 0 && entry.UserID != userID {
+			continue
+		}
+		ret.Recipients = append(ret.Recipients, entryToStatus(mid, entry))
+	}
+	m.mtx.Unlock()
+	return ret
+}
+
+func entryToStatus(mid string, entry *deliveryEntry) *define.DeliveryStatusStruct {
+	return &define.DeliveryStatusStruct{
+		Mid:        mid,
+		UserID:     entry.UserID,
+		Cid:        entry.Cid,
+		State:      entry.State,
+		UpdateTime: strconv.Itoa(int(entry.UpdateTime.UnixNano() / 1e6)),
+	}
+}
+
+//expire not final entries after gLedgerSeconds, forget the mid after 2 * gLedgerSeconds
+func (l *DeliveryLedger) expire(now time.Time) {
+	ledgerTime := time.Second * time.Duration(gLedgerSeconds)
+	l.mids.Range(func(key, value interface{}) bool {
+		m := value.(*midLedger)
+		diff := now.Sub(m.createTime)
+		//keep final states for another gLedgerSeconds so producers can query it
+		if diff > ledgerTime*2 {
+			l.mids.Delete(key)
+			return true
+		}
+		if diff > ledgerTime {
+			m.mtx.Lock()
+			for _, entry := range m.entries {
+				if !isFinalDeliveryState(entry.State) {
+					entry.State = define.DeliveryStateExpired
+					entry.UpdateTime = now
+				}
+			}
+			m.mtx.Unlock()
+		}
+		return true
+	})
+}
+
+func (l *DeliveryLedger) run() {
+	go func() {
+		ticker := time.NewTicker(time.Minute * 1)
+		for {
+			select {
+			case now := <-ticker.C:
+				l.expire(now)
+			case <-l.hubClosed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+//stubDelivered count ws-sender.out.delivered broadcasts
+func stubDelivered() *[]*define.DeliveryStatusStruct {
+	gDeliveredEvent = 1
+	mtx := sync.Mutex{}
+	delivered := make([]*define.DeliveryStatusStruct, 0)
+	broadcast = func(event string, data interface{}) {
+		if event == define.WsSenderOutDelivered {
+			mtx.Lock()
+			delivered = append(delivered, data.(*define.DeliveryStatusStruct))
+			mtx.Unlock()
+		}
+	}
+	return &delivered
+}
+
+func ledgerState(t *testing.T, mid string, cid string) string {
+	for _, recipient := range gDeliveryLedger.status(mid, "").Recipients {
+		if recipient.Cid == cid {
+			return recipient.State
+		}
+	}
+	return ""
+}
+
+func TestLedgerTransitions(t *testing.T) {
+	type step struct {
+		op    string //sending, pushed, cached, acked, expired
+		cid   string
+		want  string //state of cid after op
+		event bool   //ws-sender.out.delivered broadcast
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"push then ack", []step{
+			{"sending", "c1", define.DeliveryStatePending, false},
+			{"pushed", "c1", define.DeliveryStatePushed, false},
+			{"acked", "c1", define.DeliveryStateAcked, true},
+			{"acked", "c1", define.DeliveryStateAcked, false},
+		}},
+		{"ack before pushed", []step{
+			{"sending", "c1", define.DeliveryStatePending, false},
+			{"acked", "c1", define.DeliveryStateAcked, true},
+			{"pushed", "c1", define.DeliveryStateAcked, false},
+		}},
+		{"acked is final", []step{
+			{"sending", "c1", define.DeliveryStatePending, false},
+			{"acked", "c1", define.DeliveryStateAcked, true},
+			{"cached", "c1", define.DeliveryStateAcked, false},
+			{"expired", "c1", define.DeliveryStateAcked, false},
+		}},
+		{"cached then redelivered", []step{
+			{"cached", "c1", define.DeliveryStateCached, false},
+			{"sending", "c2", define.DeliveryStatePending, false},
+			{"pushed", "c1", define.DeliveryStateRedelivered, false},
+			{"acked", "c1", define.DeliveryStateAcked, true},
+		}},
+		{"expired is final", []step{
+			{"sending", "c1", define.DeliveryStatePending, false},
+			{"expired", "c1", define.DeliveryStateExpired, false},
+			{"acked", "c1", define.DeliveryStateExpired, false},
+		}},
+		{"ack of other cid", []step{
+			{"sending", "c1", define.DeliveryStatePending, false},
+			{"acked", "c9", "", false},
+		}},
+	}
+	for _, c := range cases {
+		resetHubs()
+		delivered := stubDelivered()
+		for i, s := range c.steps {
+			before := len(*delivered)
+			switch s.op {
+			case "sending":
+				gDeliveryLedger.sending("m1", "u1", s.cid)
+			case "pushed":
+				gDeliveryLedger.pushed("m1", "u1", s.cid)
+			case "cached":
+				gDeliveryLedger.update("m1", "u1", s.cid, define.DeliveryStateCached)
+			case "expired":
+				gDeliveryLedger.update("m1", "u1", s.cid, define.DeliveryStateExpired)
+			case "acked":
+				gDeliveryLedger.acked("m1", "u1", s.cid)
+			}
+			if got := ledgerState(t, "m1", s.cid); got != s.want {
+				t.Fatalf("%s step %d %s %s: state %q, want %q", c.name, i, s.op, s.cid, got, s.want)
+			}
+			if event := len(*delivered) > before; event != s.event {
+				t.Fatalf("%s step %d %s %s: delivered event %v, want %v", c.name, i, s.op, s.cid, event, s.event)
+			}
+		}
+	}
+}
+
+//TestLedgerIgnoresUnknownAck acks of mids this ws-sender never sent create nothing and broadcast nothing
+func TestLedgerIgnoresUnknownAck(t *testing.T) {
+	resetHubs()
+	delivered := stubDelivered()
+	for _, mid := range []string{"not-sent", "client-made-up", ""} {
+		eventWsConnectorOutAck(ackEvent(mid, "u1", "c1"))
+	}
+	count := 0
+	gDeliveryLedger.mids.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != 0 || len(*delivered) != 0 {
+		t.Fatalf("unknown acks created %d ledger mids and %d delivered events", count, len(*delivered))
+	}
+}
+
+func TestLedgerAckEventOnce(t *testing.T) {
+	resetHubs()
+	delivered := stubDelivered()
+	gDeliveryLedger.sending("m1", "u1", "c1")
+	gLocalSaveHub.save("u1", "c1", "node-0", &define.PushMsgDataStruct{Mid: "m1"}, resolveRetry(nil), nil, time.Now())
+	for i := 0; i < 3; i++ {
+		eventWsConnectorOutAck(ackEvent("m1", "u1", "c1"))
+	}
+	if len(*delivered) != 1 || (*delivered)[0].State != define.DeliveryStateAcked {
+		t.Fatalf("got %d delivered events, want 1 acked", len(*delivered))
+	}
+}
+
+func TestLedgerExpire(t *testing.T) {
+	resetHubs()
+	gLedgerSeconds = 60
+	gDeliveryLedger.sending("m1", "u1", "c1")
+	gDeliveryLedger.sending("m1", "u1", "c2")
+	gDeliveryLedger.acked("m1", "u1", "c2")
+
+	now := time.Now()
+	gDeliveryLedger.expire(now.Add(time.Second * 30))
+	if got := ledgerState(t, "m1", "c1"); got != define.DeliveryStatePending {
+		t.Fatalf("expired before gLedgerSeconds: %s", got)
+	}
+	gDeliveryLedger.expire(now.Add(time.Second * 61))
+	if got := ledgerState(t, "m1", "c1"); got != define.DeliveryStateExpired {
+		t.Fatalf("not acked state %s after gLedgerSeconds, want %s", got, define.DeliveryStateExpired)
+	}
+	if got := ledgerState(t, "m1", "c2"); got != define.DeliveryStateAcked {
+		t.Fatalf("acked state %s after gLedgerSeconds, want %s", got, define.DeliveryStateAcked)
+	}
+	gDeliveryLedger.expire(now.Add(time.Second * 121))
+	if len(gDeliveryLedger.status("m1", "").Recipients) != 0 {
+		t.Fatal("mid kept after 2 * gLedgerSeconds")
+	}
+}
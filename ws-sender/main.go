@@ -8,7 +8,7 @@ import (
 )
 
 func usage() {
-	log.Fatalf("Usage: ws-online [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-w WaitAckSeconds (10)] [-fe FastExit (0)] [-wf WriteLogToFile (0)]\n")
+	log.Fatalf("Usage: ws-online [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-w WaitAckSeconds (10)] [-ra RetryMaxAttempts (3)] [-rb RetryMaxBackoffSeconds (60)] [-l LedgerSeconds (1800)] [-de DeliveredEvent (0)] [-mp PromPort (0)] [-fe FastExit (0)] [-wf WriteLogToFile (0)]\n")
 }
 
 //./ws-sender -s nats://192.168.1.223:12008
@@ -22,6 +22,7 @@ func main() {
 	log.Warnf("Start Server: %s ...\n", AppName)
 
 	setupMoleculerService()
+	startPromService()
 
 	log.Warn("=================== Server Started ================= ")
 
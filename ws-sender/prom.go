@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/roytan883/micro-services/define"
+)
+
+var gRPCStats = &define.RPCStats{}
+var gLatency = &define.LatencyStats{}
+
+//startPromService serve /metrics on gPromPort, 0 to disable
+func startPromService() {
+	err := define.StartPromService(gPromPort, writeProm)
+	if err != nil {
+		log.Warnf("metrics http port[%d] listen err, /metrics disabled: %v\n", gPromPort, err)
+	}
+}
+
+func writeProm(p *define.PromWriter) {
+	var waitAck int
+	gLocalSaveHub.waitAckMsgs.Range(func(key, value interface{}) bool {
+		waitAck++
+		return true
+	})
+	var ledger int
+	gDeliveryLedger.mids.Range(func(key, value interface{}) bool {
+		ledger++
+		return true
+	})
+	p.Gauge("ws_sender_wait_ack", "pushed msgs waiting ack", float64(waitAck))
+	p.Gauge("ws_sender_ledger_msgs", "msgs in delivery ledger", float64(ledger))
+
+	p.Counter("ws_sender_send_total", "ws-sender.send requests", float64(atomic.LoadUint64(&gTotalSendRequest)))
+	p.Counter("ws_sender_push_total", "msgs pushed to online clients, exclude retries", float64(atomic.LoadUint64(&gTotalPushed)))
+	p.Counter("ws_sender_ack_total", "acks of waiting msgs", float64(atomic.LoadUint64(&gTotalAcked)))
+	p.Counter("ws_sender_retry_total", "msgs pushed again because no ack", float64(atomic.LoadUint64(&gTotalRetry)))
+	p.Counter("ws_sender_ack_after_retry_total", "acks after at least one retry", float64(atomic.LoadUint64(&gTotalAckAfterRetry)))
+	p.Counter("ws_sender_fallback_cache_total", "msgs moved to ws-cache after all attempts", float64(atomic.LoadUint64(&gTotalFallbackCache)))
+	p.Counter("ws_sender_drops_total", "dropped msgs by reason", float64(atomic.LoadUint64(&gDropExpired)), "reason", define.DropReasonExpired)
+
+	gLatency.WriteProm(p, "ws_sender_latency_seconds")
+	gRPCStats.WriteProm(p, "ws_sender")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+)
+
+var gTotalRetry uint64
+var gTotalAckAfterRetry uint64
+var gTotalFallbackCache uint64
+var gDropExpired uint64
+
+func init() {
+	//jitter should differ between ws-sender processes
+	rand.Seed(time.Now().UnixNano())
+}
+
+//resolveRetry fill empty fields of send call retry policy with flag defaults
+func resolveRetry(retry *define.RetryStruct) *define.RetryStruct {
+	ret := &define.RetryStruct{
+		MaxAttempts:       gRetryMaxAttempts,
+		WaitAckSeconds:    gWaitAckSeconds,
+		MaxBackoffSeconds: gRetryMaxBackoffSeconds,
+	}
+	if retry == nil {
+		return ret
+	}
+	if retry.MaxAttempts > 0 {
+		ret.MaxAttempts = retry.MaxAttempts
+	}
+	if retry.WaitAckSeconds > 0 {
+		ret.WaitAckSeconds = retry.WaitAckSeconds
+	}
+	if retry.MaxBackoffSeconds > 0 {
+		ret.MaxBackoffSeconds = retry.MaxBackoffSeconds
+	}
+	return ret
+}
+
+//waitAckDuration wait WaitAckSeconds for first attempt, then double it each retry up to MaxBackoffSeconds.
+//retries wait a random time in [d/2, d] so clients reconnected together don't retry together
+func waitAckDuration(retry *define.RetryStruct, attempts int) time.Duration {
+	d := time.Second * time.Duration(retry.WaitAckSeconds)
+	if attempts <= 1 {
+		return d
+	}
+	maxBackoff := time.Second * time.Duration(retry.MaxBackoffSeconds)
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	half := d / 2
+	if half < 1 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+//retrySend push waitAck msgs again to the ws-connector which the client connected
+func retrySend(waitAcks []*waitAckStruct) {
+	if len(waitAcks) < 1 {
+		return
+	}
+	type retryKey struct {
+		nodeID string
+		mid    string
+	}
+	batches := make(map[retryKey][]*waitAckStruct)
+	for _, waitAck := range waitAcks {
+		key := retryKey{nodeID: waitAck.NodeID, mid: waitAck.Mid}
+		batches[key] = append(batches[key], waitAck)
+	}
+	go func() {
+		for key, batch := range batches {
+			cids := make([]string, 0, len(batch))
+			for _, waitAck := range batch {
+				cids = append(cids, waitAck.Cid)
+			}
+			atomic.AddUint64(&gTotalRetry, uint64(len(batch)))
+			log.Infof("retrySend, nodeID[%s] mid[%s] cids[%v]\n", key.nodeID, key.mid, cids)
+			start := time.Now()
+			_, err := call(define.WsConnectorActionPush, &define.PushMsgStruct{
+				IDs:  cids,
+				Data: batch[0].Data,
+			}, &moleculer.CallOptions{
+				NodeID: key.nodeID,
+			})
+			gRPCStats.Observe(define.WsConnectorActionPush, start, err)
+			if err != nil {
+				log.Warnf("retrySend, push to nodeID[%s] err: %v\n", key.nodeID, err)
+			}
+		}
+	}()
+}
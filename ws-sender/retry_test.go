@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+//resetHubs fresh gLocalSaveHub and gDeliveryLedger with flag defaults, tickers are not started
+func resetHubs() {
+	log = logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	gWaitAckSeconds = 10
+	gRetryMaxAttempts = 3
+	gRetryMaxBackoffSeconds = 60
+	gLedgerSeconds = 1800
+	gDeliveredEvent = 0
+	gLocalSaveHub = &LocalSaveHub{
+		waitAckMsgs: &sync.Map{},
+		hubClosed:   make(chan int, 1),
+	}
+	gDeliveryLedger = &DeliveryLedger{
+		mids:      &sync.Map{},
+		hubClosed: make(chan int, 1),
+	}
+}
+
+func ackEvent(mid string, userID string, cid string) *protocol.MsEvent {
+	return &protocol.MsEvent{Data: &define.AckStruct{Aid: mid, UserID: userID, Cid: cid}}
+}
+
+func TestResolveRetry(t *testing.T) {
+	resetHubs()
+	cases := []struct {
+		in   *define.RetryStruct
+		want define.RetryStruct
+	}{
+		{nil, define.RetryStruct{MaxAttempts: 3, WaitAckSeconds: 10, MaxBackoffSeconds: 60}},
+		{&define.RetryStruct{}, define.RetryStruct{MaxAttempts: 3, WaitAckSeconds: 10, MaxBackoffSeconds: 60}},
+		{&define.RetryStruct{MaxAttempts: 1}, define.RetryStruct{MaxAttempts: 1, WaitAckSeconds: 10, MaxBackoffSeconds: 60}},
+		{&define.RetryStruct{WaitAckSeconds: 2, MaxBackoffSeconds: 5}, define.RetryStruct{MaxAttempts: 3, WaitAckSeconds: 2, MaxBackoffSeconds: 5}},
+		{&define.RetryStruct{MaxAttempts: -1, WaitAckSeconds: -1}, define.RetryStruct{MaxAttempts: 3, WaitAckSeconds: 10, MaxBackoffSeconds: 60}},
+	}
+	for i, c := range cases {
+		if got := resolveRetry(c.in); *got != c.want {
+			t.Errorf("case %d: got %+v, want %+v", i, *got, c.want)
+		}
+	}
+}
+
+func TestWaitAckDurationFirstAttempt(t *testing.T) {
+	retry := &define.RetryStruct{MaxAttempts: 5, WaitAckSeconds: 10, MaxBackoffSeconds: 60}
+	for i := 0; i < 100; i++ {
+		if d := waitAckDuration(retry, 1); d != time.Second*10 {
+			t.Fatalf("first attempt waits %v, want 10s without jitter", d)
+		}
+	}
+}
+
+func TestWaitAckDurationJitter(t *testing.T) {
+	retry := &define.RetryStruct{MaxAttempts: 10, WaitAckSeconds: 2, MaxBackoffSeconds: 60}
+	for attempts := 2; attempts <= 10; attempts++ {
+		//2s doubled for every retry, capped at 60s
+		full := time.Second * 2 << uint(attempts-1)
+		if full > time.Second*60 {
+			full = time.Second * 60
+		}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			d := waitAckDuration(retry, attempts)
+			if d < full/2 || d > full {
+				t.Fatalf("attempts %d: wait %v out of [%v, %v]", attempts, d, full/2, full)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("attempts %d: no jitter, always %v", attempts, full)
+		}
+	}
+}
+
+func TestWaitAckDurationMaxBackoff(t *testing.T) {
+	cases := []struct {
+		retry *define.RetryStruct
+		max   time.Duration
+	}{
+		{&define.RetryStruct{WaitAckSeconds: 10, MaxBackoffSeconds: 60}, time.Second * 60},
+		//first wait longer than the cap, retries still capped
+		{&define.RetryStruct{WaitAckSeconds: 100, MaxBackoffSeconds: 30}, time.Second * 30},
+	}
+	for _, c := range cases {
+		for _, attempts := range []int{2, 5, 30, 1000} {
+			d := waitAckDuration(c.retry, attempts)
+			if d > c.max || d < c.max/2 && attempts > 5 {
+				t.Fatalf("retry %+v attempts %d: wait %v, cap %v", *c.retry, attempts, d, c.max)
+			}
+		}
+	}
+}
+
+func TestCheckWaitAcksAttemptsLimit(t *testing.T) {
+	resetHubs()
+	data := &define.PushMsgDataStruct{Mid: "m1"}
+	retry := resolveRetry(&define.RetryStruct{MaxAttempts: 4, WaitAckSeconds: 1, MaxBackoffSeconds: 2})
+	gDeliveryLedger.sending(data.Mid, "u1", "c1")
+	gLocalSaveHub.save("u1", "c1", "node-0", data, retry, nil, time.Now())
+
+	now := time.Now()
+	retried := 0
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second * 3)
+		retries, fallbacks := gLocalSaveHub.checkWaitAcks(now)
+		retried += len(retries)
+		if len(fallbacks) > 0 {
+			if retried != retry.MaxAttempts-1 {
+				t.Fatalf("moved to ws-cache after %d retries, want %d", retried, retry.MaxAttempts-1)
+			}
+			if _, ok := gLocalSaveHub.waitAckMsgs.Load("m1.u1.c1"); ok {
+				t.Fatal("waitAck kept after moved to ws-cache")
+			}
+			if state := gDeliveryLedger.status("m1", "u1").Recipients[0].State; state != define.DeliveryStateCached {
+				t.Fatalf("ledger state %s, want %s", state, define.DeliveryStateCached)
+			}
+			return
+		}
+	}
+	t.Fatalf("not moved to ws-cache after %d retries", retried)
+}
+
+func TestCheckWaitAcksNotBeforeNextTime(t *testing.T) {
+	resetHubs()
+	gLocalSaveHub.save("u1", "c1", "node-0", &define.PushMsgDataStruct{Mid: "m1"}, resolveRetry(nil), nil, time.Now())
+	retries, fallbacks := gLocalSaveHub.checkWaitAcks(time.Now().Add(time.Second * 9))
+	if len(retries) != 0 || len(fallbacks) != 0 {
+		t.Fatalf("retried before wait ack timeout: %d retries, %d fallbacks", len(retries), len(fallbacks))
+	}
+}
+
+//TestAckDuringCheckWaitAcks every msg is either acked or moved to ws-cache, an ack is never undone by a retry
+func TestAckDuringCheckWaitAcks(t *testing.T) {
+	resetHubs()
+	const n = 2000
+	atomic.StoreUint64(&gTotalAcked, 0)
+	retry := resolveRetry(&define.RetryStruct{MaxAttempts: 3, WaitAckSeconds: 1, MaxBackoffSeconds: 1})
+	for i := 0; i < n; i++ {
+		mid := "m" + strconv.Itoa(i)
+		gDeliveryLedger.sending(mid, "u1", "c1")
+		gLocalSaveHub.save("u1", "c1", "node-0", &define.PushMsgDataStruct{Mid: mid}, retry, nil, time.Now())
+	}
+
+	var fallbackCount int64
+	stop := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		now := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			now = now.Add(time.Second * 2)
+			_, fallbacks := gLocalSaveHub.checkWaitAcks(now)
+			atomic.AddInt64(&fallbackCount, int64(len(fallbacks)))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		eventWsConnectorOutAck(ackEvent("m"+strconv.Itoa(i), "u1", "c1"))
+	}
+	close(stop)
+	wg.Wait()
+	gLocalSaveHub.checkWaitAcks(time.Now().Add(time.Hour))
+
+	count := 0
+	gLocalSaveHub.waitAckMsgs.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != 0 {
+		t.Fatalf("%d acked msgs still waiting ack", count)
+	}
+	acked := atomic.LoadUint64(&gTotalAcked)
+	if int64(acked)+atomic.LoadInt64(&fallbackCount) != n {
+		t.Fatalf("acked %d + moved to ws-cache %d != %d", acked, fallbackCount, n)
+	}
+}
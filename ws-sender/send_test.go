@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+	"github.com/roytan883/moleculer-go/protocol"
+)
+
+type testCall struct {
+	action string
+	nodeID string
+	params interface{}
+}
+
+//stubCalls answer ws-online with online, push and ws-cache.save calls are sent to the returned chan
+func stubCalls(online *define.OnlineStatusBulkStruct) chan *testCall {
+	calls := make(chan *testCall, 1000)
+	call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+		if action == define.WsOnlineActionOnlineStatusBulk {
+			return online, nil
+		}
+		one := &testCall{action: action, params: params}
+		if opts != nil {
+			one.nodeID = opts.NodeID
+		}
+		calls <- one
+		return nil, nil
+	}
+	return calls
+}
+
+func waitCalls(t *testing.T, calls chan *testCall, n int) []*testCall {
+	ret := make([]*testCall, 0, n)
+	for len(ret) < n {
+		select {
+		case one := <-calls:
+			ret = append(ret, one)
+		case <-time.After(time.Second * 2):
+			t.Fatalf("got %d calls, want %d", len(ret), n)
+		}
+	}
+	select {
+	case one := <-calls:
+		t.Fatalf("unexpected call %s to %s", one.action, one.nodeID)
+	case <-time.After(time.Millisecond * 50):
+	}
+	return ret
+}
+
+func TestSendBatchOrder(t *testing.T) {
+	resetHubs()
+	calls := stubCalls(&define.OnlineStatusBulkStruct{
+		OnlineStatusBulk: []*define.OnlineStatusStruct{
+			{UserID: "u1", RealOnlineInfos: []*define.ClientInfo{
+				{UserID: "u1", Cid: "u1_ios_node-0", NodeID: "node-0", Platform: "ios", IsOnline: true},
+				{UserID: "u1", Cid: "u1_web_node-1", NodeID: "node-1", Platform: "web", IsOnline: true},
+				{UserID: "u1", Cid: "u1_android_node-0", NodeID: "node-0", Platform: "android"},
+			}},
+		},
+	})
+
+	const n = 20
+	msgs := make([]*define.PushMsgStruct, 0, n)
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, &define.PushMsgStruct{
+			IDs:  "u1",
+			Data: &define.PushMsgDataStruct{Mid: "m" + strconv.Itoa(i)},
+		})
+	}
+	_, err := actionSend(&protocol.MsRequest{Params: &define.PushMsgStruct{Msgs: msgs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//one push per ws-connector carrying the whole batch, offline client cached one by one
+	cached := 0
+	for _, one := range waitCalls(t, calls, 2+n) {
+		switch one.action {
+		case define.WsConnectorActionPush:
+			push := one.params.(*define.PushMsgStruct)
+			if len(push.Msgs) != n {
+				t.Fatalf("push to %s has %d msgs, want %d", one.nodeID, len(push.Msgs), n)
+			}
+			for i, msg := range push.Msgs {
+				if msg.Data.Mid != "m"+strconv.Itoa(i) {
+					t.Fatalf("push to %s msg %d is %s", one.nodeID, i, msg.Data.Mid)
+				}
+			}
+		case define.WsCacheActionSave:
+			save := one.params.(*define.CacheMsgStruct)
+			if save.Cid != "u1_android_node-0" || save.Mid != "m"+strconv.Itoa(cached) {
+				t.Fatalf("ws-cache.save %d is %s of %s", cached, save.Mid, save.Cid)
+			}
+			cached++
+		default:
+			t.Fatalf("unexpected call %s", one.action)
+		}
+	}
+	waitPushed(t, "m"+strconv.Itoa(n-1), "u1_ios_node-0", "u1_web_node-1")
+}
+
+func TestSendSingleKeepsPushFormat(t *testing.T) {
+	resetHubs()
+	calls := stubCalls(&define.OnlineStatusBulkStruct{
+		OnlineStatusBulk: []*define.OnlineStatusStruct{
+			{UserID: "u1", RealOnlineInfos: []*define.ClientInfo{
+				{UserID: "u1", Cid: "u1_ios_node-0", NodeID: "node-0", Platform: "ios", IsOnline: true},
+				{UserID: "u1", Cid: "u1_web_node-0", NodeID: "node-0", Platform: "web", IsOnline: true},
+			}},
+		},
+	})
+	_, err := actionSend(&protocol.MsRequest{Params: &define.PushMsgStruct{
+		IDs:  "u1",
+		Data: &define.PushMsgDataStruct{Mid: "m1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := waitCalls(t, calls, 1)[0].params.(*define.PushMsgStruct)
+	ids, _ := define.ParseIDs(push.IDs)
+	if len(push.Msgs) != 0 || push.Data.Mid != "m1" || len(ids) != 1 || ids[0] != "u1" {
+		t.Fatalf("got push %+v, want ids [u1] data m1", push)
+	}
+	waitPushed(t, "m1", "u1_ios_node-0", "u1_web_node-0")
+}
+
+//waitPushed wait ledger of cids become pushed, doSend marks them after the push call returned
+func waitPushed(t *testing.T, mid string, cids ...string) {
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		pushed := 0
+		for _, recipient := range gDeliveryLedger.status(mid, "").Recipients {
+			for _, cid := range cids {
+				if recipient.Cid == cid && recipient.State == define.DeliveryStatePushed {
+					pushed++
+				}
+			}
+		}
+		if pushed == len(cids) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mid %s: %d of %v pushed", mid, pushed, cids)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestSendBatchBadMsg(t *testing.T) {
+	resetHubs()
+	stubCalls(&define.OnlineStatusBulkStruct{})
+	_, err := actionSend(&protocol.MsRequest{Params: &define.PushMsgStruct{Msgs: []*define.PushMsgStruct{
+		{IDs: "u1", Data: &define.PushMsgDataStruct{Mid: "m1"}},
+		{IDs: "u1"},
+	}}})
+	if err == nil {
+		t.Fatal("batch with empty data accepted")
+	}
+}
+
+func TestSendBadTarget(t *testing.T) {
+	resetHubs()
+	stubCalls(&define.OnlineStatusBulkStruct{})
+	_, err := actionSend(&protocol.MsRequest{Params: &define.PushMsgStruct{
+		IDs:    "u1",
+		Data:   &define.PushMsgDataStruct{Mid: "m1"},
+		Target: &define.TargetStruct{Versions: "<2.x"},
+	}})
+	if err == nil {
+		t.Fatal("send with bad target versions accepted")
+	}
+}
@@ -3,14 +3,14 @@ package main
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
 
 	"errors"
-	"strings"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
 	moleculer "github.com/roytan883/moleculer-go"
 	"github.com/roytan883/moleculer-go/protocol"
 )
@@ -18,6 +18,18 @@ import (
 var pBroker *moleculer.ServiceBroker
 var gMoleculerService *moleculer.Service
 
+//call and broadcast pBroker, replaced in tests
+var call = func(action string, params interface{}, opts *moleculer.CallOptions) (interface{}, error) {
+	return pBroker.Call(action, params, opts)
+}
+var broadcast = func(event string, data interface{}) {
+	pBroker.Broadcast(event, data)
+}
+
+var gTotalSendRequest uint64
+var gTotalPushed uint64
+var gTotalAcked uint64
+
 func setupMoleculerService() {
 	//init service and broker
 	config := &moleculer.ServiceBrokerConfig{
@@ -50,12 +62,14 @@ func createMoleculerService() moleculer.Service {
 	}
 
 	//init actions handlers
-	gMoleculerService.Actions["send"] = actionSend
+	gMoleculerService.Actions["send"] = define.TimedAction(gRPCStats, define.WsSenderActionSend, actionSend)
+	gMoleculerService.Actions["status"] = define.TimedAction(gRPCStats, define.WsSenderActionStatus, actionStatus)
+	gMoleculerService.Actions["metrics"] = define.TimedAction(gRPCStats, define.WsSenderActionMetrics, actionMetrics)
 
 	//init listen events handlers
-	gMoleculerService.Events[cWsConnectorOutAck] = eventWsConnectorOutAck
-	// gMoleculerService.Events[cWsConnectorOutOffline] = eventWsConnectorOutOffline
-	// gMoleculerService.Events[cWsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
+	gMoleculerService.Events[define.WsConnectorOutAck] = eventWsConnectorOutAck
+	// gMoleculerService.Events[define.WsConnectorOutOffline] = eventWsConnectorOutOffline
+	// gMoleculerService.Events[define.WsConnectorOutSyncUsersInfo] = eventWsConnectorOutSyncUsersInfo
 
 	gLocalSaveHub = &LocalSaveHub{
 		waitAckMsgs: &sync.Map{},
@@ -64,101 +78,239 @@ func createMoleculerService() moleculer.Service {
 
 	gLocalSaveHub.runCheckLocalSaveSend()
 
+	gDeliveryLedger = &DeliveryLedger{
+		mids:      &sync.Map{},
+		hubClosed: make(chan int, 1),
+	}
+	gDeliveryLedger.run()
+
 	return *gMoleculerService
 }
 
 //mol $ call ws-sender.send --ids gotest-user-0,gotest-user-1 --data.mid m123 --data.msg.a abc --data.msg.b 111 --data.msg.c true
+//with msgs, every msg is a full send request, they are pushed to each client in order (ws-cache redeliver)
 func actionSend(req *protocol.MsRequest) (interface{}, error) {
 
 	log.Info("run actionSend, req.Params = ", req.Params)
-	jsonByte, err := jsoniter.Marshal(req.Params)
+	atomic.AddUint64(&gTotalSendRequest, 1)
+	receiveTime := time.Now()
+	jsonObj := &define.PushMsgStruct{}
+	err := define.Decode(req.Params, jsonObj)
 	if err != nil {
-		log.Warn("run actionPush, parse req.Data to jsonByte error: ", err)
-		return nil, err
-	}
-	jsonObj := &pushMsgStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
-	if err != nil {
-		log.Warn("run actionSend, parse jsonByte to jsonObj error: ", err)
+		log.Warn("run actionSend, parse req.Params to jsonObj error: ", err)
 		return nil, err
 	}
 	log.Info("run actionSend, jsonObj = ", jsonObj)
 
-	// log.Info("type:", reflect.TypeOf(jsonObj.IDs))
-
-	ids := make([]string, 0)
-	switch jsonObj.IDs.(type) {
-	case []string:
-		ids = jsonObj.IDs.([]string)
-	case []interface{}:
-		_ids := jsonObj.IDs.([]interface{})
-		for _, v := range _ids {
-			if sv, ok := v.(string); ok {
-				ids = append(ids, sv)
-			}
+	msgs := jsonObj.Msgs
+	if len(msgs) < 1 {
+		msgs = []*define.PushMsgStruct{jsonObj}
+	}
+	items := make([]*sendItem, 0, len(msgs))
+	for _, msg := range msgs {
+		item, err := newSendItem(msg)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			items = append(items, item)
 		}
-	case string:
-		ids = strings.Split(jsonObj.IDs.(string), ",")
-	default:
+	}
+	if len(items) > 0 {
+		doSend(items, receiveTime)
+	}
+	return nil, nil
+}
+
+//sendItem one msg of ws-sender.send
+type sendItem struct {
+	ids    []string
+	data   *define.PushMsgDataStruct
+	retry  *define.RetryStruct
+	target *define.TargetStruct
+}
+
+//newSendItem check msg of ws-sender.send, nil if it is already expired
+func newSendItem(msg *define.PushMsgStruct) (*sendItem, error) {
+	ids, err := define.ParseIDs(msg.IDs)
+	if err != nil {
 		log.Info("can't parse jsonObj.IDs")
-		return nil, errors.New("can't parse ids")
+		return nil, err
+	}
+	if msg.Data == nil {
+		return nil, errors.New("data is empty")
+	}
+	err = msg.Target.Parse()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	msg.Data.ApplyTTL(now)
+	if msg.Data.IsExpired(now) {
+		atomic.AddUint64(&gDropExpired, 1)
+		log.Infof("actionSend drop expired msg, mid[%s] expireAt[%s]\n", msg.Data.Mid, msg.Data.ExpireAt)
+		return nil, nil
 	}
-	doSend(ids, jsonObj.Data)
 	log.Info("actionSend ids = ", ids)
-	log.Info("actionSend data = ", jsonObj.Data)
-	return nil, nil
+	log.Info("actionSend data = ", msg.Data)
+	return &sendItem{
+		ids:    ids,
+		data:   msg.Data,
+		retry:  resolveRetry(msg.Retry),
+		target: msg.Target,
+	}, nil
+}
+
+//mol $ call ws-sender.status --mid m123
+//mol $ call ws-sender.status --mid m123 --userID gotest-user-0
+func actionStatus(req *protocol.MsRequest) (interface{}, error) {
+	jsonObj := &define.MidStruct{}
+	err := define.Decode(req.Params, jsonObj)
+	if err != nil {
+		log.Warn("run actionStatus, parse req.Params to jsonObj MidStruct error: ", err)
+		return nil, err
+	}
+	if len(jsonObj.Mid) < 1 {
+		return nil, errors.New("mid is empty")
+	}
+	return gDeliveryLedger.status(jsonObj.Mid, jsonObj.UserID), nil
+}
+
+//mol $ call ws-sender.metrics
+func actionMetrics(req *protocol.MsRequest) (interface{}, error) {
+	var waitAck uint64
+	gLocalSaveHub.waitAckMsgs.Range(func(key, value interface{}) bool {
+		waitAck++
+		return true
+	})
+	return &define.SenderMetricsStruct{
+		NodeID:             gNodeID,
+		WaitAck:            waitAck,
+		TotalRetry:         atomic.LoadUint64(&gTotalRetry),
+		TotalAckAfterRetry: atomic.LoadUint64(&gTotalAckAfterRetry),
+		TotalFallbackCache: atomic.LoadUint64(&gTotalFallbackCache),
+		Drops: map[string]uint64{
+			define.DropReasonExpired: atomic.LoadUint64(&gDropExpired),
+		},
+		Latency: gLatency.Latency(),
+	}, nil
+}
+
+//nodePush one msg pushed to a ws-connector and the clients it is for
+type nodePush struct {
+	msg     *define.PushMsgStruct
+	userIDs []string
+	clients []*define.ClientInfo
 }
 
-func doSend(ids []string, data *pushMsgDataStruct) {
+//doSend receiveTime is when ws-sender.send received, start of latency stages.
+//items are handled in order, a ws-connector gets all its items in one push so clients receive them in order
+func doSend(items []*sendItem, receiveTime time.Time) {
 	go func() {
-		res, err := pBroker.Call(cWsOnlineActionOnlineStatusBulk, &idsStruct{
+		ids := make([]string, 0)
+		idSet := make(map[string]bool)
+		for _, item := range items {
+			for _, id := range item.ids {
+				if !idSet[id] {
+					idSet[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		start := time.Now()
+		res, err := call(define.WsOnlineActionOnlineStatusBulk, &define.IDsStruct{
 			IDs: ids,
 		}, nil)
+		gRPCStats.Observe(define.WsOnlineActionOnlineStatusBulk, start, err)
 		log.Info("doSend res = ", res)
 		log.Info("doSend err = ", err)
 		if err != nil {
 			log.Warn("run doSend, get ids OnlineStatusBulk err: ", err)
 			return
 		}
-		jsonByte, err := jsoniter.Marshal(res)
+		gLatency.ObserveSince(define.LatencyLookup, receiveTime)
+		jsonObj := &define.OnlineStatusBulkStruct{}
+		err = define.Decode(res, jsonObj)
 		if err != nil {
-			log.Warn("run doSend, parse res to jsonByte error: ", err)
+			log.Warn("run doSend, parse res to OnlineStatusBulkStruct error: ", err)
 			return
 		}
-		jsonObj := &onlineStatusBulkStruct{}
-		err = jsoniter.Unmarshal(jsonByte, jsonObj)
-		if err != nil {
-			log.Warn("run doSend, parse jsonByte to onlineStatusBulkStruct error: ", err)
-			return
-		}
-		// log.Info("run doSend, onlineStatusBulkStruct = ", jsonObj)
-		wsConnectorNodes := make(map[string][]string)
+		userClients := make(map[string][]*define.ClientInfo)
 		for _, onlineStatus := range jsonObj.OnlineStatusBulk {
 			for _, clientInfo := range onlineStatus.RealOnlineInfos {
-				if clientInfo.IsOnline {
-					// log.Info("run doSend, IsOnline = ", clientInfo)
-					if nodes, ok := wsConnectorNodes[clientInfo.NodeID]; !ok {
-						wsConnectorNodes[clientInfo.NodeID] = make([]string, 0)
-						wsConnectorNodes[clientInfo.NodeID] = append(wsConnectorNodes[clientInfo.NodeID], clientInfo.UserID)
+				userClients[clientInfo.UserID] = append(userClients[clientInfo.UserID], clientInfo)
+			}
+		}
+
+		nodePushes := make(map[string][]*nodePush)
+		for _, item := range items {
+			data := item.data
+			if data.IsExpired(time.Now()) {
+				atomic.AddUint64(&gDropExpired, 1)
+				log.Infof("run doSend, drop expired msg, mid[%s] expireAt[%s]\n", data.Mid, data.ExpireAt)
+				continue
+			}
+			pushes := make(map[string]*nodePush)
+			itemIDs := make(map[string]bool)
+			for _, id := range item.ids {
+				if itemIDs[id] {
+					continue
+				}
+				itemIDs[id] = true
+				for _, clientInfo := range userClients[id] {
+					if !item.target.Match(clientInfo.Platform, clientInfo.Version) {
+						continue
+					}
+					if clientInfo.IsOnline {
+						gDeliveryLedger.sending(data.Mid, clientInfo.UserID, clientInfo.Cid)
+						push, ok := pushes[clientInfo.NodeID]
+						if !ok {
+							push = &nodePush{msg: &define.PushMsgStruct{Data: data, Target: item.target}}
+							pushes[clientInfo.NodeID] = push
+						}
+						if len(push.clients) < 1 || push.clients[len(push.clients)-1].UserID != clientInfo.UserID {
+							push.userIDs = append(push.userIDs, clientInfo.UserID)
+						}
+						push.clients = append(push.clients, clientInfo)
+						gLocalSaveHub.save(clientInfo.UserID, clientInfo.Cid, clientInfo.NodeID, data, item.retry, item.target, receiveTime)
 					} else {
-						nodes = append(nodes, clientInfo.UserID)
-						wsConnectorNodes[clientInfo.NodeID] = nodes
+						gDeliveryLedger.update(data.Mid, clientInfo.UserID, clientInfo.Cid, define.DeliveryStateCached)
+						saveToRemoteCache(clientInfo.UserID, clientInfo.Cid, data, item.target)
 					}
-					gLocalSaveHub.save(clientInfo.UserID, clientInfo.Cid, data.Mid, data.Msg)
-				} else {
-					saveToRemoteCache(clientInfo.UserID, clientInfo.Cid, data.Mid, data.Msg)
 				}
 			}
+			for nodeID, push := range pushes {
+				push.msg.IDs = push.userIDs
+				nodePushes[nodeID] = append(nodePushes[nodeID], push)
+			}
 		}
-		log.Info("run doSend, wsConnectorNodes = ", wsConnectorNodes)
-		for nodeID, realIds := range wsConnectorNodes {
-			log.Infof("run doSend, nodeID[%s] realIds[%v]", nodeID, realIds)
-			pBroker.Call(cWsConnectorActionPush, &pushMsgStruct{
-				IDs:  realIds,
-				Data: data,
-			}, &moleculer.CallOptions{
+		log.Info("run doSend, nodePushes = ", len(nodePushes))
+		for nodeID, pushes := range nodePushes {
+			msg := pushes[0].msg
+			if len(pushes) > 1 {
+				msg = &define.PushMsgStruct{Msgs: make([]*define.PushMsgStruct, 0, len(pushes))}
+				for _, push := range pushes {
+					msg.Msgs = append(msg.Msgs, push.msg)
+				}
+			}
+			msg.SendTime = define.Timestamp(receiveTime)
+			log.Infof("run doSend, nodeID[%s] msgs[%d]", nodeID, len(pushes))
+			start := time.Now()
+			_, err := call(define.WsConnectorActionPush, msg, &moleculer.CallOptions{
 				NodeID: nodeID,
 			})
+			gRPCStats.Observe(define.WsConnectorActionPush, start, err)
+			if err != nil {
+				//still wait ack, runCheckLocalSaveSend will move them to remote cache
+				log.Warnf("run doSend, push to nodeID[%s] err: %v\n", nodeID, err)
+				continue
+			}
+			for _, push := range pushes {
+				atomic.AddUint64(&gTotalPushed, uint64(len(push.clients)))
+				for _, clientInfo := range push.clients {
+					gDeliveryLedger.pushed(push.msg.Data.Mid, clientInfo.UserID, clientInfo.Cid)
+				}
+			}
 		}
 	}()
 }
@@ -171,35 +323,81 @@ type LocalSaveHub struct {
 	hubClosed   chan int
 }
 
-func (h *LocalSaveHub) save(userID string, cid string, mid string, data interface{}) {
-	key := fmt.Sprintf("%s.%s.%s", mid, userID, cid)
+func (h *LocalSaveHub) save(userID string, cid string, nodeID string, data *define.PushMsgDataStruct, retry *define.RetryStruct, target *define.TargetStruct, receiveTime time.Time) {
+	key := fmt.Sprintf("%s.%s.%s", data.Mid, userID, cid)
+	now := time.Now()
 	h.waitAckMsgs.Store(key, &waitAckStruct{
-		UserID:   userID,
-		Cid:      cid,
-		Mid:      mid,
-		Data:     data,
-		SendTime: time.Now(),
+		UserID:      userID,
+		Cid:         cid,
+		Mid:         data.Mid,
+		NodeID:      nodeID,
+		Data:        data,
+		ReceiveTime: receiveTime,
+		SendTime:    now,
+		Retry:       retry,
+		Target:      target,
+		Attempts:    1,
+		NextTime:    now.Add(waitAckDuration(retry, 1)),
+	})
+}
+
+//checkWaitAcks drop expired waitAck msgs, return the ones to push again and the ones to move to ws-cache.
+//entries are updated in place under their own lock, an ack deleting one at same time always wins
+func (h *LocalSaveHub) checkWaitAcks(now time.Time) (retries []*waitAckStruct, fallbacks []*waitAckStruct) {
+	h.waitAckMsgs.Range(func(key, value interface{}) bool {
+		waitAck, ok := value.(*waitAckStruct)
+		if !ok {
+			return true
+		}
+		waitAck.mtx.Lock()
+		if waitAck.done {
+			waitAck.mtx.Unlock()
+			return true
+		}
+		if waitAck.Data.IsExpired(now) {
+			waitAck.done = true
+			waitAck.mtx.Unlock()
+			h.waitAckMsgs.Delete(key)
+			atomic.AddUint64(&gDropExpired, 1)
+			log.Info("drop expired waitAckMsg: ", key)
+			gDeliveryLedger.update(waitAck.Mid, waitAck.UserID, waitAck.Cid, define.DeliveryStateExpired)
+			return true
+		}
+		if now.Before(waitAck.NextTime) {
+			waitAck.mtx.Unlock()
+			return true
+		}
+		if waitAck.Attempts < waitAck.Retry.MaxAttempts {
+			waitAck.Attempts++
+			waitAck.NextTime = now.Add(waitAckDuration(waitAck.Retry, waitAck.Attempts))
+			waitAck.mtx.Unlock()
+			retries = append(retries, waitAck)
+			return true
+		}
+		attempts := waitAck.Attempts
+		waitAck.done = true
+		waitAck.mtx.Unlock()
+		h.waitAckMsgs.Delete(key)
+		atomic.AddUint64(&gTotalFallbackCache, 1)
+		log.Infof("move waitAckMsg to remote cache after %d attempts: %s\n", attempts, key)
+		gDeliveryLedger.update(waitAck.Mid, waitAck.UserID, waitAck.Cid, define.DeliveryStateCached)
+		fallbacks = append(fallbacks, waitAck)
+		return true
 	})
+	return
 }
 
 func (h *LocalSaveHub) runCheckLocalSaveSend() {
 	go func() {
-		ticker := time.NewTicker(time.Second * 5)
+		ticker := time.NewTicker(time.Second * 1)
 		for {
 			select {
 			case <-ticker.C:
-				now := time.Now()
-				h.waitAckMsgs.Range(func(key, value interface{}) bool {
-					if waitAck, ok := value.(*waitAckStruct); ok {
-						diff := now.Sub(waitAck.SendTime)
-						if diff > time.Second*time.Duration(gWaitAckSeconds) {
-							h.waitAckMsgs.Delete(key)
-							log.Info("move waitAckMsg to remote cache: ", key)
-							saveToRemoteCache(waitAck.UserID, waitAck.Cid, waitAck.Mid, waitAck.Data)
-						}
-					}
-					return true
-				})
+				retries, fallbacks := h.checkWaitAcks(time.Now())
+				retrySend(retries)
+				for _, waitAck := range fallbacks {
+					saveToRemoteCache(waitAck.UserID, waitAck.Cid, waitAck.Data, waitAck.Target)
+				}
 			case <-h.hubClosed:
 				return
 			}
@@ -210,39 +408,57 @@ func (h *LocalSaveHub) runCheckLocalSaveSend() {
 func eventWsConnectorOutAck(req *protocol.MsEvent) {
 	log.Info("run eventWsConnectorOutAck")
 
-	jsonByte, err := jsoniter.Marshal(req.Data)
-	if err != nil {
-		log.Warn("run eventWsConnectorOutAck, parse req.Data to jsonByte error: ", err)
-		return
-	}
-	jsonObj := &ackStruct{}
-	err = jsoniter.Unmarshal(jsonByte, jsonObj)
+	jsonObj := &define.AckStruct{}
+	err := define.Decode(req.Data, jsonObj)
 	if err != nil {
-		log.Warn("run eventWsConnectorOutAck, parse jsonByte to jsonObj ackStruct error: ", err)
+		log.Warn("run eventWsConnectorOutAck, parse req.Data to jsonObj AckStruct error: ", err)
 		return
 	}
 	if len(jsonObj.Aid) > 0 {
 		key := fmt.Sprintf("%s.%s.%s", jsonObj.Aid, jsonObj.UserID, jsonObj.Cid)
+		if value, ok := gLocalSaveHub.waitAckMsgs.Load(key); ok {
+			if waitAck, ok := value.(*waitAckStruct); ok {
+				waitAck.mtx.Lock()
+				acked := !waitAck.done
+				waitAck.done = true
+				attempts := waitAck.Attempts
+				waitAck.mtx.Unlock()
+				if acked {
+					atomic.AddUint64(&gTotalAcked, 1)
+					gLatency.ObserveSince(define.LatencySendToAck, waitAck.ReceiveTime)
+					if attempts > 1 {
+						atomic.AddUint64(&gTotalAckAfterRetry, 1)
+					}
+				}
+			}
+		}
 		gLocalSaveHub.waitAckMsgs.Delete(key)
+		gDeliveryLedger.acked(jsonObj.Aid, jsonObj.UserID, jsonObj.Cid)
 		log.Info("finish ACK: ", key)
 	}
 }
 
-func saveToRemoteCache(userID string, cid string, mid string, data interface{}) {
-	//TODO: save msg to remote cache process
+func saveToRemoteCache(userID string, cid string, data *define.PushMsgDataStruct, target *define.TargetStruct) {
 	log.Info("saveToRemoteCache userID = ", userID)
 	log.Info("saveToRemoteCache cid = ", cid)
-	log.Info("saveToRemoteCache mid = ", mid)
-	log.Info("saveToRemoteCache data = ", data)
-
-	pBroker.Call(cWsCacheActionSave, &cacheMsgStruct{
-		UserID:    userID,
-		Cid:       cid,
-		Mid:       mid,
-		Msg:       data,
-		Timestamp: getNowTimestamp(),
-	}, nil)
+	log.Info("saveToRemoteCache mid = ", data.Mid)
+	log.Info("saveToRemoteCache data = ", data.Msg)
 
+	start := time.Now()
+	_, err := call(define.WsCacheActionSave, &define.CacheMsgStruct{
+		UserID:      userID,
+		Cid:         cid,
+		Mid:         data.Mid,
+		Msg:         data.Msg,
+		CollapseKey: data.CollapseKey,
+		ExpireAt:    data.ExpireAt,
+		Target:      target,
+		Timestamp:   getNowTimestamp(),
+	}, nil)
+	gRPCStats.Observe(define.WsCacheActionSave, start, err)
+	if err != nil {
+		log.Warn("saveToRemoteCache, call ws-cache.save err: ", err)
+	}
 }
 
 // func eventWsConnectorOutOnline(req *protocol.MsEvent) {
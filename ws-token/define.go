@@ -0,0 +1,27 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	//AppName ...
+	AppName = "ws-token"
+	//ServiceName ...
+	ServiceName = AppName
+)
+
+const (
+	//token timestamp can be a little ahead of local clock
+	maxClockSkew = time.Second * 60
+
+	//check keys file changed period
+	reloadKeysPeriod = time.Second * 30
+)
+
+//keys file, e.g.: {"current":"k2","keys":{"k1":"old secret","k2":"new secret"}}
+//issue use current key, verify accept all keys in file, remove old key after ExpireSeconds
+type keysFileStruct struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/xlab/closer"
+)
+
+func usage() {
+	log.Fatalf("Usage: ws-token [-s The nats server URLs (nats://192.168.1.223:12008)] [-i nodeID (0)] [-d debug (0)] [-k KeysFile (keys.json)] [-e ExpireSeconds (604800)] [-dir DataDir (data)] [-fe FastExit (0)] [-wf WriteLogToFile (0)]\n")
+}
+
+//./ws-token -s nats://192.168.1.223:12008 -k keys.json
+func main() {
+	closer.Bind(cleanupFunc)
+
+	initFlag()
+	setDebug()
+	printFlag()
+
+	log.Warnf("Start Server: %s ...\n", AppName)
+
+	setupMoleculerService()
+
+	log.Warn("=================== Server Started ================= ")
+
+	closer.Hold()
+}
+
+func cleanupFunc() {
+	log.Warnf("Stop Server: %s ...\n", AppName)
+	if gFastExit > 0 {
+		log.Warn("================= fast exit  ================== ")
+		os.Exit(0)
+	}
+	log.Warnf("Hang on! Server[%s] is closing ...", AppName)
+	log.Warn("=================== exit start =================== ")
+	if gTokenHub != nil {
+		gTokenHub.Close()
+	}
+	time.Sleep(time.Second * 1)
+	log.Warn("=================== exit end   =================== ")
+	log.Warnf("Server[%s] is closed", AppName)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/roytan883/micro-services/define"
+)
+
+//rename is os.Rename, tests replace it
+var rename = os.Rename
+
+//revokeLog append-only file of revocations, one RevokeTokenStruct json per line.
+//Replayed at startup so a restarted ws-token still rejects revoked tokens, rewritten with live
+//revocations when expired ones are cleaned
+type revokeLog struct {
+	mtx  sync.Mutex
+	path string
+	file *os.File
+}
+
+func openRevokeLog(path string) (*revokeLog, error) {
+	l := &revokeLog{path: path}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+//load call fn for every revocation in file order, bad lines (half written when killed) are skipped
+func (l *revokeLog) load(fn func(r *define.RevokeTokenStruct)) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		r := &define.RevokeTokenStruct{}
+		err := jsoniter.Unmarshal(scanner.Bytes(), r)
+		if err != nil || len(r.Timestamp) < 1 {
+			log.Warnf("revokeLog load, skip bad line[%d]: %v\n", lineNum, err)
+			continue
+		}
+		fn(r)
+	}
+	return scanner.Err()
+}
+
+func (l *revokeLog) append(r *define.RevokeTokenStruct) error {
+	line, err := jsoniter.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return errors.New("revoke log is closed")
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+//rewrite replace the file with records
+func (l *revokeLog) rewrite(records []*define.RevokeTokenStruct) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return errors.New("revoke log is closed")
+	}
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, r := range records {
+		line, err := jsoniter.Marshal(r)
+		if err != nil {
+			continue
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	l.file.Close()
+	l.file = nil
+	renameErr := rename(tmpPath, l.path)
+	if renameErr != nil {
+		//keep appending to the old file, it still has every revocation
+		os.Remove(tmpPath)
+	}
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if renameErr != nil {
+		return renameErr
+	}
+	return err
+}
+
+//Close ...
+func (l *revokeLog) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+//revokeRecords live revocations of h as RevokeTokenStruct, to rewrite revokeLog
+func (h *TokenHub) revokeRecords() []*define.RevokeTokenStruct {
+	records := make([]*define.RevokeTokenStruct, 0)
+	h.revokedTokens.Range(func(key, value interface{}) bool {
+		revokeTime := value.(time.Time).Add(-time.Second * time.Duration(gExpireSeconds))
+		records = append(records, &define.RevokeTokenStruct{
+			Token:     key.(string),
+			Timestamp: strconv.FormatInt(revokeTime.UnixNano()/1e6, 10),
+		})
+		return true
+	})
+	h.revokedUsers.Range(func(key, value interface{}) bool {
+		records = append(records, &define.RevokeTokenStruct{
+			UserID:    key.(string),
+			Timestamp: strconv.FormatInt(value.(time.Time).UnixNano()/1e6, 10),
+		})
+		return true
+	})
+	return records
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+//KeyRing keeps HMAC-SHA256 keys by kid, reload from keys file to rotate keys
+type KeyRing struct {
+	mtx     sync.RWMutex
+	current string
+	keys    map[string][]byte
+	modTime time.Time
+}
+
+func newKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: make(map[string][]byte),
+	}
+}
+
+//load keys file, return changed == false if file not modified since last load
+func (k *KeyRing) load(path string, force bool) (changed bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	k.mtx.RLock()
+	modTime := k.modTime
+	k.mtx.RUnlock()
+	if !force && info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	keysFile := &keysFileStruct{}
+	err = jsoniter.Unmarshal(data, keysFile)
+	if err != nil {
+		return false, err
+	}
+	if len(keysFile.Current) < 1 {
+		return false, errors.New("keys file: current kid is empty")
+	}
+	keys := make(map[string][]byte)
+	for kid, secret := range keysFile.Keys {
+		if len(kid) < 1 || strings.Contains(kid, ".") {
+			return false, errors.New("keys file: invalid kid: " + kid)
+		}
+		if len(secret) < 16 {
+			return false, errors.New("keys file: secret too short, kid: " + kid)
+		}
+		keys[kid] = []byte(secret)
+	}
+	if _, ok := keys[keysFile.Current]; !ok {
+		return false, errors.New("keys file: current kid not in keys: " + keysFile.Current)
+	}
+
+	k.mtx.Lock()
+	k.current = keysFile.Current
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.mtx.Unlock()
+	return true, nil
+}
+
+//createKeysFile write a keys file with one random key if path not exists, return created true if written.
+//other ws-token nodes must use a copy of it, or tokens issued by this node fail on them
+func createKeysFile(path string) (created bool, err error) {
+	_, err = os.Stat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return false, err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return false, err
+	}
+	data, err := jsoniter.Marshal(&keysFileStruct{
+		Current: "k1",
+		Keys:    map[string]string{"k1": hex.EncodeToString(secret)},
+	})
+	if err != nil {
+		return false, err
+	}
+	//O_EXCL, another ws-token on this machine may create it at same time
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return false, err
+	}
+	return true, nil
+}
+
+func (k *KeyRing) currentKey() (kid string, key []byte) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *KeyRing) getKey(kid string) (key []byte, ok bool) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	key, ok = k.keys[kid]
+	return
+}
+
+//token = kid + "." + hex(HMAC-SHA256(key, userID \n platform \n version \n timestamp))
+func signToken(kid string, key []byte, userID string, platform string, version string, timestamp string) string {
+	return kid + "." + hex.EncodeToString(tokenMAC(key, userID, platform, version, timestamp))
+}
+
+func tokenMAC(key []byte, userID string, platform string, version string, timestamp string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(userID))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(platform))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(version))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(timestamp))
+	return mac.Sum(nil)
+}
+
+//checkTokenSign return nil if token is signed by one of the keys for these params
+func (k *KeyRing) checkTokenSign(token string, userID string, platform string, version string, timestamp string) error {
+	index := strings.Index(token, ".")
+	if index < 1 {
+		return errors.New("bad token format")
+	}
+	key, ok := k.getKey(token[:index])
+	if !ok {
+		return errors.New("unknown kid: " + token[:index])
+	}
+	sign, err := hex.DecodeString(token[index+1:])
+	if err != nil {
+		return errors.New("bad token sign")
+	}
+	if !hmac.Equal(sign, tokenMAC(key, userID, platform, version, timestamp)) {
+		return errors.New("token sign not match")
+	}
+	return nil
+}
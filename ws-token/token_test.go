@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roytan883/micro-services/define"
+	"github.com/roytan883/moleculer-go/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const testSecret1 = "0123456789abcdef-k1"
+const testSecret2 = "0123456789abcdef-k2"
+
+func testDir(t *testing.T) (dir string, remove func()) {
+	dir, err := ioutil.TempDir("", "ws-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeKeysFile(t *testing.T, path string, data string) {
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//newTestHub TokenHub with keys k1(current) and k2, run() is not started
+func newTestHub(t *testing.T, dir string) *TokenHub {
+	log = logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	gExpireSeconds = 3600
+	path := filepath.Join(dir, "keys.json")
+	writeKeysFile(t, path, `{"current":"k1","keys":{"k1":"`+testSecret1+`","k2":"`+testSecret2+`"}}`)
+	h := &TokenHub{
+		keyRing:       newKeyRing(),
+		revokedTokens: &sync.Map{},
+		revokedUsers:  &sync.Map{},
+		hubClosed:     make(chan int, 1),
+	}
+	if _, err := h.keyRing.load(path, true); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func timestampOf(tm time.Time) string {
+	return strconv.FormatInt(tm.UnixNano()/1e6, 10)
+}
+
+//issue sign like actionIssue, at issueTime
+func issue(h *TokenHub, userID string, issueTime time.Time) *define.VerifyTokenStruct {
+	timestamp := timestampOf(issueTime)
+	kid, key := h.keyRing.currentKey()
+	return &define.VerifyTokenStruct{
+		UserID:    userID,
+		Platform:  "ios",
+		Version:   "1.2.3",
+		Timestamp: timestamp,
+		Token:     signToken(kid, key, userID, "ios", "1.2.3", timestamp),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	h := newTestHub(t, dir)
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		modify func(v *define.VerifyTokenStruct)
+		valid  bool
+	}{
+		{"valid", func(v *define.VerifyTokenStruct) {}, true},
+		{"other userID", func(v *define.VerifyTokenStruct) { v.UserID = "u2" }, false},
+		{"other platform", func(v *define.VerifyTokenStruct) { v.Platform = "web" }, false},
+		{"other version", func(v *define.VerifyTokenStruct) { v.Version = "1.2.4" }, false},
+		{"other timestamp", func(v *define.VerifyTokenStruct) { v.Timestamp = timestampOf(now.Add(-time.Second)) }, false},
+		{"tampered sign", func(v *define.VerifyTokenStruct) {
+			b := []byte(v.Token)
+			if b[len(b)-1] == '0' {
+				b[len(b)-1] = '1'
+			} else {
+				b[len(b)-1] = '0'
+			}
+			v.Token = string(b)
+		}, false},
+		{"sign of other kid", func(v *define.VerifyTokenStruct) { v.Token = "k2" + v.Token[2:] }, false},
+		{"unknown kid", func(v *define.VerifyTokenStruct) { v.Token = "k9" + v.Token[2:] }, false},
+		{"no kid", func(v *define.VerifyTokenStruct) { v.Token = v.Token[3:] }, false},
+		{"sign not hex", func(v *define.VerifyTokenStruct) { v.Token = "k1.xyz" }, false},
+		{"empty token", func(v *define.VerifyTokenStruct) { v.Token = "" }, false},
+		{"bad timestamp", func(v *define.VerifyTokenStruct) { v.Timestamp = "abc" }, false},
+		{"missing userID", func(v *define.VerifyTokenStruct) { v.UserID = "" }, false},
+	}
+	for _, c := range cases {
+		v := issue(h, "u1", now)
+		c.modify(v)
+		err := h.verify(v)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: verify err %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestVerifyExpireAndSkew(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	h := newTestHub(t, dir)
+	now := time.Now()
+	expire := time.Second * time.Duration(gExpireSeconds)
+
+	cases := []struct {
+		name      string
+		issueTime time.Time
+		valid     bool
+	}{
+		{"just issued", now, true},
+		{"before expire", now.Add(-expire + time.Minute), true},
+		{"expired", now.Add(-expire - time.Second), false},
+		{"ahead within skew", now.Add(maxClockSkew - time.Second*5), true},
+		{"ahead beyond skew", now.Add(maxClockSkew + time.Second*5), false},
+	}
+	for _, c := range cases {
+		err := h.verify(issue(h, "u1", c.issueTime))
+		if (err == nil) != c.valid {
+			t.Errorf("%s: verify err %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	h := newTestHub(t, dir)
+	path := filepath.Join(dir, "keys.json")
+	now := time.Now()
+	oldToken := issue(h, "u1", now)
+
+	//k2 becomes current, k1 still accepted
+	writeKeysFile(t, path, `{"current":"k2","keys":{"k1":"`+testSecret1+`","k2":"`+testSecret2+`"}}`)
+	if _, err := h.keyRing.load(path, true); err != nil {
+		t.Fatal(err)
+	}
+	newToken := issue(h, "u1", now)
+	if newToken.Token[:3] != "k2." {
+		t.Fatalf("token %s not signed by current kid k2", newToken.Token)
+	}
+	if err := h.verify(oldToken); err != nil {
+		t.Fatalf("k1 token after rotation: %v", err)
+	}
+	if err := h.verify(newToken); err != nil {
+		t.Fatalf("k2 token after rotation: %v", err)
+	}
+
+	//k1 removed
+	writeKeysFile(t, path, `{"current":"k2","keys":{"k2":"`+testSecret2+`"}}`)
+	if _, err := h.keyRing.load(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.verify(oldToken); err == nil {
+		t.Fatal("k1 token valid after k1 removed")
+	}
+	if err := h.verify(newToken); err != nil {
+		t.Fatalf("k2 token after k1 removed: %v", err)
+	}
+}
+
+func TestLoadKeysFile(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	newTestHub(t, dir)
+	path := filepath.Join(dir, "bad.json")
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"not json", `{"current":`},
+		{"no current", `{"keys":{"k1":"` + testSecret1 + `"}}`},
+		{"current not in keys", `{"current":"k2","keys":{"k1":"` + testSecret1 + `"}}`},
+		{"short secret", `{"current":"k1","keys":{"k1":"short"}}`},
+		{"kid with dot", `{"current":"k.1","keys":{"k.1":"` + testSecret1 + `"}}`},
+	}
+	for _, c := range cases {
+		writeKeysFile(t, path, c.data)
+		k := newKeyRing()
+		if _, err := k.load(path, true); err == nil {
+			t.Errorf("%s: loaded", c.name)
+		}
+	}
+
+	//a bad file keeps the keys loaded before
+	good := filepath.Join(dir, "keys.json")
+	k := newKeyRing()
+	if _, err := k.load(good, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.load(path, true); err == nil {
+		t.Fatal("bad file loaded")
+	}
+	if kid, _ := k.currentKey(); kid != "k1" {
+		t.Fatalf("current kid %q after bad reload, want k1", kid)
+	}
+	if changed, err := k.load(good, false); changed || err != nil {
+		t.Fatalf("unmodified file reload changed %v err %v", changed, err)
+	}
+}
+
+func TestCreateKeysFile(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	newTestHub(t, dir)
+	path := filepath.Join(dir, "new.json")
+
+	created, err := createKeysFile(path)
+	if err != nil || !created {
+		t.Fatalf("created %v err %v", created, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("keys file mode %v, want 0600", info.Mode().Perm())
+	}
+	k := newKeyRing()
+	if _, err := k.load(path, true); err != nil {
+		t.Fatalf("load created keys file: %v", err)
+	}
+	if kid, key := k.currentKey(); kid != "k1" || len(key) < 32 {
+		t.Fatalf("created key %s len %d", kid, len(key))
+	}
+
+	//existing file is never overwritten
+	data, _ := ioutil.ReadFile(path)
+	created, err = createKeysFile(path)
+	if err != nil || created {
+		t.Fatalf("second create: created %v err %v", created, err)
+	}
+	again, _ := ioutil.ReadFile(path)
+	if string(again) != string(data) {
+		t.Fatal("existing keys file changed")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	h := newTestHub(t, dir)
+	now := time.Now()
+	v1 := issue(h, "u1", now.Add(-time.Minute))
+	v2 := issue(h, "u1", now.Add(-time.Second*30))
+	other := issue(h, "u2", now.Add(-time.Minute))
+
+	//one token
+	if err := h.revoke(&define.RevokeTokenStruct{Token: v1.Token, Timestamp: v1.Timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if h.verify(v1) == nil {
+		t.Fatal("revoked token valid")
+	}
+	if err := h.verify(v2); err != nil {
+		t.Fatalf("other token of user: %v", err)
+	}
+
+	//all tokens of u1 issued before now - 10s
+	if err := h.revoke(&define.RevokeTokenStruct{UserID: "u1", Timestamp: timestampOf(now.Add(-time.Second * 10))}); err != nil {
+		t.Fatal(err)
+	}
+	if h.verify(v2) == nil {
+		t.Fatal("token issued before user revocation valid")
+	}
+	if err := h.verify(issue(h, "u1", now)); err != nil {
+		t.Fatalf("token issued after user revocation: %v", err)
+	}
+	if err := h.verify(other); err != nil {
+		t.Fatalf("token of other user: %v", err)
+	}
+
+	//an older user revocation does not move it back
+	h.revoke(&define.RevokeTokenStruct{UserID: "u1", Timestamp: timestampOf(now.Add(-time.Hour))})
+	if h.verify(v2) == nil {
+		t.Fatal("older user revocation undid the newer one")
+	}
+
+	if h.revoke(&define.RevokeTokenStruct{UserID: "u1", Timestamp: "abc"}) == nil {
+		t.Fatal("bad timestamp accepted")
+	}
+}
+
+func TestRevokeClean(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	h := newTestHub(t, dir)
+	now := time.Now()
+	h.revoke(&define.RevokeTokenStruct{Token: "k1.aa", Timestamp: timestampOf(now)})
+	h.revoke(&define.RevokeTokenStruct{UserID: "u1", Timestamp: timestampOf(now)})
+
+	h.clean(now.Add(time.Second * time.Duration(gExpireSeconds-1)))
+	if _, ok := h.revokedTokens.Load("k1.aa"); !ok {
+		t.Fatal("token revocation cleaned before token expired")
+	}
+	if _, ok := h.revokedUsers.Load("u1"); !ok {
+		t.Fatal("user revocation cleaned before tokens expired")
+	}
+	h.clean(now.Add(time.Second*time.Duration(gExpireSeconds) + maxClockSkew + time.Second))
+	if _, ok := h.revokedTokens.Load("k1.aa"); ok {
+		t.Fatal("token revocation kept after token expired")
+	}
+	if _, ok := h.revokedUsers.Load("u1"); ok {
+		t.Fatal("user revocation kept after tokens expired")
+	}
+}
+
+//TestRevokePersist revocations survive a restart, expired ones are dropped from the log
+func TestRevokePersist(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	logPath := filepath.Join(dir, "node.revoked.log")
+	now := time.Now()
+
+	h := newTestHub(t, dir)
+	if err := h.openRevokeLog(logPath); err != nil {
+		t.Fatal(err)
+	}
+	v1 := issue(h, "u1", now.Add(-time.Minute))
+	v2 := issue(h, "u2", now.Add(-time.Minute))
+	h.revoke(&define.RevokeTokenStruct{Token: v1.Token, Timestamp: v1.Timestamp})
+	h.revoke(&define.RevokeTokenStruct{UserID: "u2", Timestamp: timestampOf(now)})
+	//already expired, dropped on reload
+	h.revoke(&define.RevokeTokenStruct{Token: "k1.old", Timestamp: timestampOf(now.Add(-time.Second * time.Duration(gExpireSeconds+60)))})
+	h.revokeLog.Close()
+
+	//torn last line from a kill during append
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"token":"k1.torn","timest`)
+	f.Close()
+
+	h2 := newTestHub(t, dir)
+	if err := h2.openRevokeLog(logPath); err != nil {
+		t.Fatal(err)
+	}
+	defer h2.revokeLog.Close()
+	if h2.verify(v1) == nil {
+		t.Fatal("revoked token valid after restart")
+	}
+	if h2.verify(v2) == nil {
+		t.Fatal("revoked user token valid after restart")
+	}
+	if _, ok := h2.revokedTokens.Load("k1.old"); ok {
+		t.Fatal("expired revocation loaded")
+	}
+
+	//the log was rewritten without the expired and torn lines
+	count := 0
+	h2.revokeLog.load(func(r *define.RevokeTokenStruct) { count++ })
+	if count != 2 {
+		t.Fatalf("revoke log has %d records after rewrite, want 2", count)
+	}
+
+	//appends after a rewrite still go to the log
+	v3 := issue(h2, "u3", now)
+	h2.revoke(&define.RevokeTokenStruct{Token: v3.Token, Timestamp: v3.Timestamp})
+	h2.revokeLog.Close()
+	h3 := newTestHub(t, dir)
+	if err := h3.openRevokeLog(logPath); err != nil {
+		t.Fatal(err)
+	}
+	defer h3.revokeLog.Close()
+	if h3.verify(v3) == nil {
+		t.Fatal("token revoked after rewrite valid after restart")
+	}
+}
+
+//TestRevokeBroadcastOnce the broadcast of a local revoke come back to this node, it is not logged again
+func TestRevokeBroadcastOnce(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	logPath := filepath.Join(dir, "node.revoked.log")
+	h := newTestHub(t, dir)
+	if err := h.openRevokeLog(logPath); err != nil {
+		t.Fatal(err)
+	}
+	defer h.revokeLog.Close()
+	oldHub := gTokenHub
+	gTokenHub = h
+	defer func() { gTokenHub = oldHub }()
+
+	now := time.Now()
+	revocations := []*define.RevokeTokenStruct{
+		{Token: "k1.aa", Timestamp: timestampOf(now)},
+		{UserID: "u1", Timestamp: timestampOf(now)},
+		{Token: "k1.bb", UserID: "u2", Timestamp: timestampOf(now)},
+	}
+	for _, r := range revocations {
+		if err := h.revoke(r); err != nil {
+			t.Fatal(err)
+		}
+		eventInRevoke(&protocol.MsEvent{Data: r})
+	}
+	//older user revocation changes nothing either
+	eventInRevoke(&protocol.MsEvent{Data: &define.RevokeTokenStruct{UserID: "u1", Timestamp: timestampOf(now.Add(-time.Minute))}})
+
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != len(revocations) {
+		t.Fatalf("revoke log has %d lines, want %d", lines, len(revocations))
+	}
+
+	//a newer user revocation is applied and logged
+	eventInRevoke(&protocol.MsEvent{Data: &define.RevokeTokenStruct{UserID: "u1", Timestamp: timestampOf(now.Add(time.Minute))}})
+	data, _ = ioutil.ReadFile(logPath)
+	if lines := strings.Count(string(data), "\n"); lines != len(revocations)+1 {
+		t.Fatalf("newer revocation not logged, %d lines", lines)
+	}
+}
+
+//TestRevokeLogRewriteFail a failed rename keep the old file open for append
+func TestRevokeLogRewriteFail(t *testing.T) {
+	dir, remove := testDir(t)
+	defer remove()
+	newTestHub(t, dir)
+	logPath := filepath.Join(dir, "node.revoked.log")
+	l, err := openRevokeLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.append(&define.RevokeTokenStruct{Token: "k1.aa", Timestamp: "1500000000000"})
+
+	rename = func(oldpath, newpath string) error { return errors.New("rename failed") }
+	defer func() { rename = os.Rename }()
+	if l.rewrite(nil) == nil {
+		t.Fatal("rewrite with failed rename returned nil")
+	}
+	if _, err := os.Stat(logPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("tmp file left after failed rename")
+	}
+	if err := l.append(&define.RevokeTokenStruct{Token: "k1.bb", Timestamp: "1500000000000"}); err != nil {
+		t.Fatalf("append after failed rewrite: %v", err)
+	}
+	tokens := make([]string, 0)
+	l.load(func(r *define.RevokeTokenStruct) {
+		tokens = append(tokens, r.Token)
+	})
+	if strings.Join(tokens, ",") != "k1.aa,k1.bb" {
+		t.Fatalf("log after failed rewrite has %v, want k1.aa,k1.bb", tokens)
+	}
+}
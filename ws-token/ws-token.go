@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	// _ "net/http/pprof" //https://localhost:12220/debug/pprof
+
+	"github.com/roytan883/micro-services/define"
+	moleculer "github.com/roytan883/moleculer-go"
+	"github.com/roytan883/moleculer-go/protocol"
+)
+
+var pBroker *moleculer.ServiceBroker
+var gMoleculerService *moleculer.Service
+
+func setupMoleculerService() {
+	//init service and broker
+	config := &moleculer.ServiceBrokerConfig{
+		NatsHost:              gNatsHosts,
+		NodeID:                gNodeID,
+		DefaultRequestTimeout: time.Second * 3,
+		// LogLevel: moleculer.DebugLevel,
+		LogLevel: moleculer.ErrorLevel,
+		Services: make(map[string]moleculer.Service),
+	}
+	moleculerService := createMoleculerService()
+	config.Services[ServiceName] = moleculerService
+	broker, err := moleculer.NewServiceBroker(config)
+	if err != nil {
+		log.Fatalf("NewServiceBroker err: %v\n", err)
+	}
+	pBroker = broker
+	err = broker.Start()
+	if err != nil {
+		log.Fatalf("exit process, broker.Start err: %v\n", err)
+		return
+	}
+}
+
+func createMoleculerService() moleculer.Service {
+	gMoleculerService = &moleculer.Service{
+		ServiceName: ServiceName,
+		Actions:     make(map[string]moleculer.RequestHandler),
+		Events:      make(map[string]moleculer.EventHandler),
+	}
+
+	//init actions handlers
+	gMoleculerService.Actions["verify"] = actionVerify
+	gMoleculerService.Actions["issue"] = actionIssue
+	gMoleculerService.Actions["revoke"] = actionRevoke
+	gMoleculerService.Actions["reloadKeys"] = actionReloadKeys
+
+	//init listen events handlers
+	gMoleculerService.Events[define.WsTokenInRevoke] = eventInRevoke
+	gMoleculerService.Events[define.WsTokenInReloadKeys] = eventInReloadKeys
+
+	//init hub
+	gTokenHub = &TokenHub{
+		keyRing:       newKeyRing(),
+		revokedTokens: &sync.Map{},
+		revokedUsers:  &sync.Map{},
+		hubClosed:     make(chan int, 1),
+	}
+	created, err := createKeysFile(gKeysFile)
+	if err != nil {
+		log.Fatalf("create keys file[%s] err: %v\n", gKeysFile, err)
+	}
+	if created {
+		log.Warnf("keys file[%s] not found, created one with a random key, copy it to every ws-token node\n", gKeysFile)
+	}
+	_, err = gTokenHub.keyRing.load(gKeysFile, true)
+	if err != nil {
+		log.Fatalf("load keys file[%s] err: %v\n", gKeysFile, err)
+	}
+	if len(gDataDir) > 0 {
+		os.MkdirAll(gDataDir, os.ModePerm)
+		err = gTokenHub.openRevokeLog(filepath.Join(gDataDir, gNodeID+".revoked.log"))
+		if err != nil {
+			log.Fatalf("open revoke log err: %v\n", err)
+		}
+	}
+	gTokenHub.run()
+
+	return *gMoleculerService
+}
+
+//mol $ call ws-token.verify --userID uaaa --platform web --version 0.1.0 --timestamp 1507870585757 --token k1.xxxx
+func actionVerify(req *protocol.MsRequest) (interface{}, error) {
+	jsonObj := &define.VerifyTokenStruct{}
+	err := define.Decode(req.Params, jsonObj)
+	if err != nil {
+		log.Warn("run actionVerify, parse req.Params to jsonObj VerifyTokenStruct error: ", err)
+		return nil, err
+	}
+	err = gTokenHub.verify(jsonObj)
+	if err != nil {
+		log.Warnf("run actionVerify, invalid token: %s, err: %v\n", jsonObj.String(), err)
+		return &define.VerifyTokenResultStruct{Invalid: true}, nil
+	}
+	log.Info("run actionVerify, valid token: ", jsonObj.String())
+	return &define.VerifyTokenResultStruct{Invalid: false}, nil
+}
+
+//mol $ call ws-token.issue --userID uaaa --platform web --version 0.1.0
+func actionIssue(req *protocol.MsRequest) (interface{}, error) {
+	jsonObj := &define.IssueTokenStruct{}
+	err := define.Decode(req.Params, jsonObj)
+	if err != nil {
+		log.Warn("run actionIssue, parse req.Params to jsonObj IssueTokenStruct error: ", err)
+		return nil, err
+	}
+	if len(jsonObj.UserID) < 1 || len(jsonObj.Platform) < 1 || len(jsonObj.Version) < 1 {
+		return nil, errors.New("need userID, platform and version")
+	}
+	timestamp := getNowTimestamp()
+	kid, key := gTokenHub.keyRing.currentKey()
+	token := signToken(kid, key, jsonObj.UserID, jsonObj.Platform, jsonObj.Version, timestamp)
+	log.Infof("run actionIssue, userID[%s] platform[%s] version[%s] kid[%s]\n", jsonObj.UserID, jsonObj.Platform, jsonObj.Version, kid)
+	return &define.IssueTokenResultStruct{
+		Timestamp: timestamp,
+		Token:     token,
+	}, nil
+}
+
+//mol $ call ws-token.revoke --userID uaaa
+//mol $ call ws-token.revoke --token k1.xxxx --timestamp 1507870585757
+func actionRevoke(req *protocol.MsRequest) (interface{}, error) {
+	jsonObj := &define.RevokeTokenStruct{}
+	err := define.Decode(req.Params, jsonObj)
+	if err != nil {
+		log.Warn("run actionRevoke, parse req.Params to jsonObj RevokeTokenStruct error: ", err)
+		return nil, err
+	}
+	if len(jsonObj.Token) < 1 && len(jsonObj.UserID) < 1 {
+		return nil, errors.New("need token or userID")
+	}
+	if len(jsonObj.Timestamp) < 1 {
+		jsonObj.Timestamp = getNowTimestamp()
+	}
+	err = gTokenHub.revoke(jsonObj)
+	if err != nil {
+		return nil, err
+	}
+	//let other ws-token nodes know
+	pBroker.Broadcast(define.WsTokenInRevoke, jsonObj)
+	return nil, nil
+}
+
+func eventInRevoke(req *protocol.MsEvent) {
+	log.Info("run eventInRevoke, req.Data = ", req.Data)
+	jsonObj := &define.RevokeTokenStruct{}
+	err := define.Decode(req.Data, jsonObj)
+	if err != nil {
+		log.Warn("run eventInRevoke, parse req.Data to jsonObj RevokeTokenStruct error: ", err)
+		return
+	}
+	err = gTokenHub.revoke(jsonObj)
+	if err != nil {
+		log.Warn("run eventInRevoke, revoke error: ", err)
+	}
+}
+
+//mol $ call ws-token.reloadKeys
+func actionReloadKeys(req *protocol.MsRequest) (interface{}, error) {
+	log.Warn("run actionReloadKeys")
+	_, err := gTokenHub.keyRing.load(gKeysFile, true)
+	if err != nil {
+		log.Warnf("run actionReloadKeys, load keys file[%s] err: %v\n", gKeysFile, err)
+		return nil, err
+	}
+	pBroker.Broadcast(define.WsTokenInReloadKeys, nil)
+	return nil, nil
+}
+
+func eventInReloadKeys(req *protocol.MsEvent) {
+	log.Warn("run eventInReloadKeys")
+	_, err := gTokenHub.keyRing.load(gKeysFile, true)
+	if err != nil {
+		log.Warnf("run eventInReloadKeys, load keys file[%s] err: %v\n", gKeysFile, err)
+	}
+}
+
+var gTokenHub *TokenHub
+
+//TokenHub ...
+type TokenHub struct {
+	keyRing       *KeyRing
+	revokedTokens *sync.Map  //~= sync.Map[string(token)]time.Time(token expire time)
+	revokedUsers  *sync.Map  //~= sync.Map[string(UserID)]time.Time(tokens issued before it are revoked)
+	revokeLog     *revokeLog //nil keep revocations in memory only
+	hubClosed     chan int
+}
+
+//openRevokeLog load revocations saved before restart, later ones are appended to it
+func (h *TokenHub) openRevokeLog(path string) error {
+	l, err := openRevokeLog(path)
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = l.load(func(r *define.RevokeTokenStruct) {
+		if applied, _ := h.apply(r); applied {
+			count++
+		}
+	})
+	if err != nil {
+		l.Close()
+		return err
+	}
+	h.revokeLog = l
+	h.clean(time.Now())
+	log.Warnf("TokenHub load revocations from [%s]: %d\n", path, count)
+	return nil
+}
+
+func (h *TokenHub) verify(v *define.VerifyTokenStruct) error {
+	if len(v.UserID) < 1 || len(v.Platform) < 1 || len(v.Version) < 1 || len(v.Timestamp) < 1 || len(v.Token) < 1 {
+		return errors.New("need userID, platform, version, timestamp and token")
+	}
+	issueTime, err := timestampToTime(v.Timestamp)
+	if err != nil {
+		return errors.New("bad timestamp")
+	}
+	now := time.Now()
+	if issueTime.After(now.Add(maxClockSkew)) {
+		return errors.New("timestamp in the future")
+	}
+	if now.Sub(*issueTime) > time.Second*time.Duration(gExpireSeconds) {
+		return errors.New("token expired")
+	}
+	err = h.keyRing.checkTokenSign(v.Token, v.UserID, v.Platform, v.Version, v.Timestamp)
+	if err != nil {
+		return err
+	}
+	if _, ok := h.revokedTokens.Load(v.Token); ok {
+		return errors.New("token revoked")
+	}
+	if revokeTime, ok := h.revokedUsers.Load(v.UserID); ok {
+		if !issueTime.After(revokeTime.(time.Time)) {
+			return errors.New("user tokens revoked")
+		}
+	}
+	return nil
+}
+
+//revoke apply r and save it to revokeLog
+func (h *TokenHub) revoke(r *define.RevokeTokenStruct) error {
+	applied, err := h.apply(r)
+	if err != nil || !applied || h.revokeLog == nil {
+		return err
+	}
+	err = h.revokeLog.append(r)
+	if err != nil {
+		log.Warn("TokenHub save revocation error: ", err)
+	}
+	return nil
+}
+
+//apply r in memory, applied false if nothing changed: already revoked, or older than the current user revocation
+func (h *TokenHub) apply(r *define.RevokeTokenStruct) (applied bool, err error) {
+	revokeTime, err := timestampToTime(r.Timestamp)
+	if err != nil {
+		return false, errors.New("bad timestamp")
+	}
+	expireTime := revokeTime.Add(time.Second * time.Duration(gExpireSeconds))
+	//already known (the broadcast of a local revoke come back to this node too) is not applied again
+	if len(r.Token) > 0 {
+		if old, ok := h.revokedTokens.Load(r.Token); !ok || old.(time.Time).Before(expireTime) {
+			log.Warn("TokenHub revoke token: ", r.Token)
+			h.revokedTokens.Store(r.Token, expireTime)
+			applied = true
+		}
+	}
+	if len(r.UserID) > 0 {
+		if old, ok := h.revokedUsers.Load(r.UserID); !ok || old.(time.Time).Before(*revokeTime) {
+			log.Warnf("TokenHub revoke userID[%s] tokens before: %v\n", r.UserID, *revokeTime)
+			h.revokedUsers.Store(r.UserID, *revokeTime)
+			applied = true
+		}
+	}
+	return applied, nil
+}
+
+//clean drop revocations whose tokens are all expired, and rewrite revokeLog without them
+func (h *TokenHub) clean(now time.Time) {
+	cleaned := 0
+	h.revokedTokens.Range(func(key, value interface{}) bool {
+		if now.After(value.(time.Time)) {
+			h.revokedTokens.Delete(key)
+			cleaned++
+		}
+		return true
+	})
+	h.revokedUsers.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(time.Time)) > time.Second*time.Duration(gExpireSeconds)+maxClockSkew {
+			h.revokedUsers.Delete(key)
+			cleaned++
+		}
+		return true
+	})
+	if cleaned > 0 && h.revokeLog != nil {
+		err := h.revokeLog.rewrite(h.revokeRecords())
+		if err != nil {
+			log.Warn("TokenHub rewrite revoke log error: ", err)
+		}
+	}
+}
+
+//Close ...
+func (h *TokenHub) Close() {
+	h.hubClosed <- 1
+	if h.revokeLog != nil {
+		h.revokeLog.Close()
+	}
+}
+
+func (h *TokenHub) run() {
+	go func() {
+		reloadTicker := time.NewTicker(reloadKeysPeriod)
+		cleanTicker := time.NewTicker(time.Minute * 1)
+		for {
+			select {
+			case <-reloadTicker.C:
+				changed, err := h.keyRing.load(gKeysFile, false)
+				if err != nil {
+					log.Warnf("TokenHub reload keys file[%s] err: %v\n", gKeysFile, err)
+				} else if changed {
+					log.Warnf("TokenHub keys file[%s] reloaded\n", gKeysFile)
+				}
+			case now := <-cleanTicker.C:
+				//revoked entries are useless once all the tokens they cover are expired
+				h.clean(now)
+			case <-h.hubClosed:
+				reloadTicker.Stop()
+				cleanTicker.Stop()
+				return
+			}
+		}
+	}()
+}